@@ -1,10 +1,12 @@
 package aesgcm
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 
 	"github.com/ahui2016/recoit/util"
 	"golang.org/x/crypto/scrypt"
@@ -14,6 +16,9 @@ const (
 	saltSize = 8
 	keySize  = 32
 
+	// SaltSize 是 DeriveKey 所用的 salt 的长度 (参考 NewSalt)。
+	SaltSize = 16
+
 	// AES-GCM 要求 nonce 长度为 12，参考 https://pkg.go.dev/crypto/cipher#example-NewGCM-Encrypt
 	// Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
 	// 2^32 约等于 43 亿，因此个人使用不需要担心冲突。
@@ -34,6 +39,25 @@ func RandomKey() []byte {
 	return dk
 }
 
+// NewSalt 生成一个随机的 salt, 其长度为 SaltSize.
+func NewSalt() []byte {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+// DeriveKey 利用 scrypt 算法由密码及 salt 派生 key, 用于需要抵抗离线暴力破解的场合
+// (例如导出包)。同一个密码配合不同的 salt 得到不同的 key.
+func DeriveKey(password string, salt []byte) []byte {
+	dk, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, keySize)
+	if err != nil {
+		panic(err)
+	}
+	return dk
+}
+
 func Sha256(passphrase string) []byte {
 	key := sha256.Sum256([]byte(passphrase))
 	return key[:]
@@ -65,12 +89,13 @@ func NewGCM(key []byte) *AEAD {
 	if err != nil {
 		panic(err)
 	}
-	return &AEAD{gcm}
+	return &AEAD{gcm: gcm, key: key}
 }
 
 // AEAD 只是简单地包裹了 cipher.AEAD, 以便提供更方便的 Seal 和 Open 方法。
 type AEAD struct {
 	gcm cipher.AEAD
+	key []byte // 用来派生分块加密的子密钥 (参考 EncryptChunks)
 }
 
 // Seal 参考了 nacl/secretbox 的做法，将 nonce 与密文绑在一起。
@@ -85,7 +110,17 @@ func (aead AEAD) Encrypt(plaintext []byte) []byte {
 }
 
 // Decrypt 解密 ciphertext, nonce 从 ciphertext 里获取。
+// 也可以解密 EncryptChunks 生成的分块密文。
 func (aead AEAD) Decrypt(ciphertext []byte) ([]byte, error) {
+	if IsChunked(ciphertext) {
+		if plaintext, err := aead.decryptChunks(ciphertext); err == nil {
+			return plaintext, nil
+		}
+		// 随机 nonce 碰巧以 chunkMagic 开头的普通密文，按普通密文处理。
+	}
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
 	plaintext, err := aead.gcm.Open(
 		nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
 	if err != nil {
@@ -93,3 +128,16 @@ func (aead AEAD) Decrypt(ciphertext []byte) ([]byte, error) {
 	}
 	return plaintext, nil
 }
+
+func (aead AEAD) decryptChunks(ciphertext []byte) ([]byte, error) {
+	cr, err := aead.NewChunkReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, 0, cr.Size())
+	buf := bytes.NewBuffer(plaintext)
+	if _, err := buf.ReadFrom(cr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,6 +1,8 @@
 package aesgcm
 
 import (
+	"bytes"
+	"io/ioutil"
 	"testing"
 
 	"github.com/ahui2016/recoit/util"
@@ -28,3 +30,63 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatal("decryptText is not equal to plaintext")
 	}
 }
+
+func TestEncryptChunks(t *testing.T) {
+	gcm := NewGCM(RandomKey())
+	for _, size := range []int{0, 1, ChunkSize, ChunkSize*2 + 3} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		ciphertext := gcm.EncryptChunks(plaintext)
+
+		decryptText, err := gcm.Decrypt(ciphertext)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(decryptText, plaintext) {
+			t.Fatalf("size %d: decryptText is not equal to plaintext", size)
+		}
+
+		cr, err := gcm.NewChunkReader(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if cr.Size() != int64(size) {
+			t.Fatalf("size %d: got Size() %d", size, cr.Size())
+		}
+		streamed, err := ioutil.ReadAll(cr)
+		if err != nil || !bytes.Equal(streamed, plaintext) {
+			t.Fatalf("size %d: stream decryption failed: %v", size, err)
+		}
+
+		// 边读边加密的结果应该能同样解密。
+		ce := gcm.NewChunkEncrypter(bytes.NewReader(plaintext), int64(size))
+		encrypted, err := ioutil.ReadAll(ce)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if int64(len(encrypted)) != ChunkedSize(int64(size)) || len(encrypted) != len(ciphertext) {
+			t.Fatalf("size %d: got ciphertext length %d", size, len(encrypted))
+		}
+		if decryptText, err = gcm.Decrypt(encrypted); err != nil || !bytes.Equal(decryptText, plaintext) {
+			t.Fatalf("size %d: streamed ciphertext failed: %v", size, err)
+		}
+
+		// 截断或附加数据都应该解密失败。
+		if size > 0 {
+			if _, err := gcm.Decrypt(ciphertext[:len(ciphertext)-1]); err == nil {
+				t.Fatalf("size %d: truncated ciphertext should fail", size)
+			}
+		}
+		if _, err := gcm.Decrypt(append(ciphertext, 0)); err == nil {
+			t.Fatalf("size %d: trailing data should fail", size)
+		}
+		// 子密钥由 header 里的 salt 派生，改动 salt 就不能解密。
+		tampered := append([]byte{}, ciphertext...)
+		tampered[ChunkHeaderSize-1] ^= 1
+		if _, err := gcm.Decrypt(tampered); err == nil {
+			t.Fatalf("size %d: a changed salt should fail", size)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package aesgcm
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// 分块加密：把明文切成 ChunkSize 大小的块，每块单独加密，
+// 因此解密时可以边读边解密，不需要把整个密文读进内存 (参考 ChunkReader)。
+//
+// 格式为 header + 若干个密文块，header 由 chunkMagic, 明文长度 (uint64) 及随机的 salt 组成。
+// 每个密文用 HKDF(key, salt) 派生的子密钥加密，因此 nonce 只需要在同一个密文里不重复:
+// 每块的 nonce 为块序号 (uint32) + 是否最后一块。每块以 header 作为附加数据，
+// 因此删除、调换、截断密文块或改动 header 都会导致解密失败。
+const (
+	// ChunkSize 是每个密文块里的明文长度 (最后一块可以较短)。
+	ChunkSize = 64 << 10
+
+	// ChunkHeaderSize 是分块密文的 header 的长度。
+	ChunkHeaderSize = len(chunkMagic) + 8 + chunkSaltSize
+
+	chunkMagic    = "RCS1"
+	chunkSaltSize = 32
+	chunkInfo     = "recoit chunks"
+	tagSize       = 16
+)
+
+// IsChunked 判断 data (只需要开头的几个字节) 是否分块加密的密文。
+func IsChunked(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(chunkMagic))
+}
+
+func chunkNonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint32(nonce[nonceSize-5:], counter)
+	if last {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+// subkey 返回用 header 里的 salt 派生的子密钥的 cipher.AEAD.
+func (aead AEAD) subkey(header []byte) cipher.AEAD {
+	salt := header[len(chunkMagic)+8:]
+	kdf := hkdf.New(sha256.New, aead.key, salt, []byte(chunkInfo))
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		panic(err)
+	}
+	return NewGCM(key).gcm
+}
+
+// newChunkHeader 返回明文长度为 size 的分块密文的 header (带随机的 salt)。
+func newChunkHeader(size int64) []byte {
+	header := make([]byte, ChunkHeaderSize)
+	copy(header, chunkMagic)
+	binary.BigEndian.PutUint64(header[len(chunkMagic):], uint64(size))
+	if _, err := rand.Read(header[len(chunkMagic)+8:]); err != nil {
+		panic(err)
+	}
+	return header
+}
+
+// chunkCount 返回明文长度为 size 时的块数。
+func chunkCount(size int64) int64 {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1 // 空的明文也要有一个 (空的) 最后一块。
+	}
+	return chunks
+}
+
+// ChunkedSize 返回明文长度为 size 时分块密文的长度。
+func ChunkedSize(size int64) int64 {
+	return int64(ChunkHeaderSize) + size + chunkCount(size)*tagSize
+}
+
+// EncryptChunks 采用分块加密的格式加密 plaintext (参考 ChunkReader)。
+func (aead AEAD) EncryptChunks(plaintext []byte) []byte {
+	header := newChunkHeader(int64(len(plaintext)))
+	gcm := aead.subkey(header)
+
+	chunks := int(chunkCount(int64(len(plaintext))))
+	ciphertext := make([]byte, 0, ChunkedSize(int64(len(plaintext))))
+	ciphertext = append(ciphertext, header...)
+	for i := 0; i < chunks; i++ {
+		start := i * ChunkSize
+		end := start + ChunkSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		nonce := chunkNonce(uint32(i), i == chunks-1)
+		ciphertext = gcm.Seal(ciphertext, nonce, plaintext[start:end], header)
+	}
+	return ciphertext
+}
+
+// ChunkEncrypter 从 r 读取明文，输出分块加密的密文 (与 EncryptChunks 的结果格式相同),
+// 每次只加密一块，因此不需要把整个明文读进内存。
+type ChunkEncrypter struct {
+	gcm     cipher.AEAD // 子密钥
+	r       io.Reader
+	header  []byte
+	size    int64 // 明文长度
+	read    int64 // 已加密的明文长度
+	counter uint32
+	buf     []byte // 已加密但未被读取的密文
+	chunk   []byte
+	err     error
+}
+
+// NewChunkEncrypter 返回一个 ChunkEncrypter, r 必须正好有 size 字节的明文，
+// 密文的长度是 ChunkedSize(size).
+func (aead AEAD) NewChunkEncrypter(r io.Reader, size int64) *ChunkEncrypter {
+	header := newChunkHeader(size)
+	return &ChunkEncrypter{
+		gcm:    aead.subkey(header),
+		r:      r,
+		header: header,
+		size:   size,
+		buf:    header,
+		chunk:  make([]byte, ChunkSize+tagSize),
+	}
+}
+
+// next 读取并加密下一块。
+func (ce *ChunkEncrypter) next() error {
+	n := ce.size - ce.read
+	last := n <= ChunkSize
+	if !last {
+		n = ChunkSize
+	}
+	plaintext := ce.chunk[:n]
+	if _, err := io.ReadFull(ce.r, plaintext); err != nil {
+		return errors.New("plaintext shorter than the given size")
+	}
+	nonce := chunkNonce(ce.counter, last)
+	ce.buf = ce.gcm.Seal(plaintext[:0], nonce, plaintext, ce.header)
+	ce.counter++
+	ce.read += n
+	return nil
+}
+
+// Read 实现 io.Reader.
+func (ce *ChunkEncrypter) Read(p []byte) (int, error) {
+	for len(ce.buf) == 0 {
+		if ce.err != nil {
+			return 0, ce.err
+		}
+		if int64(ce.counter) == chunkCount(ce.size) {
+			return 0, io.EOF
+		}
+		if ce.err = ce.next(); ce.err != nil {
+			return 0, ce.err
+		}
+	}
+	n := copy(p, ce.buf)
+	ce.buf = ce.buf[n:]
+	return n, nil
+}
+
+// ChunkReader 从 r 读取分块加密的密文，每次只解密一块。
+type ChunkReader struct {
+	gcm     cipher.AEAD // 子密钥
+	r       io.Reader
+	header  []byte
+	size    int64 // 明文长度
+	read    int64 // 已解密的明文长度
+	counter uint32
+	buf     []byte // 已解密但未被读取的明文
+	chunk   []byte
+	err     error
+}
+
+// NewChunkReader 读取 header 并解密第一块，以便尽早发现密钥或格式错误。
+func (aead AEAD) NewChunkReader(r io.Reader) (*ChunkReader, error) {
+	header := make([]byte, ChunkHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.NewChunkReaderAt(header, r, 0)
+}
+
+// NewChunkReaderAt 与 NewChunkReader 相同，但 header 已另外读取 (参考 ChunkReader.Header),
+// 而 r 从第 counter 块开始 (即密文的 ChunkStart(counter) 处), 用于只下载对象的一部分。
+func (aead AEAD) NewChunkReaderAt(header []byte, r io.Reader, counter int64) (*ChunkReader, error) {
+	if len(header) != ChunkHeaderSize || !IsChunked(header) {
+		return nil, errors.New("not a chunked ciphertext")
+	}
+	size := binary.BigEndian.Uint64(header[len(chunkMagic):])
+	if size > 1<<62 {
+		return nil, errors.New("invalid plaintext size")
+	}
+	if counter < 0 || (counter > 0 && counter*ChunkSize >= int64(size)) {
+		return nil, errors.New("chunk out of range")
+	}
+	cr := &ChunkReader{
+		gcm:     aead.subkey(header),
+		r:       r,
+		header:  header,
+		size:    int64(size),
+		read:    counter * ChunkSize,
+		counter: uint32(counter),
+		chunk:   make([]byte, ChunkSize+tagSize),
+	}
+	if err := cr.next(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// ChunkStart 返回第 counter 块在密文里的位置。
+func ChunkStart(counter int64) int64 {
+	return int64(ChunkHeaderSize) + counter*(ChunkSize+tagSize)
+}
+
+// Header 返回密文的 header.
+func (cr *ChunkReader) Header() []byte {
+	return cr.header
+}
+
+// Size 返回明文的长度。
+func (cr *ChunkReader) Size() int64 {
+	return cr.size
+}
+
+// next 读取并解密下一块。
+func (cr *ChunkReader) next() error {
+	remaining := cr.size - cr.read
+	n := int64(ChunkSize)
+	last := remaining <= n
+	if last {
+		n = remaining
+	}
+	chunk := cr.chunk[:n+tagSize]
+	if _, err := io.ReadFull(cr.r, chunk); err != nil {
+		return errors.New("ciphertext truncated")
+	}
+	nonce := chunkNonce(cr.counter, last)
+	plaintext, err := cr.gcm.Open(chunk[:0], nonce, chunk, cr.header)
+	if err != nil {
+		return err
+	}
+	if last {
+		// 最后一块之后不应该还有数据。
+		var extra [1]byte
+		if k, _ := io.ReadFull(cr.r, extra[:]); k > 0 {
+			return errors.New("unexpected data after the last chunk")
+		}
+	}
+	cr.counter++
+	cr.read += n
+	cr.buf = plaintext
+	return nil
+}
+
+// Read 实现 io.Reader.
+func (cr *ChunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.read == cr.size {
+			return 0, io.EOF
+		}
+		if cr.err = cr.next(); cr.err != nil {
+			return 0, cr.err
+		}
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
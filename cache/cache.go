@@ -0,0 +1,243 @@
+// Package cache 管理服务器上解密后的本地文件 (临时文件、缓存文件及缩略图)，
+// 限制其总大小，超出时按最近访问时间 (Reco.AccessedAt) 删除最久未访问的文件。
+//
+// 文件的路径为 <dir>/<user>/<reco id><ext>, 每个文件是一个 Entry,
+// 同一个 reco 的全部文件共用同一个访问时间。
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Entry 是一个被管理的本地文件。
+type Entry struct {
+	Path       string
+	User       string
+	ID         string // Reco.ID
+	Size       int64
+	AccessedAt string // 与 Reco.AccessedAt 相同 (ISO8601), 可以直接比较大小
+}
+
+// Stats 是缓存的统计数据。
+type Stats struct {
+	Files     int
+	Bytes     int64
+	Budget    int64 // 0 表示不限大小
+	Evictions int64 // 启动以来因超出 Budget 而删除的文件数
+	UserFiles int   // 以下两项只计算某个用户的文件
+	UserBytes int64
+}
+
+// Manager 可在多个 goroutine 中同时使用。
+type Manager struct {
+	mu        sync.Mutex
+	budget    int64
+	entries   map[string]*Entry // key 是 Entry.Path
+	total     int64
+	evictions int64
+}
+
+// New 返回一个总大小不超过 budget (字节) 的 Manager, budget 为 0 表示不限大小。
+func New(budget int64) *Manager {
+	return &Manager{
+		budget:  budget,
+		entries: make(map[string]*Entry),
+	}
+}
+
+func recoKey(user, id string) string {
+	return user + "/" + id
+}
+
+// Scan 登记 dir 里已有的文件 (例如服务器重启后)。
+// accessedAt 返回 reco 的访问时间，ok 为 false 表示该 reco 已不存在，此时删除其文件。
+func (m *Manager) Scan(dir string, accessedAt func(user, id string) (string, bool)) error {
+	users, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		userDir := filepath.Join(dir, user)
+		info, err := os.Stat(userDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			continue
+		}
+		names, err := readDirNames(userDir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			path := filepath.Join(userDir, name)
+			id := strings.TrimSuffix(name, filepath.Ext(name))
+			accessed, ok := accessedAt(user, id)
+			if !ok {
+				if err := removeFile(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := m.Add(path, user, id, accessed); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// Add 登记一个刚写入的文件，然后在超出 budget 时删除最久未访问的文件。
+// 同一个 reco 的文件不会在这次被删除，因为通常马上就要用到。
+func (m *Manager) Add(path, user, id, accessedAt string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(path)
+	m.entries[path] = &Entry{
+		Path:       path,
+		User:       user,
+		ID:         id,
+		Size:       info.Size(),
+		AccessedAt: accessedAt,
+	}
+	m.total += info.Size()
+	return m.evict(recoKey(user, id))
+}
+
+// evict 删除最久未访问的文件，直到总大小不超过 budget. 调用者必须持有 m.mu.
+func (m *Manager) evict(keep string) error {
+	for m.budget > 0 && m.total > m.budget {
+		var oldest *Entry
+		for _, entry := range m.entries {
+			if recoKey(entry.User, entry.ID) == keep {
+				continue
+			}
+			if oldest == nil || entry.AccessedAt < oldest.AccessedAt {
+				oldest = entry
+			}
+		}
+		if oldest == nil {
+			return nil // 只剩下 keep 的文件
+		}
+		if err := removeFile(oldest.Path); err != nil {
+			return err
+		}
+		m.remove(oldest.Path)
+		m.evictions++
+	}
+	return nil
+}
+
+// Touch 更新 reco 的全部文件的访问时间。
+func (m *Manager) Touch(user, id, accessedAt string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := recoKey(user, id)
+	for _, entry := range m.entries {
+		if recoKey(entry.User, entry.ID) == key {
+			entry.AccessedAt = accessedAt
+		}
+	}
+}
+
+// Has 判断 path 是否已登记并且文件仍然存在。
+func (m *Manager) Has(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[path]; !ok {
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		m.remove(path)
+		return false
+	}
+	return true
+}
+
+// Remove 删除文件 path (不论是否已登记)。
+func (m *Manager) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := removeFile(path); err != nil {
+		return err
+	}
+	m.remove(path)
+	return nil
+}
+
+// Clear 删除 dir 里的全部文件 (包括子文件夹里的文件，但保留文件夹本身)。
+func (m *Manager) Clear(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		m.remove(path)
+		return removeFile(path)
+	})
+	if err != nil {
+		return err
+	}
+	// 也删除已登记但文件已不存在的记录。
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	for path := range m.entries {
+		if strings.HasPrefix(path, prefix) {
+			m.remove(path)
+		}
+	}
+	return nil
+}
+
+// remove 删除 path 的记录，调用者必须持有 m.mu.
+func (m *Manager) remove(path string) {
+	if entry, ok := m.entries[path]; ok {
+		m.total -= entry.Size
+		delete(m.entries, path)
+	}
+}
+
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stats 返回统计数据，其中 UserFiles 及 UserBytes 只计算用户 user 的文件。
+func (m *Manager) Stats(user string) Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := Stats{
+		Files:     len(m.entries),
+		Bytes:     m.total,
+		Budget:    m.budget,
+		Evictions: m.evictions,
+	}
+	for _, entry := range m.entries {
+		if entry.User == user {
+			stats.UserFiles++
+			stats.UserBytes += entry.Size
+		}
+	}
+	return stats
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "recoit-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeFile 写入 dir/user/name (size 字节), 返回其路径。
+func writeFile(t *testing.T, dir, user, name string, size int) string {
+	path := filepath.Join(dir, user, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestEvictLeastRecentlyAccessed(t *testing.T) {
+	dir := tempDir(t)
+	m := New(25)
+
+	a := writeFile(t, dir, "alice", "a.reco", 10)
+	b := writeFile(t, dir, "alice", "b.reco", 10)
+	bThumb := writeFile(t, dir, "alice", "b.small", 2)
+	for _, f := range []struct{ path, id, accessed string }{
+		{a, "a", "2020-01-02T00:00:00Z"},
+		{b, "b", "2020-01-01T00:00:00Z"},
+		{bThumb, "b", "2020-01-01T00:00:00Z"},
+	} {
+		if err := m.Add(f.path, "alice", f.id, f.accessed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b 比 a 更久未访问，但 touch 之后 a 变成最旧的。
+	m.Touch("alice", "b", "2020-01-03T00:00:00Z")
+	c := writeFile(t, dir, "bob", "c.reco", 10)
+	if err := m.Add(c, "bob", "c", "2020-01-04T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(a) || !exists(b) || !exists(bThumb) || !exists(c) {
+		t.Error("only a should be evicted")
+	}
+	stats := m.Stats("alice")
+	if stats.Files != 3 || stats.Bytes != 22 || stats.Evictions != 1 || stats.UserFiles != 2 || stats.UserBytes != 12 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	// 单个文件超出 budget 时，只保留它自己。
+	d := writeFile(t, dir, "bob", "d.reco", 30)
+	if err := m.Add(d, "bob", "d", "2019-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(d) || exists(b) || exists(c) {
+		t.Error("all other files should be evicted")
+	}
+}
+
+func TestScanAndClear(t *testing.T) {
+	dir := tempDir(t)
+	kept := writeFile(t, dir, "alice", "a.reco", 10)
+	deleted := writeFile(t, dir, "alice", "gone.reco", 10)
+
+	m := New(0)
+	err := m.Scan(dir, func(user, id string) (string, bool) {
+		return "2020-01-01T00:00:00Z", id != "gone"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Has(kept) || exists(deleted) {
+		t.Error("files of deleted recos should be removed")
+	}
+
+	if err := m.Clear(filepath.Join(dir, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if exists(kept) || m.Has(kept) || !exists(filepath.Join(dir, "alice")) {
+		t.Error("Clear should remove the files but keep the folder")
+	}
+	if stats := m.Stats("alice"); stats.Files != 0 || stats.Bytes != 0 {
+		t.Errorf("stats after Clear: %+v", stats)
+	}
+}
@@ -20,6 +20,9 @@ const (
 type ObjectStorage interface {
 	PutObject(string, io.ReadSeeker) error
 	GetObjectBody(string) (io.ReadCloser, error)
+
+	// GetObjectRange 返回对象从 offset 开始的 length 个字节，length < 0 表示直到结尾。
+	GetObjectRange(name string, offset, length int64) (io.ReadCloser, error)
 	DeleteObject(string) error
 	TryUploadDelete() error
 }
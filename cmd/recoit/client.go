@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionCookie, csrfCookie, csrfHeader 与 session 包里的常量相同。
+	sessionCookie = "RecoitSessionID"
+	csrfCookie    = "RecoitCSRF"
+	csrfHeader    = "X-CSRF-Token"
+
+	configDirName  = "recoit"
+	configFileName = "cli.json"
+	defaultServer  = "http://127.0.0.1:80"
+)
+
+// Config 保存在本地，以便 shell 脚本、cron 任务等多次调用时不需要重复登入。
+type Config struct {
+	Server    string
+	User      string
+	SessionID string
+	CSRFToken string
+
+	// Token 是 API token (在网页的 Settings 里新建)。设置了 Token 时不使用 session.
+	Token string
+
+	// CACert 是服务器证书 (PEM) 的路径，用于信任服务器的自签名证书。
+	CACert string
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configDirName, configFileName), nil
+}
+
+// loadConfig 读取本地的 config, 如果不存在则返回默认值。
+func loadConfig() (*Config, error) {
+	cfg := &Config{Server: defaultServer}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, cfg)
+	return cfg, err
+}
+
+// save 保存 config, 由于包含 session id, 因此只允许本人读写。
+func (cfg *Config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Client 通过 HTTP API 与 recoit 服务器通讯。
+type Client struct {
+	cfg  *Config
+	http *http.Client
+}
+
+// NewClient .
+func NewClient(cfg *Config) (*Client, error) {
+	client := &Client{
+		cfg:  cfg,
+		http: &http.Client{Timeout: 10 * time.Minute},
+	}
+	if cfg.CACert != "" {
+		certPEM, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(certPEM) {
+			return nil, errors.New("no certificate found in " + cfg.CACert)
+		}
+		client.http.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}
+	}
+	return client, nil
+}
+
+// errorMessage 是服务器返回的 json 消息。
+type errorMessage struct {
+	Message string `json:"message"`
+}
+
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.cfg.Server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+		return req, nil
+	}
+	if c.cfg.SessionID != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.cfg.SessionID})
+	}
+	if c.cfg.CSRFToken != "" {
+		req.Header.Set(csrfHeader, c.cfg.CSRFToken)
+	}
+	return req, nil
+}
+
+// do 发送请求，并把非 2xx 的响应转换为 error.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	var msg errorMessage
+	if json.Unmarshal(data, &msg) == nil && msg.Message != "" {
+		return nil, fmt.Errorf("%d: %s", resp.StatusCode, msg.Message)
+	}
+	return nil, fmt.Errorf("%d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+}
+
+// postForm 提交表单，并把返回的 json 解码到 result (result 可以为 nil)。
+func (c *Client) postForm(path string, form url.Values, result interface{}) error {
+	req, err := c.newRequest("POST", path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.doJSON(req, result)
+}
+
+func (c *Client) doJSON(req *http.Request, result interface{}) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Login 以用户 user 登入，成功后把 session id 及 CSRF token 保存到本地 config.
+func (c *Client) Login(user, passphrase string) error {
+	form := url.Values{"user": {user}, "passphrase": {passphrase}}
+	req, err := c.newRequest("POST", "/api/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.cfg.SessionID, c.cfg.CSRFToken, c.cfg.Token = "", "", ""
+	for _, cookie := range resp.Cookies() {
+		switch cookie.Name {
+		case sessionCookie:
+			c.cfg.SessionID = cookie.Value
+		case csrfCookie:
+			c.cfg.CSRFToken = cookie.Value
+		}
+	}
+	if c.cfg.SessionID == "" {
+		return errors.New("no session cookie in the response")
+	}
+	return c.cfg.save()
+}
+
+// UseToken 改用 API token, 并清除本地保存的 session id. 不检查 token 是否有效。
+func (c *Client) UseToken(token string) error {
+	c.cfg.Token = token
+	c.cfg.SessionID, c.cfg.CSRFToken = "", ""
+	return c.cfg.save()
+}
+
+// Logout 退出登入，并清除本地保存的 session id 及 API token.
+// 使用 API token 时只清除本地的 token, 不会删除服务器上的 token.
+func (c *Client) Logout() error {
+	if c.cfg.Token != "" {
+		c.cfg.Token = ""
+		return c.cfg.save()
+	}
+	req, err := c.newRequest("GET", "/logout", nil)
+	if err != nil {
+		return err
+	}
+	// 服务器会重定向到登入页面，不需要跟随。
+	client := *c.http
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.cfg.SessionID, c.cfg.CSRFToken = "", ""
+	return c.cfg.save()
+}
+
+// UploadResult 与服务器的 uploadResult 相同。
+type UploadResult struct {
+	FileName string
+	ID       string
+	Status   string
+	Message  string
+}
+
+// Upload 批量上传文件，这些文件共用同一组标签和同一个纸箱。
+func (c *Client) Upload(files, tags []string, boxTitle, dupMode string) ([]UploadResult, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for _, name := range files {
+		if err := addFormFile(writer, name); err != nil {
+			return nil, err
+		}
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
+	writer.WriteField("file-tags", string(tagsJSON))
+	writer.WriteField("box-title", boxTitle)
+	writer.WriteField("duplicates", dupMode)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest("POST", "/api/upload-files", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	var results []UploadResult
+	err = c.doJSON(req, &results)
+	return results, err
+}
+
+func addFormFile(writer *multipart.Writer, name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	part, err := writer.CreateFormFile("files", filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, file)
+	return err
+}
+
+// Reco 只包含命令行需要用到的字段。
+type Reco struct {
+	ID          string
+	Box         string
+	Message     string
+	Tags        []string
+	FileName    string
+	FileSize    int64
+	FileType    string
+	AccessCount int64
+	CreatedAt   string
+	UpdatedAt   string
+	DeletedAt   string
+}
+
+// AllRecos .
+func (c *Client) AllRecos() (recos []Reco, err error) {
+	err = c.postForm("/api/all-recos", nil, &recos)
+	return
+}
+
+// RecosByTag .
+func (c *Client) RecosByTag(tag string) (recos []Reco, err error) {
+	err = c.postForm("/api/tag", url.Values{"tag": {tag}}, &recos)
+	return
+}
+
+// RecosByBox .
+func (c *Client) RecosByBox(boxID string) (recos []Reco, err error) {
+	err = c.postForm("/api/get-recos-by-box", url.Values{"box-id": {boxID}}, &recos)
+	return
+}
+
+// GetReco .
+func (c *Client) GetReco(id string) (reco Reco, err error) {
+	err = c.postForm("/api/reco", url.Values{"id": {id}}, &reco)
+	return
+}
+
+// Download 由服务器下载并解密文件 (原文件)，然后保存到 path.
+func (c *Client) Download(id, path string) error {
+	req, err := c.newRequest("GET", "/api/stream/"+url.PathEscape(id)+"?download=1", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return writeFile(path, resp.Body)
+}
+
+func writeFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Export 导出全部数据，保存为 path (tar 包)。
+// 如果 password 不为空，导出包里的文件内容及元数据会用该密码派生的密钥加密。
+func (c *Client) Export(path, password string) error {
+	form := url.Values{"password": {password}}
+	req, err := c.newRequest("POST", "/api/export", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return writeFile(path, resp.Body)
+}
+
+// ImportResult 与 database.ImportResult 相同。
+type ImportResult struct {
+	Path    string
+	ID      string
+	Status  string
+	Message string
+}
+
+// ImportDir 让服务器导入其本地的一个文件夹 (dir 是相对于服务器的 import-root 的路径)。
+func (c *Client) ImportDir(dir, dirAs string, tags []string, skipHidden bool) ([]ImportResult, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"dir":         {dir},
+		"dir-as":      {dirAs},
+		"file-tags":   {string(tagsJSON)},
+		"skip-hidden": {strconv.FormatBool(skipHidden)},
+	}
+	var results []ImportResult
+	err = c.postForm("/api/import-dir", form, &results)
+	return results, err
+}
+
+// ChangeBox .
+func (c *Client) ChangeBox(id, boxTitle string) error {
+	form := url.Values{"id": {id}, "box-title": {boxTitle}}
+	return c.postForm("/api/change-box", form, nil)
+}
+
+// Delete 把 reco 扔进垃圾桶，如果 purge 为 true 则彻底删除。
+func (c *Client) Delete(id string, purge bool) error {
+	form := url.Values{"id": {id}}
+	if err := c.postForm("/api/delete-reco", form, nil); err != nil {
+		return err
+	}
+	if !purge {
+		return nil
+	}
+	return c.postForm("/api/purge-reco", form, nil)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestClient 返回连接到 handler 的 Client, 本地 config 保存在临时文件夹里。
+func newTestClient(t *testing.T, cfg *Config, handler http.HandlerFunc) (*Client, func()) {
+	dir, err := ioutil.TempDir("", "recoit-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	os.Setenv("XDG_CONFIG_HOME", dir)
+
+	server := httptest.NewServer(handler)
+	cfg.Server = server.URL
+	client, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		server.Close()
+		os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		auth    string
+		session string
+		csrf    string
+	}{
+		{"token", &Config{Token: "tok", SessionID: "sid", CSRFToken: "csrf"}, "Bearer tok", "", ""},
+		{"session", &Config{SessionID: "sid", CSRFToken: "csrf"}, "", "sid", "csrf"},
+		{"anonymous", &Config{}, "", "", ""},
+	}
+	for _, tt := range tests {
+		var got *http.Request
+		client, cleanup := newTestClient(t, tt.cfg, func(w http.ResponseWriter, r *http.Request) {
+			got = r
+		})
+		req, err := client.newRequest("POST", "/api/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.do(req)
+		cleanup()
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		resp.Body.Close()
+
+		if auth := got.Header.Get("Authorization"); auth != tt.auth {
+			t.Errorf("%s: Authorization = %q, want %q", tt.name, auth, tt.auth)
+		}
+		session := ""
+		if cookie, err := got.Cookie(sessionCookie); err == nil {
+			session = cookie.Value
+		}
+		if session != tt.session {
+			t.Errorf("%s: session cookie = %q, want %q", tt.name, session, tt.session)
+		}
+		if csrf := got.Header.Get(csrfHeader); csrf != tt.csrf {
+			t.Errorf("%s: %s = %q, want %q", tt.name, csrfHeader, csrf, tt.csrf)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	cfg := &Config{Token: "old-token"}
+	client, cleanup := newTestClient(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/login" || r.PostFormValue("passphrase") != "secret" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(401)
+			w.Write([]byte(`{"message":"wrong passphrase"}`))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "sid"})
+		http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: "csrf"})
+	})
+	defer cleanup()
+
+	if err := client.Login("alice", "wrong"); err == nil {
+		t.Fatal("login with a wrong passphrase should fail")
+	}
+	if err := client.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SessionID != "sid" || cfg.CSRFToken != "csrf" {
+		t.Errorf("got session %q and csrf token %q", cfg.SessionID, cfg.CSRFToken)
+	}
+	if cfg.Token != "" {
+		t.Error("login should replace the API token")
+	}
+	saved, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.SessionID != "sid" || saved.CSRFToken != "csrf" {
+		t.Error("the session should be saved to the local config")
+	}
+}
+
+func TestDoError(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"json", `{"message":"Invalid CSRF token"}`, "403: Invalid CSRF token"},
+		{"plain text", "forbidden\n", "403: forbidden"},
+	}
+	for _, tt := range tests {
+		client, cleanup := newTestClient(t, &Config{}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(403)
+			w.Write([]byte(tt.body))
+		})
+		req, err := client.newRequest("POST", "/api/test", strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.do(req)
+		cleanup()
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+/*
+Command recoit 是 recoit 服务器的命令行客户端，通过 HTTP API 操作，
+方便在 shell 脚本、cron 任务中使用。
+
+	recoit login [-server URL] [-cacert FILE] [-user NAME] [-passphrase-file FILE]
+	recoit login [-server URL] [-cacert FILE] -token TOKEN
+	recoit logout
+	recoit upload [-tags a,b] [-box TITLE] [-dup skip|link|share] FILE...
+	recoit list [-tag NAME | -box BOX-ID] [-name TEXT] [-json]
+	recoit download [-o PATH] ID
+	recoit change-box -box TITLE ID...
+	recoit delete [-purge] ID...
+	recoit export -o PATH [-encrypt] [-passphrase-file FILE]
+	recoit import [-dir-as box|tags|none] [-tags a,b] [-hidden] SERVER-DIR
+
+登入后用户名及 session id 保存在用户配置文件夹的 recoit/cli.json 里。
+密码可通过 -passphrase-file, 环境变量 RECOIT_PASSPHRASE 或标准输入提供。
+也可以改用 API token (在网页的 Settings 里新建): login -token 把它保存在 cli.json 里，
+此后不需要密码，也不受 session 过期的影响。
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+const passphraseEnv = "RECOIT_PASSPHRASE"
+
+// command 是一个子命令。
+type command struct {
+	name  string
+	usage string
+	run   func(client *Client, args []string) error
+}
+
+var commands = []command{
+	{"login", "login [-server URL] [-cacert FILE] [-user NAME] [-passphrase-file FILE | -token TOKEN]", runLogin},
+	{"logout", "logout", runLogout},
+	{"upload", "upload [-tags a,b] [-box TITLE] [-dup skip|link|share] FILE...", runUpload},
+	{"list", "list [-tag NAME | -box BOX-ID] [-name TEXT] [-json]", runList},
+	{"download", "download [-o PATH] ID", runDownload},
+	{"change-box", "change-box -box TITLE ID...", runChangeBox},
+	{"delete", "delete [-purge] ID...", runDelete},
+	{"export", "export -o PATH [-encrypt] [-passphrase-file FILE]", runExport},
+	{"import", "import [-dir-as box|tags|none] [-tags a,b] [-hidden] SERVER-DIR", runImport},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	client, err := NewClient(cfg)
+	if err != nil {
+		fatal(err)
+	}
+
+	name := os.Args[1]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(client, os.Args[2:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, cmd := range commands {
+		fmt.Fprintln(os.Stderr, "  recoit", cmd.usage)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "recoit:", err)
+	os.Exit(1)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("recoit "+name, flag.ExitOnError)
+}
+
+func runLogin(client *Client, args []string) error {
+	flags := newFlagSet("login")
+	server := flags.String("server", "", "server address, e.g. "+defaultServer)
+	caCert := flags.String("cacert", "", "trust this certificate (e.g. the server's self-signed cert.pem)")
+	user := flags.String("user", "", "user name (default: the last logged in user)")
+	passFile := flags.String("passphrase-file", "", "read the passphrase from this file")
+	token := flags.String("token", "", "use this API token instead of a passphrase")
+	flags.Parse(args)
+
+	if *user != "" {
+		client.cfg.User = *user
+	}
+	if client.cfg.User == "" && *token == "" {
+		return errors.New("user name is empty")
+	}
+	if *server != "" {
+		client.cfg.Server = *server
+	}
+	if *caCert != "" {
+		path, err := filepath.Abs(*caCert)
+		if err != nil {
+			return err
+		}
+		client.cfg.CACert = path
+		newClient, err := NewClient(client.cfg)
+		if err != nil {
+			return err
+		}
+		*client = *newClient
+	}
+	if *token != "" {
+		return client.UseToken(*token)
+	}
+	passphrase, err := readPassphrase(*passFile)
+	if err != nil {
+		return err
+	}
+	return client.Login(client.cfg.User, passphrase)
+}
+
+// readPassphrase 依次尝试从文件、环境变量、标准输入读取密码。
+func readPassphrase(passFile string) (string, error) {
+	if passFile != "" {
+		data, err := ioutil.ReadFile(passFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func runLogout(client *Client, args []string) error {
+	return client.Logout()
+}
+
+func runUpload(client *Client, args []string) error {
+	flags := newFlagSet("upload")
+	tags := flags.String("tags", "", "comma separated tags shared by all files")
+	box := flags.String("box", "", "put all files into this box")
+	dup := flags.String("dup", "skip", "what to do with duplicates: skip, link or share")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("no file to upload")
+	}
+	results, err := client.Upload(flags.Args(), splitTags(*tags), *box, *dup)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := 0
+	for _, result := range results {
+		if result.Status == "error" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			result.Status, result.ID, result.FileName, result.Message)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed", failed)
+	}
+	return nil
+}
+
+func splitTags(s string) (tags []string) {
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+func runList(client *Client, args []string) error {
+	flags := newFlagSet("list")
+	tag := flags.String("tag", "", "only list recos with this tag")
+	boxID := flags.String("box", "", "only list recos in this box (box id)")
+	name := flags.String("name", "", "only list recos whose file name contains this text")
+	asJSON := flags.Bool("json", false, "output json")
+	flags.Parse(args)
+
+	var recos []Reco
+	var err error
+	switch {
+	case *tag != "":
+		recos, err = client.RecosByTag(*tag)
+	case *boxID != "":
+		recos, err = client.RecosByBox(*boxID)
+	default:
+		recos, err = client.AllRecos()
+	}
+	if err != nil {
+		return err
+	}
+	recos = filterByName(recos, *name)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(recos)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, reco := range recos {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n",
+			reco.ID, reco.FileSize, reco.FileName, strings.Join(reco.Tags, ","))
+	}
+	return w.Flush()
+}
+
+func filterByName(recos []Reco, name string) []Reco {
+	if name == "" {
+		return recos
+	}
+	name = strings.ToLower(name)
+	var found []Reco
+	for _, reco := range recos {
+		if strings.Contains(strings.ToLower(reco.FileName), name) {
+			found = append(found, reco)
+		}
+	}
+	return found
+}
+
+func runDownload(client *Client, args []string) error {
+	flags := newFlagSet("download")
+	output := flags.String("o", "", "output path (default: the original file name)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("require exactly one id")
+	}
+	id := flags.Arg(0)
+	path := *output
+	if path == "" {
+		reco, err := client.GetReco(id)
+		if err != nil {
+			return err
+		}
+		path = reco.FileName
+	}
+	return client.Download(id, path)
+}
+
+func runChangeBox(client *Client, args []string) error {
+	flags := newFlagSet("change-box")
+	box := flags.String("box", "", "title of the box")
+	flags.Parse(args)
+
+	if *box == "" || flags.NArg() == 0 {
+		return errors.New("require -box and at least one id")
+	}
+	for _, id := range flags.Args() {
+		if err := client.ChangeBox(id, *box); err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func runDelete(client *Client, args []string) error {
+	flags := newFlagSet("delete")
+	purge := flags.Bool("purge", false, "delete permanently")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("require at least one id")
+	}
+	for _, id := range flags.Args() {
+		if err := client.Delete(id, *purge); err != nil {
+			return fmt.Errorf("%s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func runExport(client *Client, args []string) error {
+	flags := newFlagSet("export")
+	output := flags.String("o", "", "output path of the tar file")
+	encrypt := flags.Bool("encrypt", false, "encrypt the bundle (contents and metadata) with an export passphrase")
+	passFile := flags.String("passphrase-file", "", "read the export passphrase from this file")
+	flags.Parse(args)
+
+	if *output == "" {
+		return errors.New("require -o")
+	}
+	password := ""
+	if *encrypt {
+		var err error
+		if password, err = readPassphrase(*passFile); err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("export passphrase is empty")
+		}
+	}
+	return client.Export(*output, password)
+}
+
+// runImport 导入服务器上的一个文件夹 (必须在服务器设置的 import-root 里面)。
+// 中断后再次执行同一命令即可继续导入。
+func runImport(client *Client, args []string) error {
+	flags := newFlagSet("import")
+	dirAs := flags.String("dir-as", "box", "map sub-directories to: box, tags or none")
+	tags := flags.String("tags", "", "comma separated tags added to all files")
+	hidden := flags.Bool("hidden", false, "also import hidden files and directories")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("require exactly one directory (a path inside the server's import root)")
+	}
+	results, err := client.ImportDir(flags.Arg(0), *dirAs, splitTags(*tags), !*hidden)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := 0
+	for _, result := range results {
+		if result.Status == "error" {
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			result.Status, result.ID, result.Path, result.Message)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) failed, run the same command again to retry", failed)
+	}
+	return nil
+}
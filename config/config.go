@@ -0,0 +1,310 @@
+/*
+Package config 读取 recoit 的设置。
+
+设置的来源及优先级 (从高到低):
+
+ 1. 命令行参数，例如 -addr 127.0.0.1:8080
+ 2. 环境变量，例如 RECOIT_ADDR=127.0.0.1:8080
+ 3. 设置文件 (json), 例如 {"Addr": "127.0.0.1:8080"}
+ 4. 默认值 (参考 Default)
+
+设置文件的位置由 -config 或 RECOIT_CONFIG 指定，如果都没有指定，
+则使用数据文件夹 (DataDir) 里的 recoit.json, 该文件不存在时忽略。
+
+全部设置项见 settings, 每个设置项都有对应的命令行参数、环境变量及 json 字段名。
+*/
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	dataFolderName = "recoit_data_folder"
+	configFileName = "recoit.json"
+	configEnv      = "RECOIT_CONFIG"
+)
+
+// Config 包含 recoit 的全部设置。
+type Config struct {
+	Addr           string // 监听地址
+	DataDir        string // 数据文件夹，包括数据库、缓存文件等
+	MaxBytes       int64  // 单个文件的上传大小限制 (字节)
+	MaxBatchBytes  int64  // 批量上传的总大小限制 (字节)
+	MaxAge         int    // session 的有效期 (秒)
+	SmallImageSize int64  // 小于该体积 (字节) 的图片不需要压缩尺寸
+	PasswordMaxTry int    // 同一个 IP 最多可连续输错几次密码，超过后锁定
+	Lockout        int    // 锁定时间 (秒)
+
+	// 把 session 保存在数据库中，使服务器重启后不需要重新登入。
+	PersistSessions bool
+
+	// 闲置超过该时间 (秒) 就自动锁定，全部设备都需要重新登入。0 表示不自动锁定，
+	// 但当全部 session 都已过期或退出时，仍会锁定。
+	AutoLock int
+
+	// 服务器上解密后的本地文件 (缓存、临时文件及缩略图) 的总大小上限 (字节),
+	// 超出时删除最久未访问的文件。0 表示不限大小。
+	CacheSize int64
+
+	// 显示用的图片不保留 EXIF (包括 GPS 位置)。带有 EXIF 的图片一律重新编码，
+	// 即使其体积小于 SmallImageSize. 拍摄时间等资料在上传时已另外保存。
+	StripExif bool
+
+	// 衍生图片的参数，格式为 "size=900,format=webp,quality=80,crop=fit", 没有提及的参数使用默认值
+	// (参考 graphics.ParseProfile)。改变后已生成的衍生图片会被重新生成。
+	DisplayProfile string // 用于在网页中显示的图片
+	ThumbProfile   string // 缩略图
+
+	// 允许导入的服务器本地文件夹 (参考 database.DB.ImportDir), 只能导入其中的文件夹。
+	// 为空时不允许导入服务器上的文件夹。
+	ImportRoot string
+
+	// 服务器密钥文件 (参考 database.Users.LoadServerKey), 不存在时自动生成。
+	// 服务器用它加密分享了纸箱或文件的用户的云储存设置，使主人未登入时成员及分享链接也能下载，
+	// 因此应放在数据文件夹之外 (例如另一个磁盘)。为空时只有在主人已登入期间才能下载。
+	ServerKeyFile string
+
+	// HTTPS. 启用 TLS 但没有提供证书时，自动生成自签名证书并保存在数据文件夹里。
+	TLS          bool   // 是否启用 HTTPS
+	CertFile     string // 证书 (PEM)
+	KeyFile      string // 私钥 (PEM)
+	RedirectAddr string // 在该地址监听 HTTP 并重定向到 HTTPS, 为空时不监听
+}
+
+// Default 返回默认设置。
+func Default() *Config {
+	return &Config{
+		Addr:           "127.0.0.1:80",
+		DataDir:        filepath.Join(userHomeDir(), dataFolderName),
+		MaxBytes:       1024 * 1024 * 3,  // 3 MB
+		MaxBatchBytes:  1024 * 1024 * 30, // 30 MB
+		MaxAge:         60 * 30,          // 30 minutes
+		SmallImageSize: 500 * 1024,       // 500 KB
+		PasswordMaxTry: 5,
+		Lockout:        60 * 15,            // 15 minutes
+		CacheSize:      1024 * 1024 * 1024, // 1 GB
+	}
+}
+
+func userHomeDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+	return homeDir
+}
+
+// setting 是一个设置项，value 指向 Config 中的字段。
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (cfg *Config) settings() []setting {
+	return []setting{
+		{"addr", "RECOIT_ADDR", "listen address", (*stringValue)(&cfg.Addr)},
+		{"data-dir", "RECOIT_DATA_DIR", "data directory", (*stringValue)(&cfg.DataDir)},
+		{"max-bytes", "RECOIT_MAX_BYTES", "max upload size of one file (bytes)", (*int64Value)(&cfg.MaxBytes)},
+		{"max-batch-bytes", "RECOIT_MAX_BATCH_BYTES", "max size of a batch upload (bytes)", (*int64Value)(&cfg.MaxBatchBytes)},
+		{"max-age", "RECOIT_MAX_AGE", "session max age (seconds)", (*intValue)(&cfg.MaxAge)},
+		{"small-image-size", "RECOIT_SMALL_IMAGE_SIZE", "images smaller than this (bytes) are not resized", (*int64Value)(&cfg.SmallImageSize)},
+		{"password-max-try", "RECOIT_PASSWORD_MAX_TRY", "max number of wrong passwords", (*intValue)(&cfg.PasswordMaxTry)},
+		{"lockout", "RECOIT_LOCKOUT", "lockout after too many wrong passwords (seconds)", (*intValue)(&cfg.Lockout)},
+		{"persist-sessions", "RECOIT_PERSIST_SESSIONS", "keep sessions in the database across restarts", (*boolValue)(&cfg.PersistSessions)},
+		{"auto-lock", "RECOIT_AUTO_LOCK", "lock the vault after being idle for this long (seconds, 0 = never)", (*intValue)(&cfg.AutoLock)},
+		{"cache-size", "RECOIT_CACHE_SIZE", "max size of decrypted local files (bytes, 0 = unlimited)", (*int64Value)(&cfg.CacheSize)},
+		{"strip-exif", "RECOIT_STRIP_EXIF", "remove EXIF (including GPS) from display images", (*boolValue)(&cfg.StripExif)},
+		{"display-profile", "RECOIT_DISPLAY_PROFILE", "display image profile, e.g. size=1200,format=webp,quality=80", (*stringValue)(&cfg.DisplayProfile)},
+		{"thumb-profile", "RECOIT_THUMB_PROFILE", "thumbnail profile, e.g. size=256,crop=fit", (*stringValue)(&cfg.ThumbProfile)},
+		{"import-root", "RECOIT_IMPORT_ROOT", "server directory that imports are limited to (empty = disabled)", (*stringValue)(&cfg.ImportRoot)},
+		{"server-key-file", "RECOIT_SERVER_KEY_FILE", "key file (kept outside the data directory) that lets shared boxes and links work while their owner is logged out", (*stringValue)(&cfg.ServerKeyFile)},
+		{"tls", "RECOIT_TLS", "serve HTTPS", (*boolValue)(&cfg.TLS)},
+		{"cert-file", "RECOIT_CERT_FILE", "TLS certificate (a self-signed one is generated if empty)", (*stringValue)(&cfg.CertFile)},
+		{"key-file", "RECOIT_KEY_FILE", "TLS private key", (*stringValue)(&cfg.KeyFile)},
+		{"redirect-addr", "RECOIT_REDIRECT_ADDR", "listen address for redirecting HTTP to HTTPS", (*stringValue)(&cfg.RedirectAddr)},
+	}
+}
+
+// Load 依次读取默认值、设置文件、环境变量及命令行参数 (args 不包括程序名)。
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	// 先解析命令行参数，但暂不应用，因为命令行参数的优先级最高，要最后应用。
+	flags := flag.NewFlagSet("recoit", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of the config file (json)")
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		_, isBool := s.value.(*boolValue)
+		flags.Var(&recorder{s.flag, flagValues, isBool}, s.flag, s.usage+" (env "+s.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// 设置文件
+	path, required := *configPath, *configPath != ""
+	if path == "" {
+		path, required = os.Getenv(configEnv), os.Getenv(configEnv) != ""
+	}
+	if path == "" {
+		path = filepath.Join(cfg.dataDir(flagValues), configFileName)
+	}
+	if err := cfg.loadFile(path, required); err != nil {
+		return nil, err
+	}
+
+	// 环境变量
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, fmt.Errorf("%s: %v", s.env, err)
+			}
+		}
+	}
+
+	// 命令行参数
+	for _, s := range settings {
+		if v, ok := flagValues[s.flag]; ok {
+			if err := s.value.Set(v); err != nil {
+				return nil, fmt.Errorf("-%s: %v", s.flag, err)
+			}
+		}
+	}
+	return cfg, cfg.validate()
+}
+
+// dataDir 返回用于寻找默认设置文件的数据文件夹 (设置文件本身不能改变它)。
+func (cfg *Config) dataDir(flagValues map[string]string) string {
+	if dir, ok := flagValues["data-dir"]; ok {
+		return dir
+	}
+	if dir := os.Getenv("RECOIT_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return cfg.DataDir
+}
+
+// loadFile 读取设置文件，如果文件不存在并且 required 为 false 则忽略。
+func (cfg *Config) loadFile(path string, required bool) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	if cfg.Addr == "" {
+		return errors.New("addr is empty")
+	}
+	if cfg.DataDir == "" {
+		return errors.New("data-dir is empty")
+	}
+	if cfg.MaxBytes <= 0 || cfg.MaxBatchBytes <= 0 {
+		return errors.New("max-bytes and max-batch-bytes must be positive")
+	}
+	if cfg.MaxAge <= 0 {
+		return errors.New("max-age must be positive")
+	}
+	if cfg.AutoLock < 0 {
+		return errors.New("auto-lock must not be negative")
+	}
+	if cfg.CacheSize < 0 {
+		return errors.New("cache-size must not be negative")
+	}
+	if cfg.Lockout <= 0 {
+		return errors.New("lockout must be positive")
+	}
+	if cfg.PasswordMaxTry <= 0 {
+		return errors.New("password-max-try must be positive")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("cert-file and key-file must be set together")
+	}
+	if cfg.RedirectAddr != "" && !cfg.TLS {
+		return errors.New("redirect-addr requires tls")
+	}
+	return nil
+}
+
+// recorder 记录命令行参数的原始字符串。
+type recorder struct {
+	name   string
+	values map[string]string
+	isBool bool
+}
+
+func (r *recorder) String() string { return "" }
+
+// IsBoolFlag 使 bool 类型的参数可以省略值，例如 -tls 相当于 -tls=true.
+func (r *recorder) IsBoolFlag() bool { return r.isBool }
+
+func (r *recorder) Set(s string) error {
+	r.values[r.name] = s
+	return nil
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type int64Value int64
+
+func (v *int64Value) String() string { return strconv.FormatInt(int64(*v), 10) }
+
+func (v *int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = int64Value(n)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
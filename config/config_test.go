@@ -0,0 +1,70 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recoit-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, configFileName)
+	content := `{"Addr": "127.0.0.1:1000", "MaxAge": 100, "PasswordMaxTry": 3}`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("RECOIT_ADDR", "127.0.0.1:2000")
+	os.Setenv("RECOIT_MAX_AGE", "200")
+	defer os.Unsetenv("RECOIT_ADDR")
+	defer os.Unsetenv("RECOIT_MAX_AGE")
+
+	cfg, err := Load([]string{"-data-dir", dir, "-addr", "127.0.0.1:3000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Addr != "127.0.0.1:3000" {
+		t.Errorf("Addr: got %s; want the value from flag", cfg.Addr)
+	}
+	if cfg.MaxAge != 200 {
+		t.Errorf("MaxAge: got %d; want the value from env", cfg.MaxAge)
+	}
+	if cfg.PasswordMaxTry != 3 {
+		t.Errorf("PasswordMaxTry: got %d; want the value from file", cfg.PasswordMaxTry)
+	}
+	if cfg.MaxBytes != Default().MaxBytes {
+		t.Errorf("MaxBytes: got %d; want the default value", cfg.MaxBytes)
+	}
+	if cfg.DataDir != dir {
+		t.Errorf("DataDir: got %s; want %s", cfg.DataDir, dir)
+	}
+}
+
+func TestLoadMissingRequiredFile(t *testing.T) {
+	if _, err := Load([]string{"-config", "/no/such/recoit.json"}); err == nil {
+		t.Error("want an error when the specified config file does not exist")
+	}
+}
+
+func TestLoadBoolFlag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recoit-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := Load([]string{"-data-dir", dir, "-tls"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.TLS {
+		t.Error("-tls without value should enable TLS")
+	}
+}
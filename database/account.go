@@ -0,0 +1,290 @@
+package database
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+const recoveryFileVersion = 1
+
+// restoreCheckID 是重置账号时保存的 masterKey 校验值的记录 ID (参考 restoreCheck).
+const restoreCheckID = "restore-check"
+
+// ErrNothingToRestore 表示该用户没有被重置过的账号，或者 RecoveryFile 不属于该账号。
+var ErrNothingToRestore = errors.New("wrong password or the recovery file does not belong to this account")
+
+// RecoveryFile 包含被 userKey 加密的 masterKey (即 firstReco.Message),
+// 被恢复码加密的 masterKey 以及被 masterKey 加密的云储存设置，在重置账号前导出。
+// 只要记得原来的密码，就可以用它恢复账号 (参考 RestoreAccount),
+// 或者解密云储存中保留下来的文件。
+type RecoveryFile struct {
+	Version     int
+	CreatedAt   string
+	WrappedKey  string
+	RecoveryKey string // 未生成恢复码时为空
+	Settings    string // base64, 未设置云储存时为空
+}
+
+// VerifyPassphrase 检查 passphrase 是否正确，不改变登入状态。
+func (db *DB) VerifyPassphrase(passphrase string) error {
+	if passphrase == "" {
+		return errors.New("password is empty")
+	}
+	reco, err := db.getFirstReco()
+	if err != nil {
+		return err
+	}
+	_, err = decryptFirstReco(passphrase, reco.Message)
+	return err
+}
+
+// restoreCheck 返回 masterKey 的校验值。重置账号时保存，恢复时用来确认 RecoveryFile
+// 里的 masterKey 就是被重置的账号的 masterKey, 以免别人用自己的 RecoveryFile 占用该账号。
+func restoreCheck(masterKey []byte) string {
+	return util.Base64Encode(aesgcm.Sha256("recoit-restore-check:" + string(masterKey)))
+}
+
+func (db *DB) newRecoveryFile() (*RecoveryFile, error) {
+	reco, err := db.getFirstReco()
+	if err != nil {
+		return nil, err
+	}
+	file := &RecoveryFile{
+		Version:    recoveryFileVersion,
+		CreatedAt:  util.TimeNow(),
+		WrappedKey: reco.Message,
+	}
+	recoveryKey, err := db.getRecoveryKey()
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if err == nil {
+		file.RecoveryKey = recoveryKey.Key
+	}
+	if util.PathIsExist(db.settingsPath) {
+		settings, err := ioutil.ReadFile(db.settingsPath)
+		if err != nil {
+			return nil, err
+		}
+		file.Settings = util.Base64Encode(settings)
+	}
+	return file, nil
+}
+
+// saveRecoveryFile 把 file 保存在数据库文件夹里，以免返回给前端时出错而丢失。
+func (db *DB) saveRecoveryFile(file *RecoveryFile) error {
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("recovery-%s-%d.json", db.Name, time.Now().Unix())
+	path := filepath.Join(db.dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	log.Print("recovery file saved: ", path)
+	return nil
+}
+
+// ResetAccount 删除账号 (firstReco, 云储存设置及 API token) 并锁定，之后可以重新创建账号。
+// 删除前会先导出 RecoveryFile (同时保存在数据库文件夹里)。
+// 数据库中的删除在一个事务里完成，因此中途出错时账号仍然有效，可以再次尝试。
+//
+// 如果 wipe 为 true, 则同时删除云储存中的全部文件及数据库中的全部记录。
+// 先逐一删除云储存中的文件，全部成功后才删除账号，因此中途出错时账号仍然有效，
+// 可以再次尝试。如果 wipe 为 false, 则保留全部文件及记录，以便用 RecoveryFile 恢复。
+func (db *DB) ResetAccount(passphrase string, wipe bool) (*RecoveryFile, error) {
+	return db.resetAccount(passphrase, wipe, nil)
+}
+
+// ResetAccount 重置用户 db 的账号 (参考 DB.ResetAccount), 成功后撤销其全部分享链接。
+func (users *Users) ResetAccount(db *DB, passphrase string, wipe bool) (*RecoveryFile, error) {
+	return db.resetAccount(passphrase, wipe, func() error {
+		return users.DeleteShareLinks(db.Name)
+	})
+}
+
+// resetAccount 是 ResetAccount 的具体操作。afterCommit 在数据库的事务提交后、
+// 删除云储存设置之前调用 (例如删除分享链接的文件副本时仍需要访问云储存),
+// 此时账号已被重置，因此 afterCommit 出错只写入日志。
+func (db *DB) resetAccount(passphrase string, wipe bool, afterCommit func() error) (*RecoveryFile, error) {
+	if passphrase == "" {
+		return nil, errors.New("password is empty")
+	}
+	file, err := db.newRecoveryFile()
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := decryptFirstReco(passphrase, file.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.saveRecoveryFile(file); err != nil {
+		return nil, err
+	}
+	if wipe {
+		if err := db.wipe(); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.deleteAccount(masterKey); err != nil {
+		return nil, err
+	}
+	if afterCommit != nil {
+		if err := afterCommit(); err != nil {
+			log.Printf("reset account %s: %v", db.Name, err)
+		}
+	}
+	for _, path := range []string{db.settingsPath, db.sharedPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	db.LockVault()
+	return file, nil
+}
+
+// deleteAccount 在一个事务中删除账号 (firstReco, 恢复码及 API token),
+// 并保存恢复账号时用来检查 masterKey 的 restoreCheck.
+func (db *DB) deleteAccount(masterKey []byte) error {
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	check := model.NewWrappedKey(restoreCheckID, restoreCheck(masterKey))
+	if err := tx.Save(check); err != nil {
+		return err
+	}
+	if err := tx.DeleteStruct(&Reco{ID: "1"}); err != nil {
+		return err
+	}
+	if err := deleteRecoveryKey(tx); err != nil {
+		return err
+	}
+	if err := deleteAPITokens(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// wipe 删除云储存中的全部文件 (包括衍生图片及元数据的备份),
+// 然后删除数据库中的全部记录 (不包括 firstReco)。
+func (db *DB) wipe() error {
+	var objects []model.Object
+	if err := db.DB.All(&objects); err != nil {
+		return err
+	}
+	if len(objects) > 0 && db.COS == nil {
+		return errors.New("cloud storage is not set up, cannot wipe the bucket")
+	}
+	for _, obj := range objects {
+		if err := db.deleteObject(obj.Name); err != nil {
+			return fmt.Errorf("wiping stopped, the account is not reset: %w", err)
+		}
+		db.deletePreviews(obj.Name)
+		// 逐一删除记录，再次尝试时就不会重复删除。
+		if err := db.DB.DeleteStruct(&obj); err != nil {
+			return err
+		}
+	}
+	if db.COS != nil {
+		if err := db.deleteObject(db.prefix + manifestName); err != nil {
+			return fmt.Errorf("wiping stopped, the account is not reset: %w", err)
+		}
+	}
+	return db.deleteAllRecords()
+}
+
+// deleteAllRecords 删除全部 Reco (不包括 firstReco), Tag, Box, Object, 共享纸箱的记录及 API token.
+func (db *DB) deleteAllRecords() error {
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var recos []Reco
+	if err := tx.All(&recos); err != nil {
+		return err
+	}
+	for i := range recos {
+		if recos[i].ID == "1" {
+			continue
+		}
+		if err := tx.DeleteStruct(&recos[i]); err != nil {
+			return err
+		}
+	}
+	for _, kind := range []interface{}{&Tag{}, &Box{}, &model.Object{}, &model.SharedBox{}, &model.BoxMember{}, &model.APIToken{}} {
+		if err := tx.Select().Delete(kind); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RestoreAccount 用 RecoveryFile 恢复被重置的账号，passphrase 必须是原来的密码，
+// 并且 RecoveryFile 必须是重置该账号时导出的。
+func (db *DB) RestoreAccount(file *RecoveryFile, passphrase string) error {
+	if db.IsFirstRecoExist() {
+		return errors.New("已存在账号，不可恢复")
+	}
+	if file.Version != recoveryFileVersion {
+		return fmt.Errorf("unknown recovery file version: %d", file.Version)
+	}
+	check := new(model.WrappedKey)
+	if err := db.DB.One("ID", restoreCheckID, check); err != nil {
+		if err == storm.ErrNotFound {
+			return ErrNothingToRestore
+		}
+		return err
+	}
+	masterKey, err := decryptFirstReco(passphrase, file.WrappedKey)
+	if err != nil {
+		return ErrNothingToRestore
+	}
+	if !hmac.Equal([]byte(restoreCheck(masterKey)), []byte(check.Key)) {
+		return ErrNothingToRestore
+	}
+	if file.Settings != "" {
+		settings, err := util.Base64Decode(file.Settings)
+		if err != nil {
+			return err
+		}
+		if _, err := aesgcm.NewGCM(masterKey).Decrypt(settings); err != nil {
+			return errors.New("broken recovery file: " + err.Error())
+		}
+		if err := ioutil.WriteFile(db.settingsPath, settings, 0600); err != nil {
+			return err
+		}
+	}
+	firstReco := model.NewFirstReco()
+	firstReco.Message = file.WrappedKey
+	if err := db.createIndexes(); err != nil {
+		return err
+	}
+	if file.RecoveryKey != "" {
+		key := model.NewWrappedKey(recoveryKeyID, file.RecoveryKey)
+		if err := db.DB.Save(key); err != nil {
+			return err
+		}
+	}
+	if err := db.DB.Save(firstReco); err != nil {
+		return err
+	}
+	return db.DB.DeleteStruct(check)
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func openTestUsers(t *testing.T) (*Users, func()) {
+	dir, err := ioutil.TempDir("", "recoit-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "db"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	users := new(Users)
+	if err := users.Open(60, filepath.Join(dir, "db", "recoit.db")); err != nil {
+		t.Fatal(err)
+	}
+	// 服务器密钥放在数据库文件夹之外。
+	if err := users.LoadServerKey(filepath.Join(dir, "server.key")); err != nil {
+		t.Fatal(err)
+	}
+	return users, func() {
+		users.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// openTestDB 返回一个尚未创建账号的用户的 vault.
+func openTestDB(t *testing.T) (*DB, func()) {
+	users, cleanup := openTestUsers(t)
+	if err := users.root.Save(model.NewUser("alice")); err != nil {
+		t.Fatal(err)
+	}
+	db, err := users.Vault("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, cleanup
+}
+
+func TestResetRestoreAccount(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	const passphrase = "abc"
+	if _, err := db.InsertFirstReco(passphrase, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ResetAccount("wrong", false); err == nil {
+		t.Fatal("should not reset with a wrong password")
+	}
+	file, err := db.ResetAccount(passphrase, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.IsFirstRecoExist() {
+		t.Fatal("the account should be deleted")
+	}
+	saved, _ := filepath.Glob(filepath.Join(db.dir, "recovery-alice-*.json"))
+	if len(saved) != 1 {
+		t.Errorf("the recovery file should be saved, got %v", saved)
+	}
+
+	if err := db.RestoreAccount(file, "wrong"); err == nil {
+		t.Error("should not restore with a wrong password")
+	}
+	// 别人的 RecoveryFile 不能用来恢复 (占用) 这个账号。
+	otherReco, _ := db.newFirstReco("evil")
+	other := &RecoveryFile{Version: recoveryFileVersion, WrappedKey: otherReco.Message}
+	if err := db.RestoreAccount(other, "evil"); err != ErrNothingToRestore {
+		t.Errorf("should not restore with another key, got %v", err)
+	}
+	if err := db.RestoreAccount(file, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Login(passphrase); err != nil {
+		t.Errorf("should login after restoring: %v", err)
+	}
+	if !db.HasRecoveryCode() {
+		t.Error("the recovery code should be restored")
+	}
+	db.LockVault()
+	if err := db.DB.DeleteStruct(&Reco{ID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreAccount(file, passphrase); err != ErrNothingToRestore {
+		t.Errorf("a recovery file should only be used once, got %v", err)
+	}
+}
+
+// 清空云储存时，衍生图片及元数据的备份也要删除。
+func TestResetAccountWipe(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	reco, _ := model.NewFile("photo.png")
+	reco.Checksum = "p1"
+	if err := alice.InsertReco(reco, []byte("photo")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.UploadPreview(reco.Object, PreviewThumb, "v1", []byte("thumb")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.uploadManifest(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.ResetAccount("alice-pwd", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(cos.objects) != 0 {
+		t.Errorf("every object should be deleted, left %d", len(cos.objects))
+	}
+}
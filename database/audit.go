@@ -0,0 +1,48 @@
+package database
+
+import (
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/throttle"
+	"github.com/asdine/storm/v3"
+)
+
+// throttleStore 把登入失败的计数保存在数据库中 (实现 throttle.Store)。
+type throttleStore struct {
+	node storm.Node
+}
+
+func (store throttleStore) Save(rec *throttle.Record) error {
+	return store.node.Save(rec)
+}
+
+func (store throttleStore) Delete(key string) error {
+	err := store.node.DeleteStruct(&throttle.Record{Key: key})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (store throttleStore) All() (all []throttle.Record, err error) {
+	err = store.node.All(&all)
+	return
+}
+
+// ThrottleStore 返回用来保存登入失败计数的 store, 使锁定期在服务器重启后仍然有效。
+func (users *Users) ThrottleStore() throttle.Store {
+	return throttleStore{users.root}
+}
+
+// AddLoginFailure 记录一次失败的登入尝试，user 是尝试登入的用户名。
+func (users *Users) AddLoginFailure(user, ip, userAgent, reason string) error {
+	return users.root.Save(model.NewLoginFailure(user, ip, userAgent, reason))
+}
+
+// LoginFailures 返回用户 user 最近的 limit 次失败的登入尝试，最新的在前。
+func (users *Users) LoginFailures(user string, limit int) (failures []model.LoginFailure, err error) {
+	err = users.root.Find("User", user, &failures, storm.Limit(limit), storm.Reverse())
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
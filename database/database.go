@@ -2,10 +2,11 @@ package database
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
-	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/ahui2016/recoit/aesgcm"
 	"github.com/ahui2016/recoit/cloud"
@@ -23,68 +24,78 @@ type (
 	Box  = model.Box
 )
 
-// DB 将数据库、加密、云储存三大功能汇于一身。
+// DB 是一个用户的 vault, 将数据库、加密、云储存三大功能汇于一身。
+// 每个用户的数据保存在数据库中各自的 node 里 (参考 Users)。
 type DB struct {
-	path         string
+	Name         string // 用户名
+	dir          string // 数据库文件夹
 	settingsPath string
-	DB           *storm.DB
+	sharedPath   string       // 用服务器密钥加密的云储存设置 (参考 shareSettings)
+	serverGCM    *aesgcm.AEAD // 全部用户共用，可以为 nil (参考 Users.LoadServerKey)
+	prefix       string       // 该用户的云储存对象名前缀
+	DB           storm.Node
 	GCM          *aesgcm.AEAD
 	COS          cloud.ObjectStorage
-	Sess         *session.Manager
-}
-
-// Open .
-func (db *DB) Open(maxAge int, dbPath, settingsPath string) (err error) {
-	if db.DB, err = storm.Open(dbPath); err != nil {
-		return err
-	}
-	db.path = dbPath
-	db.settingsPath = settingsPath
-	db.Sess = session.NewManager(maxAge)
-	log.Print(db.path)
-	return nil
-}
-
-// Reset .
-func (db *DB) Reset() {
-	db.GCM = nil
-	db.COS = nil
-}
-
-// IsReady .
-func (db *DB) IsReady() bool {
-	if db.GCM != nil && db.COS != nil {
-		return true
-	}
-	return false
-}
+	Sess         *session.Manager // 全部用户共用
 
-// Close .
-func (db *DB) Close() error {
-	return db.DB.Close()
+	mu         sync.RWMutex // 保护 masterKey, GCM, localGCM, COS 及 lastActive
+	masterKey  []byte
+	localGCM   *aesgcm.AEAD // 加密服务器上的本地文件 (参考 LocalGCM)
+	lastActive time.Time
 }
 
 // InsertFirstReco 向数据库插入第一条数据，这个数据包含了该数据库的密码。
 // 一旦操作成功，从此必须输入正确密码 (DB.Login) 才能读写数据库。
-func (db *DB) InsertFirstReco(passphrase string) error {
+// 如果 withRecoveryCode 为 true, 则同时生成恢复码并返回 (参考 RecoverAccount),
+// 用户应把它抄写在纸上或保存在其他安全的地方。
+func (db *DB) InsertFirstReco(passphrase string, withRecoveryCode bool) (recoveryCode string, err error) {
 	if db.IsFirstRecoExist() {
-		return errors.New("已存在账号，不可重复创建")
+		return "", errors.New("已存在账号，不可重复创建")
 	}
 	if passphrase == "" {
-		return errors.New("password is empty")
+		return "", errors.New("password is empty")
+	}
+	firstReco, masterKey := db.newFirstReco(passphrase)
+	db.createIndexes()
+
+	// 重置账号时如果没有清空数据，旧的记录已无法用新的密钥解密，因此删除。
+	// (云储存中的旧文件不会被删除，仍可用 RecoveryFile 恢复的密钥解密。)
+	if err := db.deleteAllRecords(); err != nil {
+		return "", err
 	}
-	firstReco, err := db.newFirstReco(passphrase)
+
+	tx, err := db.DB.Begin(true)
 	if err != nil {
-		return err
+		return "", err
 	}
-	db.createIndexes()
-	return db.DB.Save(firstReco)
+	defer tx.Rollback()
+
+	if err := deleteRecoveryKey(tx); err != nil {
+		return "", err
+	}
+	// 旧的记录已被删除，不可再恢复被重置的账号。
+	if err := tx.DeleteStruct(&model.WrappedKey{ID: restoreCheckID}); err != nil && err != storm.ErrNotFound {
+		return "", err
+	}
+	// 旧的私钥已无法用新的 masterKey 解密，登入后会重新生成 (参考 EnsureKeyPair)。
+	if err := deletePrivateKey(tx); err != nil {
+		return "", err
+	}
+	if withRecoveryCode {
+		if recoveryCode, err = saveRecoveryCode(tx, masterKey); err != nil {
+			return "", err
+		}
+	}
+	if err := tx.Save(firstReco); err != nil {
+		return "", err
+	}
+	return recoveryCode, tx.Commit()
 }
 
 // 用 userKey 来加密 masterKey.
 // userKey 用来加密解密 firstReco.Message,
 // masterKey 用来加密解密其他数据。
-func (db *DB) newFirstReco(passphrase string) (*Reco, error) {
+func (db *DB) newFirstReco(passphrase string) (*Reco, []byte) {
 	userKey := aesgcm.Sha256(passphrase)
 	userGCM := aesgcm.NewGCM(userKey)
 	masterKey := aesgcm.RandomKey()
@@ -92,7 +103,7 @@ func (db *DB) newFirstReco(passphrase string) (*Reco, error) {
 
 	firstReco := model.NewFirstReco()
 	firstReco.Message = util.Base64Encode(cipherMasterKey)
-	return firstReco, nil
+	return firstReco, masterKey
 }
 
 func (db *DB) createIndexes() error {
@@ -105,7 +116,19 @@ func (db *DB) createIndexes() error {
 	if err := db.DB.Init(&Box{}); err != nil {
 		return err
 	}
-	return nil
+	if err := db.DB.Init(&Object{}); err != nil {
+		return err
+	}
+	if err := db.DB.Init(&model.WrappedKey{}); err != nil {
+		return err
+	}
+	if err := db.DB.Init(&model.SharedBox{}); err != nil {
+		return err
+	}
+	if err := db.DB.Init(&model.BoxMember{}); err != nil {
+		return err
+	}
+	return db.DB.Init(&model.APIToken{})
 }
 
 // Login .
@@ -117,27 +140,23 @@ func (db *DB) Login(passphrase string) error {
 	if err != nil {
 		return err
 	}
-	db.GCM, err = decryptFirstReco(passphrase, reco.Message)
+	masterKey, err := decryptFirstReco(passphrase, reco.Message)
 	if err != nil {
 		return err
 	}
+	db.setMasterKey(masterKey)
 	return nil
 }
 
-func decryptFirstReco(passphrase, key64 string) (*aesgcm.AEAD, error) {
+func decryptFirstReco(passphrase, key64 string) ([]byte, error) {
 	userKey := aesgcm.Sha256(passphrase)
 	userGCM := aesgcm.NewGCM(userKey)
 	cipherMasterKey, err := util.Base64Decode(key64)
 	if err != nil {
 		return nil, err
 	}
-	masterKey, err := userGCM.Decrypt(cipherMasterKey)
-	if err != nil {
-		return nil, err
-	}
 	// 解密成功，获得 masterKey
-	gcm := aesgcm.NewGCM(masterKey)
-	return gcm, nil
+	return userGCM.Decrypt(cipherMasterKey)
 }
 
 // SetupIbmCos .
@@ -163,29 +182,39 @@ func (db *DB) setupCloud(cos cloud.ObjectStorage, settings cloud.Settings) error
 	if err := ioutil.WriteFile(db.settingsPath, encrypted, 0600); err != nil {
 		return err
 	}
+	if db.serverGCM != nil && util.PathIsExist(db.sharedPath) {
+		if err := ioutil.WriteFile(db.sharedPath, db.serverGCM.Encrypt(settingsJSON), 0600); err != nil {
+			return err
+		}
+	}
 
 	// 云储存设置成功, 从此 db.COS != nil
+	db.mu.Lock()
 	db.COS = cos
+	db.mu.Unlock()
 
-	// 第一次将数据库文件上传到 COS, 之后找机会再上传当作备份。
-	if err := db.encryptUploadFile(db.path); err != nil {
-		return err
-	}
-	return nil
+	// 第一次将元数据上传到 COS, 之后找机会再上传当作备份。
+	return db.uploadManifest()
 }
 
-func (db *DB) encryptUploadFile(filePath string) error {
-	content, err := ioutil.ReadFile(filePath)
+// uploadManifest 把该用户的元数据 (参考 Manifest) 加密后上传到 COS 当作备份。
+// 全部用户共用一个数据库文件，因此不能上传整个数据库文件。
+func (db *DB) uploadManifest() error {
+	manifest, err := db.newManifest()
 	if err != nil {
 		return err
 	}
-	name := filepath.Base(filePath)
-	ciphertext := db.GCM.Encrypt(content)
-	body := bytes.NewReader(ciphertext)
-	if err := db.COS.PutObject(name, body); err != nil {
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
 		return err
 	}
-	return nil
+	ciphertext := db.GCM.Encrypt(manifestJSON)
+	return db.COS.PutObject(db.prefix+manifestName, bytes.NewReader(ciphertext))
+}
+
+// HasCloudSettings 判断云储存的 settings 是否已经保存在本地。
+func (db *DB) HasCloudSettings() bool {
+	return util.PathIsExist(db.settingsPath)
 }
 
 // LoadSettings 检查云储存的 settings 是否已经保存在本地，
@@ -194,22 +223,18 @@ func (db *DB) LoadSettings() error {
 	if util.PathIsNotExist(db.settingsPath) {
 		return nil
 	}
-	if db.GCM == nil {
-		return errors.New("require login")
-	}
-	encryptedSettings, err := ioutil.ReadFile(db.settingsPath)
-	if err != nil {
-		return err
-	}
-	settingsJSON, err := db.GCM.Decrypt(encryptedSettings)
+	settingsJSON, err := db.cloudSettings()
 	if err != nil {
 		return err
 	}
+	db.mu.Lock()
 	db.COS = newCOS(settingsJSON)
+	db.mu.Unlock()
 	return nil
 }
 
-func newCOS(settingsJSON []byte) cloud.ObjectStorage {
+// newCOS 根据云储存设置生成 cloud.ObjectStorage (测试时可替换)。
+var newCOS = func(settingsJSON []byte) cloud.ObjectStorage {
 	switch provider := cloud.GetProviderFromJSON(settingsJSON); provider {
 	case cloud.IBM:
 		settings := ibm.NewSettingsFromJSON(settingsJSON)
@@ -242,6 +267,13 @@ func (db *DB) GetRecoByID(id string) (*Reco, error) {
 	return reco, err
 }
 
+// GetRecoByChecksum .
+func (db *DB) GetRecoByChecksum(checksum string) (*Reco, error) {
+	reco := new(Reco)
+	err := db.DB.One("Checksum", checksum, reco)
+	return reco, err
+}
+
 // GetRecosByTag .
 func (db *DB) GetRecosByTag(tagName string) ([]*Reco, error) {
 	tag, err := db.GetTagByName(tagName)
@@ -309,48 +341,69 @@ func (db *DB) DeleteReco(id string) error {
 
 // InsertReco 插入一个 reco 到数据库中，同时添加 tags 到数据库中。
 // 由于还需要上传文件到 COS, 如果上传失败要回滚数据库，因此在这个事务内上传。
-func (db *DB) InsertReco(reco *Reco, objName string, objBody []byte) error {
+// 如果 COS 里已有内容相同的对象，则直接引用该对象，不重复上传。
+func (db *DB) InsertReco(reco *Reco, objBody []byte) error {
+	return db.InsertRecoInBox(reco, objBody, "")
+}
+
+// InsertRecoInBox 与 InsertReco 相同，但同时把 reco 放进标题为 boxTitle 的纸箱 (不存在时新建),
+// 在同一个事务里完成，并且直接用该纸箱的密钥加密上传 (参考 storeFor)。
+// boxTitle 为空时等同 InsertReco.
+func (db *DB) InsertRecoInBox(reco *Reco, objBody []byte, boxTitle string) error {
 	tx, err := db.DB.Begin(true)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	if err := tx.Save(reco); err != nil {
+	if boxTitle != "" {
+		box := new(Box)
+		err := tx.One("Title", boxTitle, box)
+		if err == storm.ErrNotFound {
+			box = model.NewBox(boxTitle)
+		} else if err != nil {
+			return err
+		}
+		box.Add(reco.ID)
+		if err := tx.Save(box); err != nil {
+			return err
+		}
+		reco.Box = box.ID
+	}
+	store, err := db.storeFor(tx, reco.Box)
+	if err != nil {
 		return err
 	}
-	if err := addTags(tx, reco.Tags, reco.ID); err != nil {
+	if err := addObjectRef(tx, store, reco, objBody); err != nil {
+		return err
+	}
+	if err := tx.Save(reco); err != nil {
 		return err
 	}
-	if err := db.encryptUpload(objName, objBody); err != nil {
+	if err := addTags(tx, reco.Tags, reco.ID); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-// encryptUpload 上传数据到 COS.
-func (db *DB) encryptUpload(objName string, content []byte) error {
-	ciphertext := db.GCM.Encrypt(content)
-	body := bytes.NewReader(ciphertext)
-	if err := db.COS.PutObject(objName, body); err != nil {
-		return err
-	}
-	return nil
+// Download 下载、解密，返回文件内容。
+func (db *DB) Download(objName string) ([]byte, error) {
+	return db.downloadDecrypt(objName)
 }
 
-// DownloadDecrypt 下载、解密、写文件。
-func (db *DB) DownloadDecrypt(objName, filePath string) error {
-	body, err := db.COS.GetObjectBody(objName)
+// OpenObject 打开对象 objName, 以便边下载边解密 (参考 ObjectReader)。
+// 用完后要记得 Close.
+func (db *DB) OpenObject(objName string) (*ObjectReader, error) {
+	store, err := db.objectStoreOf(objName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer body.Close()
+	return store.open(objName)
+}
 
-	ciphertext, err := ioutil.ReadAll(body)
-	if err != nil {
-		return err
-	}
-	fileContents, err := db.GCM.Decrypt(ciphertext)
+// DownloadDecrypt 下载、解密、写文件。
+func (db *DB) DownloadDecrypt(objName, filePath string) error {
+	fileContents, err := db.downloadDecrypt(objName)
 	if err != nil {
 		return err
 	}
@@ -363,13 +416,28 @@ func (db *DB) deleteObject(objName string) error {
 }
 
 // UpdateReco .
-func (db *DB) UpdateReco(oldReco, reco *Reco, objName string, objBody []byte) error {
+func (db *DB) UpdateReco(oldReco, reco *Reco, objBody []byte) error {
 	tx, err := db.DB.Begin(true)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
+	// 如果文件有更新则改为引用新的 Object, 并减少旧 Object 的引用计数。
+	orphan := false
+	if objBody != nil && reco.Checksum != oldReco.Checksum {
+		store, err := db.storeFor(tx, reco.Box)
+		if err != nil {
+			return err
+		}
+		if err := addObjectRef(tx, store, reco, objBody); err != nil {
+			return err
+		}
+		if orphan, err = removeObjectRef(tx, oldReco.Object); err != nil {
+			return err
+		}
+	}
+
 	// 重写，相当于一次完全的更新。
 	// 因为 storm 的 update 方法不可更新空值。
 	if err := tx.Save(reco); err != nil {
@@ -388,14 +456,76 @@ func (db *DB) UpdateReco(oldReco, reco *Reco, objName string, objBody []byte) er
 		return err
 	}
 
-	// 如果文件有更新则需要更新 COS 里的文件
-	if objBody != nil && reco.Checksum != oldReco.Checksum {
-		if err := db.encryptUpload(objName, objBody); err != nil {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if orphan {
+		db.deleteOrphan(oldReco.Object)
+	}
+	return nil
+}
+
+// PurgeReco 彻底删除一个已被扔进垃圾桶的 reco, 同时从标签和纸箱中删除它。
+// 只有当已无任何 Reco 引用其 Object 时，才删除 COS 里的对象。
+func (db *DB) PurgeReco(id string) error {
+	reco, err := db.GetRecoByID(id)
+	if err != nil {
+		return err
+	}
+	if reco.DeletedAt == "" {
+		return errors.New("只能彻底删除垃圾桶里的文件")
+	}
+
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteTags(tx, reco.Tags, reco.ID); err != nil {
+		return err
+	}
+	if reco.Box != "" {
+		box := new(Box)
+		if err := tx.One("ID", reco.Box, box); err != nil {
 			return err
 		}
+		box.Remove(reco.ID)
+		if err := tx.Save(box); err != nil {
+			return err
+		}
+	}
+	orphan, err := removeObjectRef(tx, reco.Object)
+	if err != nil {
+		return err
+	}
+	if err := tx.DeleteStruct(reco); err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if orphan {
+		db.deleteOrphan(reco.Object)
+	}
+	return nil
+}
+
+// AddTagsToReco 向 reco 添加标签 (已存在的标签会被忽略)。
+func (db *DB) AddTagsToReco(reco *Reco, tags []string) error {
+	newReco := *reco
+	newReco.Tags = append([]string{}, reco.Tags...)
+	for _, tag := range tags {
+		if !util.HasString(newReco.Tags, tag) {
+			newReco.Tags = append(newReco.Tags, tag)
+		}
+	}
+	if len(newReco.Tags) == len(reco.Tags) {
+		return nil
+	}
+	newReco.UpdatedAt = util.TimeNow()
+	return db.UpdateReco(reco, &newReco, nil)
 }
 
 func addTags(tx storm.Node, tags []string, recoID string) error {
@@ -428,7 +558,11 @@ func deleteTags(tx storm.Node, tagsToDelete []string, recoID string) error {
 			return err
 		}
 		tag.Remove(recoID) // 每一个 tag 都与该 reco.ID 脱离关系
-		return tx.Update(tag)
+
+		// 用 Save 而不用 Update, 因为 Update 不可更新空值 (tag.RecoIDs 可能变空)。
+		if err := tx.Save(tag); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -526,7 +660,28 @@ func (db *DB) ChangeBox(boxID, boxTitle, recoID string) error {
 		return nil
 	}
 
-	// 开始写入数据库。
+	// 如果新旧纸箱的密钥不同 (其中之一是共享纸箱), 还要用新纸箱的密钥重新加密文件。
+	// 上传在事务之外进行，以免在网络 I/O 期间阻塞其他写入。
+	store, err := db.storeFor(db.DB, box.ID)
+	if err != nil {
+		return err
+	}
+	uploaded, err := db.uploadForMove(store, reco)
+	if err != nil {
+		return err
+	}
+	if err := db.saveChangeBox(box, reco, store, uploaded); err != nil {
+		if uploaded != "" {
+			db.discardUploads(map[string]string{reco.Object: uploaded})
+		}
+		return err
+	}
+	return nil
+}
+
+// saveChangeBox 是 ChangeBox 的数据库部分，在一个事务里完成。
+func (db *DB) saveChangeBox(box *Box, reco *Reco, store *objectStore, uploaded string) error {
+	recoID := reco.ID
 	tx, err := db.DB.Begin(true)
 	if err != nil {
 		return err
@@ -558,5 +713,16 @@ func (db *DB) ChangeBox(boxID, boxTitle, recoID string) error {
 		return err
 	}
 
-	return tx.Commit()
+	orphan, err := moveObjectRef(tx, store, reco, uploaded)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if orphan != "" {
+		db.deleteOrphan(orphan)
+	}
+	return nil
 }
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+const (
+	exportHeaderName      = "recoit-export.json"
+	manifestName          = "manifest.json"
+	encryptedManifestName = "manifest.json.enc"
+	exportObjectsDir      = "objects/"
+	manifestVersion       = 2
+)
+
+// ErrExportPassword 表示导出包的密码错误 (或导出包已损坏)。
+var ErrExportPassword = errors.New("wrong export password or broken bundle")
+
+// ExportHeader 是导出包里的第一个文件 (recoit-export.json), 说明导出包的格式。
+// 如果 Encrypted 为 true, 导出密钥由导出密码及 Salt 经 scrypt 派生 (参考 aesgcm.DeriveKey),
+// manifest (manifest.json.enc) 用该密钥加密 (AES-GCM, nonce 在前),
+// 每个 Object 的内容则用该密钥分块加密 (参考 aesgcm.ChunkEncrypter)。
+type ExportHeader struct {
+	Version   int
+	Encrypted bool
+	Salt      string // base64, 未加密时为空
+}
+
+// Manifest 是导出包里的 manifest.json, 记录全部元数据。
+// 每个 Object 的内容保存在导出包的 objects/<Reco.Object> 里。
+type Manifest struct {
+	Version    int
+	ExportedAt string
+	Recos      []Reco
+	Tags       []Tag
+	Boxes      []Box
+}
+
+// Export 把全部 reco 的内容及元数据导出为一个 tar 包，写入 w.
+// 如果 password 为空，则导出解密后的内容，否则用 password 派生的密钥重新加密
+// (包括 manifest, 因为其中有文件名、描述及标签)。
+// 导出包不依赖 COS, 可用于迁移或离线备份 (参考 ReadExport)。
+func (db *DB) Export(w io.Writer, password string) error {
+	manifest, err := db.newManifest()
+	if err != nil {
+		return err
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	header := ExportHeader{Version: manifestVersion}
+	var exportGCM *aesgcm.AEAD
+	if password != "" {
+		salt := aesgcm.NewSalt()
+		header.Encrypted = true
+		header.Salt = util.Base64Encode(salt)
+		exportGCM = aesgcm.NewGCM(aesgcm.DeriveKey(password, salt))
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, exportHeaderName, headerJSON); err != nil {
+		return err
+	}
+	if exportGCM != nil {
+		err = writeTarFile(tw, encryptedManifestName, exportGCM.Encrypt(manifestJSON))
+	} else {
+		err = writeTarFile(tw, manifestName, manifestJSON)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 多个 Reco 可能共用同一个 Object, 每个 Object 只导出一次。
+	exported := make(map[string]bool)
+	for _, reco := range manifest.Recos {
+		if reco.Object == "" || exported[reco.Object] {
+			continue
+		}
+		if err := db.exportObject(tw, reco.Object, exportGCM); err != nil {
+			return err
+		}
+		exported[reco.Object] = true
+	}
+	return tw.Close()
+}
+
+// exportObject 把对象 objName 边下载边写入 tw, 不需要把整个对象读进内存。
+// 如果 exportGCM 不为 nil, 则边读边用它加密 (分块加密，参考 aesgcm.ChunkEncrypter)。
+func (db *DB) exportObject(tw *tar.Writer, objName string, exportGCM *aesgcm.AEAD) error {
+	obj, err := db.OpenObject(objName)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	var content io.Reader = obj
+	size := obj.Size()
+	if exportGCM != nil {
+		content = exportGCM.NewChunkEncrypter(obj, size)
+		size = aesgcm.ChunkedSize(size)
+	}
+	header := &tar.Header{
+		Name:    exportObjectsDir + objName,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, content)
+	return err
+}
+
+// ReadExport 读取 Export 导出的 tar 包，返回 manifest 及每个 Object 的内容 (key 是对象名)。
+// 导出包被加密时需要提供导出密码，密码错误时返回 ErrExportPassword.
+func ReadExport(r io.Reader, password string) (*Manifest, map[string][]byte, error) {
+	var exportGCM *aesgcm.AEAD
+	var manifest *Manifest
+	objects := make(map[string][]byte)
+	headerRead := false
+
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if th.Name == exportHeaderName {
+			if exportGCM, err = readExportHeader(content, password); err != nil {
+				return nil, nil, err
+			}
+			headerRead = true
+			continue
+		}
+		if !headerRead {
+			return nil, nil, errors.New("not a recoit export bundle")
+		}
+		wantManifest := manifestName
+		if exportGCM != nil {
+			wantManifest = encryptedManifestName
+			if content, err = exportGCM.Decrypt(content); err != nil {
+				return nil, nil, ErrExportPassword
+			}
+		}
+		switch {
+		case th.Name == wantManifest:
+			manifest = new(Manifest)
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, nil, err
+			}
+		case strings.HasPrefix(th.Name, exportObjectsDir):
+			objects[strings.TrimPrefix(th.Name, exportObjectsDir)] = content
+		}
+	}
+	if manifest == nil {
+		return nil, nil, errors.New("the bundle has no manifest")
+	}
+	return manifest, objects, nil
+}
+
+// readExportHeader 检查导出包的格式，导出包被加密时返回由 password 派生的 AEAD.
+func readExportHeader(headerJSON []byte, password string) (*aesgcm.AEAD, error) {
+	var header ExportHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+	if header.Version != manifestVersion {
+		return nil, fmt.Errorf("unknown export version: %d", header.Version)
+	}
+	if !header.Encrypted {
+		return nil, nil
+	}
+	if password == "" {
+		return nil, errors.New("the bundle is encrypted, require the export password")
+	}
+	salt, err := util.Base64Decode(header.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return aesgcm.NewGCM(aesgcm.DeriveKey(password, salt)), nil
+}
+
+func (db *DB) newManifest() (*Manifest, error) {
+	manifest := &Manifest{
+		Version:    manifestVersion,
+		ExportedAt: util.TimeNow(),
+	}
+	// 第一条 reco 包含被加密的 masterKey, 不导出。
+	err := db.DB.Select(q.Gt("ID", "1")).Find(&manifest.Recos)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	if err := db.DB.All(&manifest.Tags); err != nil {
+		return nil, err
+	}
+	if err := db.DB.All(&manifest.Boxes); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestExportRoundTrip(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	contents := map[string]string{"secret-plan.txt": "plan", "copy-of-plan.txt": "plan", "notes.txt": "notes"}
+	for name, content := range contents {
+		reco, _ := model.NewFile(name)
+		reco.Checksum = "sum-" + content
+		if err := alice.InsertReco(reco, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, password := range []string{"", "export-pwd"} {
+		buf := new(bytes.Buffer)
+		if err := alice.Export(buf, password); err != nil {
+			t.Fatal(err)
+		}
+		bundle := buf.Bytes()
+		if password != "" {
+			if bytes.Contains(bundle, []byte("secret-plan.txt")) || bytes.Contains(bundle, []byte("notes")) {
+				t.Error("an encrypted bundle should not contain file names or contents in plain text")
+			}
+			if _, _, err := ReadExport(bytes.NewReader(bundle), "wrong"); err != ErrExportPassword {
+				t.Errorf("wrong password: got %v", err)
+			}
+		}
+
+		manifest, objects, err := ReadExport(bytes.NewReader(bundle), password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Recos) != len(contents) {
+			t.Fatalf("exported %d recos, want %d", len(manifest.Recos), len(contents))
+		}
+		if len(objects) != 2 {
+			t.Errorf("exported %d objects, want 2 (identical files share one)", len(objects))
+		}
+		for _, reco := range manifest.Recos {
+			if got := string(objects[reco.Object]); got != contents[reco.FileName] {
+				t.Errorf("%s: content = %q, want %q", reco.FileName, got, contents[reco.FileName])
+			}
+		}
+	}
+}
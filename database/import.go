@@ -0,0 +1,227 @@
+package database
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ahui2016/recoit/graphics"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+// importBucket 记录已导入的文件 (相对路径 → Reco.ID), 以便中断后继续导入。
+const importBucket = "imports"
+
+// 文件夹名称的转换方式。
+const (
+	DirAsBox  = "box"  // 第一层子文件夹作为纸箱，更深层的子文件夹作为标签。
+	DirAsTags = "tags" // 全部子文件夹都作为标签。
+	DirAsNone = "none" // 忽略子文件夹。
+)
+
+// ImportRules 决定如何导入一个文件夹。
+type ImportRules struct {
+	DirAs      string   // DirAsBox, DirAsTags 或 DirAsNone
+	Tags       []string // 添加到全部文件的标签
+	SkipHidden bool     // 跳过以 "." 开头的文件和文件夹
+}
+
+// ImportResult 是导入时每个文件的处理结果。
+type ImportResult struct {
+	Path    string // 相对于导入文件夹的路径
+	ID      string
+	Status  string // imported, duplicate, done, error
+	Message string
+}
+
+// ErrImportDisabled 表示服务器没有设置允许导入的文件夹 (参考 ImportDir)。
+var ErrImportDisabled = errors.New("importing server directories is disabled (no import root)")
+
+// resolveImportDir 把 dir (相对于 importRoot 的路径，或 importRoot 里的绝对路径) 转换为真实路径。
+// 解析符号链接后不在 importRoot 里面时返回错误，以免导入数据文件夹、其他用户的数据库或系统文件。
+func resolveImportDir(importRoot, dir string) (string, error) {
+	if importRoot == "" {
+		return "", ErrImportDisabled
+	}
+	root, err := filepath.Abs(importRoot)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("the directory is outside the import root")
+	}
+	return dir, nil
+}
+
+// ImportDir 遍历 importRoot 里的文件夹 dir, 把每个文件转换为 reco.
+// dir 可以是相对于 importRoot 的路径，importRoot 为空时不允许导入 (返回 ErrImportDisabled)。
+// 如果数据库中已有内容相同的文件，则跳过该文件。出错的文件记录在结果里，不影响其他文件。
+// 已处理的文件会被记录下来，因此中断后再次导入同一个文件夹时会从中断处继续 (并重试出错的文件)。
+// 符号链接一律跳过，因此不会导入 importRoot 以外的文件。
+func (db *DB) ImportDir(importRoot, dir string, rules ImportRules) ([]ImportResult, error) {
+	root, err := resolveImportDir(importRoot, dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("not a directory: " + dir)
+	}
+	if rules.DirAs == "" {
+		rules.DirAs = DirAsBox
+	}
+	if rules.DirAs != DirAsBox && rules.DirAs != DirAsTags && rules.DirAs != DirAsNone {
+		return nil, errors.New("unknown dir-as: " + rules.DirAs)
+	}
+
+	progress := db.DB.From(importBucket)
+	results := []ImportResult{}
+	addError := func(path string, err error) {
+		rel, _ := filepath.Rel(root, path)
+		results = append(results, ImportResult{
+			Path: filepath.ToSlash(rel), Status: "error", Message: err.Error(),
+		})
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 无法读取的文件或文件夹，记录后继续 (文件夹的内容会被跳过)。
+			addError(path, err)
+			return nil
+		}
+		if rules.SkipHidden && path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			addError(path, err)
+			return nil
+		}
+		result := ImportResult{Path: filepath.ToSlash(rel)}
+
+		id, err := importedID(db, progress, root, result.Path)
+		if err != nil {
+			addError(path, err)
+			return nil
+		}
+		if id != "" {
+			result.ID, result.Status = id, "done"
+			results = append(results, result)
+			return nil
+		}
+
+		result.ID, result.Status, err = db.importFile(path, result.Path, rules)
+		if err != nil {
+			// 出错的文件不记录进度，下次导入时会重试。
+			result.Status, result.Message = "error", err.Error()
+		} else if err := progress.Set(root, result.Path, result.ID); err != nil {
+			// 文件已导入，下次导入时会因为内容相同而被视为重复。
+			log.Printf("failed to record import progress of %s: %v", path, err)
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
+
+// importedID 返回之前已导入的文件 rel 的 reco ID, 未导入时返回空字符串。
+// 如果记录的 reco 已不存在 (例如重置账号后), 也返回空字符串，以便重新导入。
+func importedID(db *DB, progress storm.Node, root, rel string) (string, error) {
+	var id string
+	err := progress.Get(root, rel, &id)
+	if err == storm.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = db.GetRecoByID(id)
+	if err == storm.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// importFile 导入一个文件，rel 是该文件相对于导入文件夹的路径。
+func (db *DB) importFile(path, rel string, rules ImportRules) (id, status string, err error) {
+	fileContents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	checksum := util.Sha256Hex(fileContents)
+	existing, err := db.GetRecoByChecksum(checksum)
+	if err != nil && err != storm.ErrNotFound {
+		return
+	}
+	if err == nil {
+		return existing.ID, "duplicate", nil
+	}
+
+	reco, err := model.NewFile(filepath.Base(path))
+	if err != nil {
+		return
+	}
+	boxTitle, dirTags := mapDirs(rel, rules.DirAs)
+	reco.Checksum = checksum
+	reco.FileSize = int64(len(fileContents))
+	reco.Tags = mergeTags(rules.Tags, dirTags)
+	if reco.IsImage() {
+		reco.Photo = graphics.ReadPhoto(fileContents)
+	}
+
+	// 放进纸箱与插入 reco 在同一个事务里完成，以免中断后再次导入时被视为重复而不放进纸箱。
+	if err = db.InsertRecoInBox(reco, fileContents, boxTitle); err != nil {
+		return
+	}
+	return reco.ID, "imported", nil
+}
+
+// mapDirs 根据 dirAs 把 rel (以 "/" 分隔的相对路径) 中的文件夹名称转换为纸箱标题和标签。
+func mapDirs(rel, dirAs string) (boxTitle string, tags []string) {
+	dirs := strings.Split(rel, "/")
+	dirs = dirs[:len(dirs)-1] // 最后一项是文件名
+	if len(dirs) == 0 || dirAs == DirAsNone {
+		return "", nil
+	}
+	if dirAs == DirAsBox {
+		return dirs[0], dirs[1:]
+	}
+	return "", dirs
+}
+
+func mergeTags(a, b []string) []string {
+	tags := []string{}
+	for _, tag := range append(append([]string{}, a...), b...) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !util.HasString(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
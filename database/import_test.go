@@ -0,0 +1,128 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/util"
+)
+
+func TestMapDirs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rel      string
+		dirAs    string
+		wantBox  string
+		wantTags []string
+	}{
+		{"根目录的文件", "a.txt", DirAsBox, "", nil},
+		{"第一层作为纸箱", "photos/a.jpg", DirAsBox, "photos", []string{}},
+		{"更深层作为标签", "photos/2020/trip/a.jpg", DirAsBox, "photos", []string{"2020", "trip"}},
+		{"全部作为标签", "photos/2020/a.jpg", DirAsTags, "", []string{"photos", "2020"}},
+		{"忽略文件夹", "photos/2020/a.jpg", DirAsNone, "", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			box, tags := mapDirs(tc.rel, tc.dirAs)
+			if box != tc.wantBox || !util.SameSlice(tags, tc.wantTags) {
+				t.Errorf("got %q %v; want %q %v", box, tags, tc.wantBox, tc.wantTags)
+			}
+		})
+	}
+}
+
+func writeImportFile(t *testing.T, root, rel, content string) {
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportDirResume(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+	alice := loginTestUser(t, users, cos, "alice")
+
+	importRoot := filepath.Dir(tempPath(t))
+	writeImportFile(t, importRoot, "trip/a.txt", "a")
+	writeImportFile(t, importRoot, "trip/day1/b.txt", "b")
+	outside := filepath.Dir(tempPath(t))
+	writeImportFile(t, outside, "secret.txt", "secret")
+	if err := os.Symlink(outside, filepath.Join(importRoot, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"..", outside, "link"} {
+		if _, err := alice.ImportDir(importRoot, dir, ImportRules{}); err == nil {
+			t.Errorf("importing %s should be refused", dir)
+		}
+	}
+	if _, err := alice.ImportDir("", "trip", ImportRules{}); err != ErrImportDisabled {
+		t.Errorf("without an import root: got %v", err)
+	}
+
+	// 上传失败时每个文件都有结果，并且不中断导入。
+	statuses := func(results []ImportResult) map[string]string {
+		m := make(map[string]string)
+		for _, result := range results {
+			m[result.Path] = result.Status
+		}
+		return m
+	}
+	cos.failPut = true
+	results, err := alice.ImportDir(importRoot, "trip", ImportRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(results); len(got) != 2 || got["a.txt"] != "error" || got["day1/b.txt"] != "error" {
+		t.Fatalf("failed import: %v", got)
+	}
+
+	// 再次导入时重试出错的文件，第三次则全部已完成。
+	cos.failPut = false
+	for _, want := range []string{"imported", "done"} {
+		results, err := alice.ImportDir(importRoot, "trip", ImportRules{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := statuses(results); got["a.txt"] != want || got["day1/b.txt"] != want {
+			t.Errorf("want %s, got %v", want, got)
+		}
+	}
+	// 按文件夹放进纸箱时，中断后再次导入仍会放进纸箱。
+	writeImportFile(t, importRoot, "album/x/c.txt", "c")
+	rules := ImportRules{DirAs: DirAsBox}
+	cos.failPut = true
+	if _, err := alice.ImportDir(importRoot, "album", rules); err != nil {
+		t.Fatal(err)
+	}
+	cos.failPut = false
+	results, err = alice.ImportDir(importRoot, "album", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := statuses(results); got["x/c.txt"] != "imported" {
+		t.Fatalf("want imported, got %v", got)
+	}
+	box, err := alice.getBoxByTitle("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reco, err := alice.GetRecoByID(results[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reco.Box != box.ID || !util.HasString(box.RecoIDs, reco.ID) {
+		t.Errorf("the file should be in the box x, got box %q, box files %v", reco.Box, box.RecoIDs)
+	}
+}
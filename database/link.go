@@ -0,0 +1,425 @@
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+const (
+	// linkSecretKey 是签名分享链接所用的服务器密钥在 metaBucket 里的 key.
+	linkSecretKey = "link-secret"
+
+	// linkSecretSize 是链接中的 secret 的字节数 (编码前)。
+	linkSecretSize = 32
+
+	// LinkOK 是成功下载时 model.LinkAccess.Result 的值。
+	LinkOK = "ok"
+
+	// linkObjectDir 是分享链接的文件副本在该用户的对象名前缀下的文件夹。
+	linkObjectDir = "links/"
+)
+
+// 打开分享链接时的错误。
+var (
+	ErrLinkInvalid  = errors.New("the link is invalid or has expired")
+	ErrLinkPassword = errors.New("wrong password")
+	ErrLinkUsedUp   = errors.New("the link has reached its download limit")
+)
+
+// LinkFile 是通过分享链接打开的一个文件 (参考 Users.OpenShareLink)。
+// 每个链接有专用的文件副本，用链接中的密钥解密，云储存由服务器代替主人访问
+// (参考 DB.sharedCOS), 因此主人未解锁时也能下载，而链接不能解密主人的其他文件。
+type LinkFile struct {
+	Reco *Reco
+	Link *model.ShareLink
+
+	users     *Users
+	key       []byte
+	cos       cloud.ObjectStorage
+	ip        string
+	userAgent string
+}
+
+// loadLinkSecret 从数据库读取签名分享链接所用的服务器密钥，第一次使用时生成。
+func (users *Users) loadLinkSecret() error {
+	err := users.root.Get(metaBucket, linkSecretKey, &users.linkSecret)
+	if err != storm.ErrNotFound {
+		return err
+	}
+	users.linkSecret = aesgcm.RandomKey()
+	return users.root.Set(metaBucket, linkSecretKey, users.linkSecret)
+}
+
+// signLink 用服务器密钥对链接的 secret 及有效期签名，
+// 使伪造或被改动有效期的链接不需要查询数据库就能被拒绝。
+func (users *Users) signLink(secret string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, users.linkSecret)
+	mac.Write([]byte(secret + "." + strconv.FormatInt(expiresAt, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseLinkToken 检查 token (格式为 secret.expiresAt.signature) 的签名及有效期，返回 secret.
+func (users *Users) parseLinkToken(token string) (secret string, expiresAt int64, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", 0, ErrLinkInvalid
+	}
+	secret = parts[0]
+	if expiresAt, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return "", 0, ErrLinkInvalid
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(users.signLink(secret, expiresAt))) {
+		return "", 0, ErrLinkInvalid
+	}
+	if time.Now().Unix() >= expiresAt {
+		return "", 0, ErrLinkInvalid
+	}
+	return secret, expiresAt, nil
+}
+
+func newLinkSecret() string {
+	b := make([]byte, linkSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashLinkSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// linkKey 由链接的 secret 及密码经 scrypt 派生用来加密 ShareLink.Key 的密钥，
+// 因此不需要另外保存密码的 hash, 密码错误时解密就会失败。
+func linkKey(secret, password string, salt []byte) []byte {
+	return aesgcm.DeriveKey(secret+":"+password, salt)
+}
+
+// CreateShareLink 为 owner 的文件 recoID 新建一个分享链接，有效期为 ttl,
+// password 可以为空，maxDownloads 为 0 表示不限次数。
+// 文件用一个随机的密钥重新加密，作为该链接专用的副本上传，链接只能解密这个副本。
+// 返回的 token 只在此时可以得到 (数据库里只保存其 hash), 应放在链接里 (参考 OpenShareLink)。
+func (users *Users) CreateShareLink(owner *DB, recoID, password string, ttl time.Duration, maxDownloads int) (token string, link *model.ShareLink, err error) {
+	if ttl <= 0 {
+		return "", nil, errors.New("the expiry time should be in the future")
+	}
+	if maxDownloads < 0 {
+		return "", nil, errors.New("the download limit should not be negative")
+	}
+	if !owner.IsReady() {
+		return "", nil, errors.New("require login")
+	}
+	reco, err := owner.GetRecoByID(recoID)
+	if err != nil {
+		return "", nil, err
+	}
+	if reco.Type != model.File || reco.Object == "" || reco.DeletedAt != "" {
+		return "", nil, errors.New("only files can be shared by link")
+	}
+	content, err := owner.Download(reco.Object)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := owner.shareSettings(); err != nil {
+		return "", nil, err
+	}
+
+	secret := newLinkSecret()
+	expiresAt := time.Now().Add(ttl).Unix()
+	link = model.NewShareLink(hashLinkSecret(secret), owner.Name, reco, expiresAt, maxDownloads)
+	link.Object = owner.prefix + linkObjectDir + link.ID + objectExt
+	fileKey := aesgcm.RandomKey()
+	salt := aesgcm.NewSalt()
+	link.Key = util.Base64Encode(aesgcm.NewGCM(linkKey(secret, password, salt)).Encrypt(fileKey))
+	link.Salt = util.Base64Encode(salt)
+	link.HasPassword = password != ""
+
+	ciphertext := aesgcm.NewGCM(fileKey).EncryptChunks(content)
+	if err := owner.COS.PutObject(link.Object, bytes.NewReader(ciphertext)); err != nil {
+		return "", nil, err
+	}
+	if err := users.root.Save(link); err != nil {
+		if err := owner.deleteObject(link.Object); err != nil {
+			log.Printf("failed to delete object %s: %v", link.Object, err)
+		}
+		return "", nil, err
+	}
+	token = secret + "." + strconv.FormatInt(expiresAt, 10) + "." + users.signLink(secret, expiresAt)
+	return token, link, nil
+}
+
+// ShareLinks 返回用户 owner 的分享链接，recoID 不为空时只返回该文件的链接。
+func (users *Users) ShareLinks(owner, recoID string) (links []model.ShareLink, err error) {
+	matchers := []q.Matcher{q.Eq("Owner", owner)}
+	if recoID != "" {
+		matchers = append(matchers, q.Eq("RecoID", recoID))
+	}
+	err = users.root.Select(matchers...).OrderBy("CreatedAt").Reverse().Find(&links)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// getShareLink 返回属于 owner 的链接 id, 不属于 owner 时当作不存在。
+func (users *Users) getShareLink(owner, id string) (*model.ShareLink, error) {
+	link := new(model.ShareLink)
+	if err := users.root.One("ID", id, link); err != nil {
+		return nil, err
+	}
+	if link.Owner != owner {
+		return nil, storm.ErrNotFound
+	}
+	return link, nil
+}
+
+// DeleteShareLink 删除 owner 的链接 id 及其访问记录，此后该链接立即失效。
+func (users *Users) DeleteShareLink(owner, id string) error {
+	link, err := users.getShareLink(owner, id)
+	if err != nil {
+		return err
+	}
+	return users.deleteShareLinks([]model.ShareLink{*link})
+}
+
+// DeleteShareLinks 删除用户 owner 的全部链接 (例如重置账号或用恢复码重设密码时)。
+func (users *Users) DeleteShareLinks(owner string) error {
+	links, err := users.ShareLinks(owner, "")
+	if err != nil {
+		return err
+	}
+	return users.deleteShareLinks(links)
+}
+
+// deleteShareLinks 在一个事务中删除 links 及其访问记录，然后删除其文件副本。
+// 此时链接已经失效，因此删除副本失败只写入日志。
+func (users *Users) deleteShareLinks(links []model.ShareLink) error {
+	if len(links) == 0 {
+		return nil
+	}
+	tx, err := users.root.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range links {
+		if err := deleteShareLink(tx, &links[i]); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Object == "" {
+			continue // 旧版本的链接没有副本
+		}
+		if err := users.deleteLinkObject(&link); err != nil {
+			log.Printf("failed to delete object %s: %v", link.Object, err)
+		}
+	}
+	return nil
+}
+
+func (users *Users) deleteLinkObject(link *model.ShareLink) error {
+	owner, err := users.Vault(link.Owner)
+	if err != nil {
+		return err
+	}
+	cos, err := owner.sharedCOS()
+	if err != nil {
+		return err
+	}
+	return cos.DeleteObject(link.Object)
+}
+
+func deleteShareLink(tx storm.Node, link *model.ShareLink) error {
+	if err := tx.DeleteStruct(link); err != nil {
+		return err
+	}
+	err := tx.Select(q.Eq("LinkID", link.ID)).Delete(new(model.LinkAccess))
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// DeleteExpiredLinks 删除全部已过期的链接及其访问记录，应定期调用。
+func (users *Users) DeleteExpiredLinks() error {
+	var links []model.ShareLink
+	err := users.root.Select(q.Lte("ExpiresAt", time.Now().Unix())).Find(&links)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return users.deleteShareLinks(links)
+}
+
+// deleteLegacyLinks 删除旧版本的链接 (没有文件副本，而是保存了整个 masterKey)。
+func (users *Users) deleteLegacyLinks() error {
+	var links []model.ShareLink
+	err := users.root.Select(q.Eq("Salt", "")).Find(&links)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return users.deleteShareLinks(links)
+}
+
+// LinkAccesses 返回 owner 的链接 id 最近的 limit 次下载尝试，最新的在前。
+func (users *Users) LinkAccesses(owner, id string, limit int) (accesses []model.LinkAccess, err error) {
+	if _, err := users.getShareLink(owner, id); err != nil {
+		return nil, err
+	}
+	err = users.root.Find("LinkID", id, &accesses, storm.Limit(limit), storm.Reverse())
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// ShareLinkInfo 检查 token 的签名及有效期，返回其链接 (不检查密码，也不记录访问)。
+func (users *Users) ShareLinkInfo(token string) (*model.ShareLink, error) {
+	link, _, err := users.findShareLink(token)
+	return link, err
+}
+
+func (users *Users) findShareLink(token string) (link *model.ShareLink, secret string, err error) {
+	secret, expiresAt, err := users.parseLinkToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	link = new(model.ShareLink)
+	err = users.root.One("ID", hashLinkSecret(secret), link)
+	if err == storm.ErrNotFound || (err == nil && link.ExpiresAt != expiresAt) {
+		return nil, "", ErrLinkInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return link, secret, nil
+}
+
+// OpenShareLink 检查 token 的签名、有效期、下载次数及密码，成功则返回可下载的文件。
+// 链接需要密码而 password 为空时返回 ErrLinkPassword (此时不记录访问)。
+// ip 及 userAgent 用于记录访问 (参考 model.LinkAccess)。
+func (users *Users) OpenShareLink(token, password, ip, userAgent string) (*LinkFile, error) {
+	link, secret, err := users.findShareLink(token)
+	if err != nil {
+		return nil, err
+	}
+	file := &LinkFile{Link: link, users: users, ip: ip, userAgent: userAgent}
+	if link.HasPassword && password == "" {
+		return nil, ErrLinkPassword
+	}
+	if link.UsedUp() {
+		file.record(ErrLinkUsedUp.Error())
+		return nil, ErrLinkUsedUp
+	}
+	salt, err := util.Base64Decode(link.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if file.key, err = decryptBase64(aesgcm.NewGCM(linkKey(secret, password, salt)), link.Key); err != nil {
+		file.record(ErrLinkPassword.Error())
+		return nil, ErrLinkPassword
+	}
+
+	owner, err := users.Vault(link.Owner)
+	if err != nil {
+		return nil, err
+	}
+	if file.cos, err = owner.sharedCOS(); err != nil {
+		return nil, err
+	}
+	reco, err := owner.GetRecoByID(link.RecoID)
+	if err == storm.ErrNotFound || (err == nil && reco.DeletedAt != "") {
+		file.record("the file has been deleted")
+		return nil, ErrLinkInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.Reco = reco
+	return file, nil
+}
+
+// Open 占用一次下载次数，然后打开该链接的文件副本，以便边下载边解密 (参考 ObjectReader),
+// 不写入硬盘也不把整个文件读进内存。打开失败时退回该次数。每次调用都会被记录。
+// 用完后要记得 Close.
+func (file *LinkFile) Open() (*ObjectReader, error) {
+	if err := file.addDownloads(1); err != nil {
+		file.record(err.Error())
+		return nil, err
+	}
+	store := &objectStore{gcm: aesgcm.NewGCM(file.key), cos: file.cos}
+	obj, err := store.open(file.Link.Object)
+	if err != nil {
+		if err2 := file.addDownloads(-1); err2 != nil {
+			log.Print(err2)
+		}
+		file.record(err.Error())
+		return nil, err
+	}
+	file.record(LinkOK)
+	return obj, nil
+}
+
+// addDownloads 在事务中更新下载次数，以免同时下载时超出限制。
+func (file *LinkFile) addDownloads(n int) error {
+	tx, err := file.users.root.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	link := new(model.ShareLink)
+	if err := tx.One("ID", file.Link.ID, link); err != nil {
+		if err == storm.ErrNotFound {
+			return ErrLinkInvalid
+		}
+		return err
+	}
+	if n > 0 && link.UsedUp() {
+		return ErrLinkUsedUp
+	}
+	link.Downloads += n
+	if err := tx.Save(link); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	file.Link = link
+	return nil
+}
+
+// record 记录一次下载尝试，失败只写入日志。
+func (file *LinkFile) record(result string) {
+	access := model.NewLinkAccess(file.Link.ID, file.ip, file.userAgent, result)
+	if err := file.users.root.Save(access); err != nil {
+		log.Printf("failed to record link access: %v", err)
+	}
+}
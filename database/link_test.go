@@ -0,0 +1,143 @@
+package database
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestShareLink(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	reco, _ := model.NewFile("report.txt")
+	reco.Checksum = "c1"
+	if err := alice.InsertReco(reco, []byte("report")); err != nil {
+		t.Fatal(err)
+	}
+	token, link, err := users.CreateShareLink(alice, reco.ID, "pwd", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 链接只能解密其专用的文件副本。
+	if !cos.has(link.Object) || link.Object == reco.Object {
+		t.Errorf("the link should have its own copy of the file: %s", link.Object)
+	}
+
+	// 主人锁定后，凭链接及密码仍可下载。
+	alice.Lock()
+	if _, err := users.OpenShareLink(token, "", "1.2.3.4", "test"); err != ErrLinkPassword {
+		t.Errorf("a password is required, got %v", err)
+	}
+	if _, err := users.OpenShareLink(token, "wrong", "1.2.3.4", "test"); err != ErrLinkPassword {
+		t.Errorf("the password is wrong, got %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged := parts[0] + ".9999999999." + parts[2]
+	if _, err := users.OpenShareLink(forged, "pwd", "1.2.3.4", "test"); err != ErrLinkInvalid {
+		t.Errorf("a forged expiry should be rejected, got %v", err)
+	}
+
+	file, err := users.OpenShareLink(token, "pwd", "1.2.3.4", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := file.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(got) != "report" {
+		t.Errorf("downloaded %q, %v", got, err)
+	}
+	if !alice.IsLocked() {
+		t.Error("opening a link should not unlock the owner's vault")
+	}
+	if _, err := users.OpenShareLink(token, "pwd", "1.2.3.4", "test"); err != ErrLinkUsedUp {
+		t.Errorf("the download limit is 1, got %v", err)
+	}
+
+	accesses, err := users.LinkAccesses("alice", link.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []string
+	for _, access := range accesses {
+		results = append(results, access.Result)
+	}
+	want := []string{ErrLinkUsedUp.Error(), LinkOK, ErrLinkPassword.Error()}
+	if strings.Join(results, "|") != strings.Join(want, "|") {
+		t.Errorf("accesses: got %q, want %q", results, want)
+	}
+	if _, err := users.LinkAccesses("bob", link.ID, 10); err == nil {
+		t.Error("other users should not see the accesses")
+	}
+
+	if err := users.DeleteShareLink("alice", link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.OpenShareLink(token, "pwd", "1.2.3.4", "test"); err != ErrLinkInvalid {
+		t.Errorf("the link has been deleted, got %v", err)
+	}
+	if cos.has(link.Object) {
+		t.Error("the copy should be deleted with the link")
+	}
+
+	// 没有密码的链接；DeleteShareLinks 撤销该用户的全部链接。
+	if err := alice.Login("alice-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.LoadSettings(); err != nil {
+		t.Fatal(err)
+	}
+	token, link, err = users.CreateShareLink(alice, reco.ID, "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := users.ShareLinkInfo(token); err != nil || info.HasPassword {
+		t.Errorf("ShareLinkInfo() = %+v, %v", info, err)
+	}
+	if _, err := users.OpenShareLink(token, "", "1.2.3.4", "test"); err != nil {
+		t.Errorf("no password is needed, got %v", err)
+	}
+	if err := users.DeleteShareLinks("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.ShareLinkInfo(token); err != ErrLinkInvalid {
+		t.Errorf("the links should be revoked, got %v", err)
+	}
+	if cos.has(link.Object) {
+		t.Error("the copy should be deleted with the link")
+	}
+
+	// 重置账号失败时保留链接，成功后才撤销。
+	token, link, err = users.CreateShareLink(alice, reco.ID, "", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.ResetAccount(alice, "wrong", false); err == nil {
+		t.Fatal("the password is wrong")
+	}
+	if _, err := users.ShareLinkInfo(token); err != nil {
+		t.Errorf("a failed reset should keep the links, got %v", err)
+	}
+	if _, err := users.ResetAccount(alice, "alice-pwd", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.ShareLinkInfo(token); err != ErrLinkInvalid {
+		t.Errorf("the links should be revoked after the reset, got %v", err)
+	}
+	if cos.has(link.Object) {
+		t.Error("the copy should be deleted with the link")
+	}
+}
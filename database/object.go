@@ -0,0 +1,299 @@
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// Object from model.
+type Object = model.Object
+
+const (
+	objectExt = ".reco"
+
+	metaBucket    = "meta"
+	schemaKey     = "schema"
+	schemaVersion = 5
+)
+
+// objectStore 是加密、上传对象所用的密钥、云储存及对象名前缀。
+// 一般的对象用 masterKey 加密，共享纸箱里的对象用该纸箱的密钥加密。
+type objectStore struct {
+	box     string // Object.Box
+	key     []byte // 共享纸箱的密钥，用于分发给成员
+	nameKey []byte // 用来生成对象名 (参考 objectNameKey)
+	gcm     *aesgcm.AEAD
+	cos     cloud.ObjectStorage
+	prefix  string
+}
+
+// objectNameKey 由 masterKey 或纸箱的密钥派生用来生成对象名的密钥。
+func objectNameKey(key []byte) []byte {
+	return aesgcm.Sha256("recoit-name-key:" + string(key))
+}
+
+// name 根据文件内容的 checksum 生成 COS 里的对象名，因此 (同一个 objectStore 里)
+// 内容相同的文件只需要上传一次。对象名是 checksum 的 HMAC 而不是 checksum 本身，
+// 以免云储存服务商从对象名得知文件内容的 hash (从而判断用户是否拥有某个已知的文件)。
+func (store *objectStore) name(checksum string) string {
+	mac := hmac.New(sha256.New, store.nameKey)
+	mac.Write([]byte(checksum))
+	return store.prefix + hex.EncodeToString(mac.Sum(nil)) + objectExt
+}
+
+// upload 加密并上传数据到 COS.
+func (store *objectStore) upload(objName string, content []byte) error {
+	ciphertext := store.gcm.EncryptChunks(content)
+	return store.cos.PutObject(objName, bytes.NewReader(ciphertext))
+}
+
+// download 下载并解密一个对象，返回其内容。
+func (store *objectStore) download(objName string) ([]byte, error) {
+	body, err := store.cos.GetObjectBody(objName)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	ciphertext, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return store.gcm.Decrypt(ciphertext)
+}
+
+// masterStore 返回用 masterKey 加密的 objectStore.
+func (db *DB) masterStore() *objectStore {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return &objectStore{
+		nameKey: objectNameKey(db.masterKey),
+		gcm:     db.GCM,
+		cos:     db.COS,
+		prefix:  db.prefix,
+	}
+}
+
+// storeFor 返回纸箱 boxID 里的文件所用的 objectStore: 如果该纸箱已共享，
+// 则用纸箱的密钥，否则 (包括 boxID 为空) 用 masterKey.
+func (db *DB) storeFor(tx storm.Node, boxID string) (*objectStore, error) {
+	if boxID == "" {
+		return db.masterStore(), nil
+	}
+	shared := new(model.SharedBox)
+	err := tx.One("ID", boxID, shared)
+	if err == storm.ErrNotFound {
+		return db.masterStore(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.boxStore(shared)
+}
+
+// legacyObjectName 是旧版本的对象名，以 Reco.ID 命名。
+func legacyObjectName(recoID string) string {
+	return recoID + objectExt
+}
+
+// addObjectRef 令 reco 引用 store 里与其 checksum 对应的 Object.
+// 如果该 Object 不存在，则加密上传 objBody 并新建 Object, 否则只增加其引用计数。
+// 注意该函数会设置 reco.Object, 因此应在保存 reco 之前调用。
+// (按 checksum 查找，因为旧版本的对象名可能没有前缀。)
+func addObjectRef(tx storm.Node, store *objectStore, reco *Reco, objBody []byte) error {
+	err := tx.Select(q.Eq("Checksum", reco.Checksum), q.Eq("Box", store.box)).First(new(Object))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if err == storm.ErrNotFound {
+		if err := store.upload(store.name(reco.Checksum), objBody); err != nil {
+			return err
+		}
+	}
+	return refObject(tx, store, reco)
+}
+
+// refObject 与 addObjectRef 相同，但对象已经上传 (或已存在), 因此不需要网络 I/O.
+func refObject(tx storm.Node, store *objectStore, reco *Reco) error {
+	obj := new(Object)
+	err := tx.Select(q.Eq("Checksum", reco.Checksum), q.Eq("Box", store.box)).First(obj)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if err == storm.ErrNotFound {
+		obj = model.NewObject(store.name(reco.Checksum), reco.Checksum)
+		obj.Box = store.box
+	} else {
+		obj.RefCount++
+	}
+	reco.Object = obj.Name
+	return tx.Save(obj)
+}
+
+// removeObjectRef 减少 Object 的引用计数，如果已无任何 Reco 引用它，
+// 就删除该 Object 的记录，并返回 true 表示需要删除 COS 里的对象。
+// 由于删除 COS 里的对象无法回滚，因此应在事务提交后才删除。
+func removeObjectRef(tx storm.Node, name string) (orphan bool, err error) {
+	if name == "" {
+		return false, nil
+	}
+	obj := new(Object)
+	if err := tx.One("Name", name, obj); err != nil {
+		return false, err
+	}
+	obj.RefCount--
+	if obj.RefCount > 0 {
+		return false, tx.Save(obj)
+	}
+	return true, tx.DeleteStruct(obj)
+}
+
+// uploadForMove 在事务之外准备 moveObjectRef: 如果 reco 的对象要改用 store 的密钥，
+// 并且 store 里还没有相同内容的对象，就下载、解密后用 store 的密钥重新加密上传。
+// 返回上传的对象名 (没有上传则为空), 如果之后事务失败，应删除该对象 (参考 discardUploads)。
+func (db *DB) uploadForMove(store *objectStore, reco *Reco) (uploaded string, err error) {
+	if reco.Object == "" {
+		return "", nil
+	}
+	old := new(Object)
+	if err := db.DB.One("Name", reco.Object, old); err != nil {
+		return "", err
+	}
+	if old.Box == store.box {
+		return "", nil
+	}
+	err = db.DB.Select(q.Eq("Checksum", reco.Checksum), q.Eq("Box", store.box)).First(new(Object))
+	if err == nil {
+		return "", nil
+	}
+	if err != storm.ErrNotFound {
+		return "", err
+	}
+	oldStore, err := db.storeFor(db.DB, old.Box)
+	if err != nil {
+		return "", err
+	}
+	content, err := oldStore.download(reco.Object)
+	if err != nil {
+		return "", err
+	}
+	uploaded = store.name(reco.Checksum)
+	if err := store.upload(uploaded, content); err != nil {
+		return "", err
+	}
+	return uploaded, nil
+}
+
+// moveObjectRef 令 reco 改为引用 store 里的对象 (例如放进或移出共享纸箱时)。
+// 对象应已由 uploadForMove 上传 (uploaded) 或原已存在于 store 里，因此不需要网络 I/O,
+// 否则 (在上传期间被改动) 返回 errBoxChanged. 返回的 orphan 是已无任何 Reco 引用的旧对象名，
+// 应在事务提交后删除 (参考 removeObjectRef)。reco 的 Object 会被更新并保存。
+func moveObjectRef(tx storm.Node, store *objectStore, reco *Reco, uploaded string) (orphan string, err error) {
+	oldName := reco.Object
+	if oldName == "" {
+		return "", nil
+	}
+	old := new(Object)
+	if err := tx.One("Name", oldName, old); err != nil {
+		return "", err
+	}
+	if old.Box == store.box {
+		return "", nil
+	}
+	if uploaded != store.name(reco.Checksum) {
+		err := tx.Select(q.Eq("Checksum", reco.Checksum), q.Eq("Box", store.box)).First(new(Object))
+		if err == storm.ErrNotFound {
+			return "", errBoxChanged
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := refObject(tx, store, reco); err != nil {
+		return "", err
+	}
+	if err := tx.UpdateField(&Reco{ID: reco.ID}, "Object", reco.Object); err != nil {
+		return "", err
+	}
+	isOrphan, err := removeObjectRef(tx, oldName)
+	if err != nil || !isOrphan {
+		return "", err
+	}
+	return oldName, nil
+}
+
+// deleteOrphan 删除已无任何 Reco 引用的 COS 对象及其衍生图片。
+// 此时数据库已更新，因此删除失败只会在 COS 里留下无用的对象，不影响数据。
+func (db *DB) deleteOrphan(name string) {
+	if err := db.deleteObject(name); err != nil {
+		log.Printf("failed to delete object %s: %v", name, err)
+	}
+	db.deletePreviews(name)
+}
+
+// downloadDecrypt 下载并解密一个对象，根据 Object.Box 选用 masterKey 或纸箱的密钥。
+func (db *DB) downloadDecrypt(objName string) ([]byte, error) {
+	store, err := db.objectStoreOf(objName)
+	if err != nil {
+		return nil, err
+	}
+	return store.download(objName)
+}
+
+// objectStoreOf 返回对象 objName 所用的 objectStore.
+func (db *DB) objectStoreOf(objName string) (*objectStore, error) {
+	obj := new(Object)
+	err := db.DB.One("Name", objName, obj)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return db.storeFor(db.DB, obj.Box)
+}
+
+// migrateObjects 把旧版本的 Reco 转换为引用 Object 的形式。
+// 旧版本的对象以 Reco.ID 命名，每个对象只被一个 Reco 引用。
+// 另外，Reco.Checksum 由 unique 改为 index, 因此需要重建索引。
+func (db *DB) migrateObjects() error {
+	err := db.DB.ReIndex(&Reco{})
+	if err == storm.ErrNotFound {
+		return nil // 空数据库，不需要转换。
+	}
+	if err != nil {
+		return err
+	}
+
+	var recos []Reco
+	if err := db.DB.Find("Type", model.File, &recos); err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, reco := range recos {
+		if reco.Object != "" {
+			continue
+		}
+		obj := model.NewObject(legacyObjectName(reco.ID), reco.Checksum)
+		if err := tx.Save(obj); err != nil {
+			return err
+		}
+		if err := tx.UpdateField(&Reco{ID: reco.ID}, "Object", obj.Name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestObjectName(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	bob := loginTestUser(t, users, cos, "bob")
+
+	checksum := "0123456789abcdef"
+	var names []string
+	for _, db := range []*DB{alice, alice, bob} {
+		reco, _ := model.NewFile("same.txt")
+		reco.Checksum = checksum
+		if err := db.InsertReco(reco, []byte("same")); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, reco.Object)
+	}
+	if strings.Contains(names[0], checksum) {
+		t.Errorf("the object name %s should not reveal the checksum", names[0])
+	}
+	if names[0] != names[1] {
+		t.Error("files with the same content should share one object")
+	}
+	if strings.TrimPrefix(names[0], "alice/") == strings.TrimPrefix(names[2], "bob/") {
+		t.Error("different users should get different object names for the same content")
+	}
+	obj := new(Object)
+	if err := alice.DB.One("Name", names[0], obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.RefCount != 2 {
+		t.Errorf("RefCount = %d, want 2", obj.RefCount)
+	}
+}
+
+func TestOpenObject(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+
+	content := make([]byte, aesgcm.ChunkSize*2+2000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	reco, _ := model.NewFile("big.bin")
+	reco.Checksum = "big"
+	if err := alice.InsertReco(reco, content); err != nil {
+		t.Fatal(err)
+	}
+	if !aesgcm.IsChunked(cos.objects[reco.Object]) {
+		t.Fatal("new objects should be encrypted in chunks")
+	}
+
+	// 旧版本的对象是整体加密的。
+	legacy := "alice/legacy" + objectExt
+	cos.objects[legacy] = alice.GCM.Encrypt(content)
+
+	for _, name := range []string{reco.Object, legacy} {
+		obj, err := alice.OpenObject(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Size() != int64(len(content)) {
+			t.Fatalf("%s: Size() = %d, want %d", name, obj.Size(), len(content))
+		}
+		// 先向前跳到第三块，再退回开头。
+		cos.ranges = nil
+		for _, offset := range []int64{aesgcm.ChunkSize*2 + 10, 5} {
+			if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 1000)
+			if _, err := io.ReadFull(obj, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content[offset:offset+1000]) {
+				t.Fatalf("%s: wrong content at offset %d", name, offset)
+			}
+		}
+		obj.Close()
+		if name == reco.Object && (len(cos.ranges) != 2 || cos.ranges[0] != aesgcm.ChunkStart(2)) {
+			t.Errorf("seeking should only download from the chunk it lands in, got ranges %v", cos.ranges)
+		}
+	}
+}
+
+func TestPurgeSharedObject(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+
+	var recos []*Reco
+	for i := 0; i < 2; i++ {
+		reco, _ := model.NewFile("same.txt")
+		reco.Checksum = "same"
+		if err := alice.InsertReco(reco, []byte("same")); err != nil {
+			t.Fatal(err)
+		}
+		recos = append(recos, reco)
+	}
+	name := recos[0].Object
+	for _, reco := range recos {
+		if err := alice.DeleteReco(reco.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 还有另一个 reco 引用该对象，只减少引用计数。
+	if err := alice.PurgeReco(recos[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	obj := new(Object)
+	if err := alice.DB.One("Name", name, obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.RefCount != 1 {
+		t.Errorf("RefCount = %d, want 1", obj.RefCount)
+	}
+	if !cos.has(name) {
+		t.Fatal("the object is still referenced and should not be deleted")
+	}
+
+	// 最后一个引用被删除后，COS 里的对象也应被删除。
+	if err := alice.PurgeReco(recos[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.DB.One("Name", name, obj); err == nil {
+		t.Error("the Object record should be deleted with its last reference")
+	}
+	if cos.has(name) {
+		t.Error("the orphan object should be deleted from COS")
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+// 衍生图片 (由原文件生成的预览) 的种类，与 Object.Previews 的值相同。
+const (
+	PreviewDisplay = "display" // 显示用的图片
+	PreviewThumb   = "thumb"   // 缩略图
+)
+
+var previewKinds = []string{PreviewDisplay, PreviewThumb}
+
+// ErrNoPreview 表示该对象还没有上传该种衍生图片。
+var ErrNoPreview = errors.New("preview not found")
+
+// previewName 返回对象 objName 的衍生图片 kind 在 COS 里的对象名，放在原对象旁边，
+// 例如 "abc.reco" 的缩略图为 "abc.thumb.reco".
+func previewName(objName, kind string) string {
+	return strings.TrimSuffix(objName, objectExt) + "." + kind + objectExt
+}
+
+// UploadPreview 加密并上传对象 objName 的衍生图片 kind, 使用与原对象相同的密钥
+// (因此共享纸箱里的文件的衍生图片也用纸箱的密钥加密)。
+// version 是生成该图片时的参数的指纹，与之前上传的不同时，之前上传的其他种类的衍生图片作废。
+// 衍生图片随原对象一起删除 (参考 deleteOrphan)。
+func (db *DB) UploadPreview(objName, kind, version string, content []byte) error {
+	obj := new(Object)
+	if err := db.DB.One("Name", objName, obj); err != nil {
+		return err
+	}
+	store, err := db.storeFor(db.DB, obj.Box)
+	if err != nil {
+		return err
+	}
+	return uploadPreview(db.DB, store, obj, kind, version, content)
+}
+
+// DownloadPreview 下载并解密对象 objName 的衍生图片 kind,
+// 未上传或不是用 version 的参数生成时返回 ErrNoPreview.
+func (db *DB) DownloadPreview(objName, kind, version string) ([]byte, error) {
+	obj := new(Object)
+	if err := db.DB.One("Name", objName, obj); err != nil {
+		return nil, err
+	}
+	if obj.PreviewVersion != version || !util.HasString(obj.Previews, kind) {
+		return nil, ErrNoPreview
+	}
+	store, err := db.storeFor(db.DB, obj.Box)
+	if err != nil {
+		return nil, err
+	}
+	return store.download(previewName(objName, kind))
+}
+
+// UploadPreview 与 DB.UploadPreview 相同，但上传的是共享纸箱里的文件的衍生图片，
+// 用成员得到的纸箱密钥加密，因此主人未解锁时成员也能生成缩略图。
+func (access *BoxAccess) UploadPreview(objName, kind, version string, content []byte) error {
+	obj, err := access.object(objName)
+	if err != nil {
+		return err
+	}
+	return uploadPreview(access.Owner.DB, access.store, obj, kind, version, content)
+}
+
+// DownloadPreview 与 DB.DownloadPreview 相同，但下载的是共享纸箱里的文件的衍生图片。
+func (access *BoxAccess) DownloadPreview(objName, kind, version string) ([]byte, error) {
+	obj, err := access.object(objName)
+	if err != nil {
+		return nil, err
+	}
+	if obj.PreviewVersion != version || !util.HasString(obj.Previews, kind) {
+		return nil, ErrNoPreview
+	}
+	return access.store.download(previewName(objName, kind))
+}
+
+// object 返回纸箱里的对象 objName, 不在纸箱里时返回 ErrNoAccess.
+func (access *BoxAccess) object(objName string) (*Object, error) {
+	obj := new(Object)
+	if err := access.Owner.DB.One("Name", objName, obj); err != nil {
+		return nil, err
+	}
+	if obj.Box != access.Box.ID {
+		return nil, ErrNoAccess
+	}
+	return obj, nil
+}
+
+func uploadPreview(node storm.Node, store *objectStore, obj *Object, kind, version string, content []byte) error {
+	if err := store.upload(previewName(obj.Name, kind), content); err != nil {
+		return err
+	}
+	if obj.PreviewVersion != version {
+		obj.PreviewVersion = version
+		obj.Previews = nil
+	}
+	if util.HasString(obj.Previews, kind) {
+		return nil
+	}
+	obj.Previews = append(obj.Previews, kind)
+	return node.Save(obj)
+}
+
+// deletePreviews 删除对象 name 的全部衍生图片 (不存在的也不会出错)。
+func (db *DB) deletePreviews(name string) {
+	for _, kind := range previewKinds {
+		if err := db.deleteObject(previewName(name, kind)); err != nil {
+			log.Printf("failed to delete preview of %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestPreview(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	reco, _ := model.NewFile("photo.png")
+	reco.Checksum = "p1"
+	if err := alice.InsertReco(reco, []byte("photo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.DownloadPreview(reco.Object, PreviewThumb, "v1"); err != ErrNoPreview {
+		t.Errorf("no preview has been uploaded, got %v", err)
+	}
+	if err := alice.UploadPreview(reco.Object, PreviewThumb, "v1", []byte("thumb")); err != nil {
+		t.Fatal(err)
+	}
+	thumb := previewName(reco.Object, PreviewThumb)
+	if data := cos.objects[thumb]; len(data) == 0 || string(data) == "thumb" {
+		t.Error("the preview should be encrypted in COS")
+	}
+	got, err := alice.DownloadPreview(reco.Object, PreviewThumb, "v1")
+	if err != nil || string(got) != "thumb" {
+		t.Errorf("DownloadPreview() = %q, %v", got, err)
+	}
+
+	// 参数改变后，旧的衍生图片作废。
+	if err := alice.UploadPreview(reco.Object, PreviewDisplay, "v2", []byte("display")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.DownloadPreview(reco.Object, PreviewThumb, "v2"); err != ErrNoPreview {
+		t.Errorf("the thumbnail is out of date, got %v", err)
+	}
+
+	// 原对象被删除时，衍生图片也一起删除。
+	if err := alice.DeleteReco(reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.PurgeReco(reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cos.objects[thumb]; ok {
+		t.Error("the preview should be deleted with its object")
+	}
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+// recoveryKeyID 是被恢复码加密的 masterKey 的记录 ID.
+const recoveryKeyID = "recovery"
+
+// recoveryCodeSize 是恢复码的字节数 (编码前), 160 bits 足以抵抗暴力破解。
+const recoveryCodeSize = 20
+
+// newRecoveryCode 生成一个随机的恢复码，例如 "ABCD-EFGH-...", 方便抄写在纸上。
+func newRecoveryCode() string {
+	b := make([]byte, recoveryCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	var groups []string
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	return strings.Join(groups, "-")
+}
+
+// recoveryKey 由恢复码派生密钥，忽略大小写、连字符及空格。
+func recoveryKey(code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return aesgcm.Sha256("recoit-recovery:" + code)
+}
+
+// saveRecoveryCode 生成恢复码，用它加密 masterKey 并保存，返回恢复码。
+func saveRecoveryCode(tx storm.Node, masterKey []byte) (string, error) {
+	code := newRecoveryCode()
+	wrapped := aesgcm.NewGCM(recoveryKey(code)).Encrypt(masterKey)
+	key := model.NewWrappedKey(recoveryKeyID, util.Base64Encode(wrapped))
+	if err := tx.Save(key); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func deleteRecoveryKey(tx storm.Node) error {
+	err := tx.DeleteStruct(&model.WrappedKey{ID: recoveryKeyID})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (db *DB) getRecoveryKey() (*model.WrappedKey, error) {
+	key := new(model.WrappedKey)
+	err := db.DB.One("ID", recoveryKeyID, key)
+	return key, err
+}
+
+// HasRecoveryCode 判断是否已生成恢复码。
+func (db *DB) HasRecoveryCode() bool {
+	_, err := db.getRecoveryKey()
+	return err == nil
+}
+
+// NewRecoveryCode 重新生成恢复码 (需要输入当前的密码), 旧的恢复码随之失效。
+func (db *DB) NewRecoveryCode(passphrase string) (string, error) {
+	if err := db.VerifyPassphrase(passphrase); err != nil {
+		return "", err
+	}
+	reco, err := db.getFirstReco()
+	if err != nil {
+		return "", err
+	}
+	masterKey, err := decryptFirstReco(passphrase, reco.Message)
+	if err != nil {
+		return "", err
+	}
+	return saveRecoveryCode(db.DB, masterKey)
+}
+
+// RecoverAccount 用恢复码解密 masterKey, 并用 newPassphrase 重新加密 (即重设密码)。
+// masterKey 不变，因此全部数据仍然可以解密。为了安全，重设后会锁定并删除全部 session 及 API token.
+func (db *DB) RecoverAccount(code, newPassphrase string) error {
+	if newPassphrase == "" {
+		return errors.New("password is empty")
+	}
+	key, err := db.getRecoveryKey()
+	if err == storm.ErrNotFound {
+		return errors.New("no recovery code for this account")
+	}
+	if err != nil {
+		return err
+	}
+	wrapped, err := util.Base64Decode(key.Key)
+	if err != nil {
+		return err
+	}
+	masterKey, err := aesgcm.NewGCM(recoveryKey(code)).Decrypt(wrapped)
+	if err != nil {
+		return errors.New("wrong recovery code")
+	}
+	reco, err := db.getFirstReco()
+	if err != nil {
+		return err
+	}
+	cipherMasterKey := aesgcm.NewGCM(aesgcm.Sha256(newPassphrase)).Encrypt(masterKey)
+	reco.Message = util.Base64Encode(cipherMasterKey)
+	if err := db.DB.Update(reco); err != nil {
+		return err
+	}
+	if err := deleteAPITokens(db.DB); err != nil {
+		return err
+	}
+	db.LockVault()
+	return nil
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecoverAccount(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	code, err := db.InsertFirstReco("old", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code == "" || !db.HasRecoveryCode() {
+		t.Fatal("should generate a recovery code")
+	}
+	if err := db.RecoverAccount(newRecoveryCode(), "new"); err == nil {
+		t.Fatal("should not recover with a wrong code")
+	}
+
+	// 忽略大小写、连字符及空格
+	typed := strings.ToLower(strings.Replace(code, "-", " ", -1))
+	if err := db.RecoverAccount(typed, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Login("old"); err == nil {
+		t.Error("the old password should not work")
+	}
+	if err := db.Login("new"); err != nil {
+		t.Errorf("the new password should work: %v", err)
+	}
+}
+
+func TestNoRecoveryCode(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	code, err := db.InsertFirstReco("abc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "" || db.HasRecoveryCode() {
+		t.Error("should not generate a recovery code")
+	}
+	if err := db.RecoverAccount("anything", "new"); err == nil {
+		t.Error("should not recover without a recovery code")
+	}
+}
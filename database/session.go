@@ -0,0 +1,59 @@
+package database
+
+import (
+	"net/http"
+
+	"github.com/ahui2016/recoit/session"
+	"github.com/asdine/storm/v3"
+)
+
+// sessionStore 把 session 保存在数据库中 (实现 session.Store)。
+type sessionStore struct {
+	node storm.Node
+}
+
+func (store sessionStore) Save(sess *session.Session) error {
+	return store.node.Save(sess)
+}
+
+func (store sessionStore) Delete(id string) error {
+	err := store.node.DeleteStruct(&session.Session{ID: id})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (store sessionStore) All() (all []session.Session, err error) {
+	err = store.node.All(&all)
+	return
+}
+
+// PersistSessions 把 session 保存在数据库中，使服务器重启后不需要重新登入。
+func (users *Users) PersistSessions() error {
+	return users.Sess.SetStore(sessionStore{users.root})
+}
+
+// NewSession 在成功登入后新建一个 session.
+// masterKey 会用由 session id 派生的密钥加密后保存在 session 中，
+// 因此服务器重启后，持有该 session 的请求可以通过 ResumeSession 重新解锁。
+func (db *DB) NewSession(w http.ResponseWriter) error {
+	return db.Sess.Add(w, db.Name, db.masterKey)
+}
+
+// ResumeSession 在 db.GCM 为空 (例如服务器重启后) 时，尝试用 session 中的 masterKey 解锁。
+// 调用者应确保该 session 属于本用户 (参考 Users.FromSession)。
+func (db *DB) ResumeSession(r *http.Request) error {
+	if !db.IsLocked() {
+		return nil
+	}
+	masterKey, err := db.Sess.Data(r)
+	if err != nil {
+		return err
+	}
+	db.setMasterKey(masterKey)
+	if db.COS == nil {
+		return db.LoadSettings()
+	}
+	return nil
+}
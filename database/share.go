@@ -0,0 +1,771 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/sealbox"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+const (
+	// privateKeyID 是被 masterKey 加密的私钥 (参考 model.User.PublicKey) 的记录 ID.
+	privateKeyID = "box-private"
+
+	// serverKeyName 是旧版本保存服务器密钥的 key (参考 deleteStoredServerKey)。
+	serverKeyName = "server-key"
+)
+
+// ErrNoAccess 表示用户不是该纸箱的成员，或没有所需的权限。
+var ErrNoAccess = errors.New("no access to the box")
+
+// SharedBoxInfo 是分享给某个用户的一个纸箱。
+type SharedBoxInfo struct {
+	Owner string
+	BoxID string
+	Title string
+	Perm  string
+}
+
+// BoxAccess 是成员打开的一个共享纸箱 (参考 Users.OpenSharedBox)。
+// 纸箱的密钥从成员自己的密钥解密得到，云储存则由服务器代替主人访问 (参考 DB.sharedCOS),
+// 因此主人未解锁时也能使用，而成员不会得到主人的云储存设置。
+type BoxAccess struct {
+	Owner  *DB
+	Box    *Box
+	Member *model.BoxMember
+	store  *objectStore
+}
+
+// boxObjectPrefix 返回共享纸箱的对象名前缀。每次更换密钥都使用新的前缀，
+// 以便在全部对象都重新加密之前，旧的对象仍然可用。
+func boxObjectPrefix(ownerPrefix string, shared *model.SharedBox) string {
+	return fmt.Sprintf("%sboxes/%s/%d/", ownerPrefix, shared.ID, shared.KeyVersion)
+}
+
+// boxStore 用主人的 masterKey 解密纸箱的密钥，返回该纸箱的 objectStore.
+func (db *DB) boxStore(shared *model.SharedBox) (*objectStore, error) {
+	db.mu.RLock()
+	gcm, cos := db.GCM, db.COS
+	db.mu.RUnlock()
+	if gcm == nil {
+		return nil, errors.New("require login")
+	}
+	key, err := decryptBase64(gcm, shared.OwnerKey)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStore{
+		box:     shared.ID,
+		key:     key,
+		nameKey: objectNameKey(key),
+		gcm:     aesgcm.NewGCM(key),
+		cos:     cos,
+		prefix:  boxObjectPrefix(db.prefix, shared),
+	}, nil
+}
+
+// sealBoxKey 用主人的 masterKey 加密纸箱的密钥。
+func (db *DB) sealBoxKey(shared *model.SharedBox, key []byte) {
+	shared.OwnerKey = util.Base64Encode(db.GCM.Encrypt(key))
+	shared.UpdatedAt = util.TimeNow()
+}
+
+// LoadServerKey 从文件 path 读取服务器密钥 (base64), 文件不存在时生成。
+// 服务器密钥用来加密分享了纸箱或文件的用户的云储存设置 (参考 DB.shareSettings),
+// 因此应保存在数据文件夹之外，否则复制了数据文件夹就能解密这些设置。
+// 没有服务器密钥时，只有在主人已登入期间才能打开其共享纸箱及分享链接。
+func (users *Users) LoadServerKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data = []byte(util.Base64Encode(aesgcm.RandomKey()))
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	key, err := util.Base64Decode(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("%s should hold a base64 encoded 32-byte key", path)
+	}
+	users.serverGCM = aesgcm.NewGCM(key)
+	return nil
+}
+
+// deleteStoredServerKey 删除旧版本保存在数据库里的服务器密钥及用它加密的云储存设置
+// (复制了数据文件夹就能解密)。设置了服务器密钥时，主人下次登入会重新加密 (参考 RefreshSharedSettings)。
+func (users *Users) deleteStoredServerKey() error {
+	var key []byte
+	err := users.root.Get(metaBucket, serverKeyName, &key)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := users.root.Delete(metaBucket, serverKeyName); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(users.dir, "settings-*.shared"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareSettings 用服务器密钥加密云储存设置并保存，使主人未解锁时服务器也能代替成员
+// 访问主人的云储存 (参考 sharedCOS)。分享纸箱时调用，之后更改云储存设置时会一并更新。
+// 没有服务器密钥时不保存。
+func (db *DB) shareSettings() error {
+	if db.serverGCM == nil {
+		return nil
+	}
+	settingsJSON, err := db.cloudSettings()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(db.sharedPath, db.serverGCM.Encrypt(settingsJSON), 0600)
+}
+
+// RefreshSharedSettings 用当前的服务器密钥重新加密已保存的云储存设置 (服务器密钥可能已更换),
+// 已分享纸箱但没有保存 (例如旧版本分享的纸箱) 时补上，应在登入后调用。
+func (db *DB) RefreshSharedSettings() error {
+	if db.serverGCM == nil || !db.HasCloudSettings() {
+		return nil
+	}
+	if util.PathIsExist(db.sharedPath) {
+		return db.shareSettings()
+	}
+	n, err := db.DB.Count(&model.SharedBox{})
+	if err != nil || n == 0 {
+		return err
+	}
+	return db.shareSettings()
+}
+
+// sharedCOS 返回服务器代替成员访问主人 (db) 的云储存所用的 COS.
+func (db *DB) sharedCOS() (cloud.ObjectStorage, error) {
+	db.mu.RLock()
+	cos := db.COS
+	db.mu.RUnlock()
+	if cos != nil {
+		return cos, nil
+	}
+	if db.serverGCM == nil {
+		return nil, fmt.Errorf("%s needs to be logged in (the server has no server key)", db.Name)
+	}
+	encrypted, err := ioutil.ReadFile(db.sharedPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s needs to login once before the box can be opened", db.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	settingsJSON, err := db.serverGCM.Decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return newCOS(settingsJSON), nil
+}
+
+// cloudSettings 读取并解密本地的云储存设置。
+func (db *DB) cloudSettings() ([]byte, error) {
+	if db.GCM == nil {
+		return nil, errors.New("require login")
+	}
+	encrypted, err := ioutil.ReadFile(db.settingsPath)
+	if err != nil {
+		return nil, err
+	}
+	return db.GCM.Decrypt(encrypted)
+}
+
+func decryptBase64(gcm *aesgcm.AEAD, data64 string) ([]byte, error) {
+	data, err := util.Base64Decode(data64)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Decrypt(data)
+}
+
+// privateKey 返回被 masterKey 加密保存的私钥。
+func (db *DB) privateKey() ([]byte, error) {
+	if db.GCM == nil {
+		return nil, errors.New("require login")
+	}
+	wrapped := new(model.WrappedKey)
+	if err := db.DB.One("ID", privateKeyID, wrapped); err != nil {
+		return nil, err
+	}
+	return decryptBase64(db.GCM, wrapped.Key)
+}
+
+func deletePrivateKey(tx storm.Node) error {
+	err := tx.DeleteStruct(&model.WrappedKey{ID: privateKeyID})
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// EnsureKeyPair 检查已解锁的 vault 有没有可用的密钥对，如果没有
+// (例如旧版本的用户，或重置账号后 masterKey 已改变) 则生成新的密钥对。
+// 公钥保存在 User 里，私钥被 masterKey 加密后保存在该用户的 node 里。
+func (users *Users) EnsureKeyPair(db *DB) error {
+	if _, err := db.privateKey(); err == nil {
+		return nil
+	}
+	publicKey, privateKey := sealbox.GenerateKey()
+
+	tx, err := users.root.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	wrapped := model.NewWrappedKey(privateKeyID, util.Base64Encode(db.GCM.Encrypt(privateKey)))
+	if err := tx.From(usersBucket, db.Name).Save(wrapped); err != nil {
+		return err
+	}
+	user := &model.User{Name: db.Name}
+	if err := tx.UpdateField(user, "PublicKey", util.Base64Encode(publicKey)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// publicKey 返回用户 name 的公钥。
+func (users *Users) publicKey(name string) ([]byte, error) {
+	var user model.User
+	err := users.root.One("Name", name, &user)
+	if err == storm.ErrNotFound {
+		return nil, ErrNoUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.PublicKey == "" {
+		return nil, fmt.Errorf("%s has no public key yet (needs to login once)", name)
+	}
+	return util.Base64Decode(user.PublicKey)
+}
+
+// errBoxChanged 表示在重新加密纸箱的文件期间，纸箱被改动了 (例如有成员添加了文件)。
+var errBoxChanged = errors.New("the box was changed while re-encrypting its files, please try again")
+
+// ShareBox 把 owner 的纸箱分享给用户 member, perm 是 model.ReadOnly 或 model.ReadWrite.
+// 第一次分享时生成纸箱的密钥，并把纸箱里的文件用该密钥重新加密上传。
+// 如果 member 已是成员，则只更新其权限。
+func (users *Users) ShareBox(owner *DB, boxID, member, perm string) error {
+	if perm != model.ReadOnly && perm != model.ReadWrite {
+		return fmt.Errorf("unknown permission: %s", perm)
+	}
+	if member == owner.Name {
+		return errors.New("cannot share a box with its owner")
+	}
+	if !owner.IsReady() {
+		return errors.New("require login")
+	}
+	memberKey, err := users.publicKey(member)
+	if err != nil {
+		return err
+	}
+	box, err := owner.GetBoxByID(boxID)
+	if err != nil {
+		return err
+	}
+	shared := new(model.SharedBox)
+	err = owner.DB.One("ID", boxID, shared)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	firstShare := err == storm.ErrNotFound
+	if firstShare {
+		if err := owner.shareSettings(); err != nil {
+			return err
+		}
+		shared = model.NewSharedBox(boxID)
+		owner.sealBoxKey(shared, aesgcm.RandomKey())
+	}
+	store, err := owner.boxStore(shared)
+	if err != nil {
+		return err
+	}
+
+	// 重新加密上传需要网络 I/O, 因此在事务之外进行，事务中只更新引用。
+	var renamed map[string]string
+	if firstShare {
+		objects, err := owner.boxObjects(box)
+		if err != nil {
+			return err
+		}
+		if renamed, err = owner.reencrypt(objects, store); err != nil {
+			return err
+		}
+	}
+	orphans, err := owner.saveShareBox(shared, store, firstShare, renamed, model.NewBoxMember(boxID, member, perm), memberKey)
+	if err != nil {
+		owner.discardUploads(renamed)
+		return err
+	}
+	owner.deleteOrphans(orphans)
+	return nil
+}
+
+func (db *DB) saveShareBox(shared *model.SharedBox, store *objectStore, firstShare bool, renamed map[string]string, member *model.BoxMember, memberKey []byte) (orphans []string, err error) {
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if firstShare {
+		err := tx.One("ID", shared.ID, new(model.SharedBox))
+		if err == nil {
+			return nil, errBoxChanged // 同时被分享了两次
+		}
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+		if err := tx.Save(shared); err != nil {
+			return nil, err
+		}
+		if orphans, err = moveBoxObjects(tx, store, renamed); err != nil {
+			return nil, err
+		}
+	}
+	if err := sealForMember(tx, store, member, memberKey); err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
+}
+
+// boxObjects 返回纸箱里的文件引用的全部 Object.
+func (db *DB) boxObjects(box *Box) ([]Object, error) {
+	var objects []Object
+	seen := make(map[string]bool)
+	for _, id := range box.RecoIDs {
+		reco := new(Reco)
+		if err := db.DB.One("ID", id, reco); err != nil {
+			return nil, err
+		}
+		if reco.Object == "" || seen[reco.Object] {
+			continue
+		}
+		seen[reco.Object] = true
+		obj := new(Object)
+		if err := db.DB.One("Name", reco.Object, obj); err != nil {
+			return nil, err
+		}
+		objects = append(objects, *obj)
+	}
+	return objects, nil
+}
+
+// reencrypt 下载、解密 objects, 用 store 的密钥重新加密上传，返回旧对象名到新对象名的对应。
+// 出错时删除已上传的对象。
+func (db *DB) reencrypt(objects []Object, store *objectStore) (renamed map[string]string, err error) {
+	renamed = make(map[string]string)
+	defer func() {
+		if err != nil {
+			db.discardUploads(renamed)
+		}
+	}()
+	for _, obj := range objects {
+		oldStore, err := db.storeFor(db.DB, obj.Box)
+		if err != nil {
+			return nil, err
+		}
+		content, err := oldStore.download(obj.Name)
+		if err != nil {
+			return nil, err
+		}
+		newName := store.name(obj.Checksum)
+		if err := store.upload(newName, content); err != nil {
+			return nil, err
+		}
+		renamed[obj.Name] = newName
+	}
+	return renamed, nil
+}
+
+// discardUploads 删除 reencrypt 上传了但未被引用的对象 (例如事务失败时)。
+func (db *DB) discardUploads(renamed map[string]string) {
+	for _, name := range renamed {
+		if err := db.deleteObject(name); err != nil {
+			log.Printf("failed to delete object %s: %v", name, err)
+		}
+	}
+}
+
+// moveBoxObjects 令纸箱里的全部文件改为引用 reencrypt 上传的对象 (参考 moveObjectRef)。
+// 如果有文件的对象不在 renamed 里 (在上传期间被添加), 则返回 errBoxChanged.
+func moveBoxObjects(tx storm.Node, store *objectStore, renamed map[string]string) (orphans []string, err error) {
+	box := new(Box)
+	if err := tx.One("ID", store.box, box); err != nil {
+		return nil, err
+	}
+	for _, id := range box.RecoIDs {
+		reco := new(Reco)
+		if err := tx.One("ID", id, reco); err != nil {
+			return nil, err
+		}
+		oldName := reco.Object
+		if oldName == "" {
+			continue
+		}
+		if _, ok := renamed[oldName]; !ok {
+			return nil, errBoxChanged
+		}
+		if err := refObject(tx, store, reco); err != nil {
+			return nil, err
+		}
+		if err := tx.UpdateField(&Reco{ID: reco.ID}, "Object", reco.Object); err != nil {
+			return nil, err
+		}
+		isOrphan, err := removeObjectRef(tx, oldName)
+		if err != nil {
+			return nil, err
+		}
+		if isOrphan {
+			orphans = append(orphans, oldName)
+		}
+	}
+	return orphans, nil
+}
+
+// sealForMember 用成员的公钥加密纸箱的密钥，并保存成员记录。
+func sealForMember(tx storm.Node, store *objectStore, member *model.BoxMember, publicKey []byte) error {
+	sealed, err := sealbox.Seal(store.key, publicKey)
+	if err != nil {
+		return err
+	}
+	member.Key = util.Base64Encode(sealed)
+	return tx.Save(member)
+}
+
+// RevokeBox 撤销用户 member 对 owner 的纸箱的访问权限，并更换纸箱的密钥：
+// 全部文件用新的密钥重新加密上传，其余成员获得新的密钥，旧的对象随后被删除。
+// 因此即使被撤销的成员保留了旧的密钥，也无法再解密纸箱里的文件。
+func (users *Users) RevokeBox(owner *DB, boxID, member string) error {
+	if !owner.IsReady() {
+		return errors.New("require login")
+	}
+	members, err := owner.BoxMembers(boxID)
+	if err != nil {
+		return err
+	}
+	found := false
+	publicKeys := make(map[string][]byte)
+	var others []model.BoxMember
+	for _, m := range members {
+		if m.User == member {
+			found = true
+			continue
+		}
+		if publicKeys[m.User], err = users.publicKey(m.User); err != nil {
+			return err
+		}
+		others = append(others, m)
+	}
+	if !found {
+		return fmt.Errorf("%s is not a member of the box", member)
+	}
+	shared := new(model.SharedBox)
+	if err := owner.DB.One("ID", boxID, shared); err != nil {
+		return err
+	}
+
+	// 生成新的密钥并重新加密上传全部对象 (在事务之外), 然后在事务中换成新的对象及密钥。
+	oldVersion := shared.KeyVersion
+	shared.KeyVersion++
+	owner.sealBoxKey(shared, aesgcm.RandomKey())
+	store, err := owner.boxStore(shared)
+	if err != nil {
+		return err
+	}
+	var objects []Object
+	err = owner.DB.Select(q.Eq("Box", boxID)).Find(&objects)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	renamed, err := owner.reencrypt(objects, store)
+	if err != nil {
+		return err
+	}
+	orphans, err := owner.saveRekeyedBox(shared, oldVersion, store, renamed, member, others, publicKeys)
+	if err != nil {
+		owner.discardUploads(renamed)
+		return err
+	}
+	owner.deleteOrphans(orphans)
+	return nil
+}
+
+func (db *DB) saveRekeyedBox(shared *model.SharedBox, oldVersion int, store *objectStore, renamed map[string]string, revoked string, others []model.BoxMember, publicKeys map[string][]byte) (orphans []string, err error) {
+	tx, err := db.DB.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current := new(model.SharedBox)
+	if err := tx.One("ID", shared.ID, current); err != nil {
+		return nil, err
+	}
+	if current.KeyVersion != oldVersion {
+		return nil, errBoxChanged
+	}
+	if err := tx.DeleteStruct(&model.BoxMember{ID: shared.ID + ":" + revoked}); err != nil {
+		return nil, err
+	}
+	if orphans, err = rekeyBox(tx, shared, renamed); err != nil {
+		return nil, err
+	}
+	for i := range others {
+		if err := sealForMember(tx, store, &others[i], publicKeys[others[i].User]); err != nil {
+			return nil, err
+		}
+	}
+	return orphans, tx.Commit()
+}
+
+// rekeyBox 令纸箱的全部对象换成 reencrypt 用新密钥上传的对象，并保存纸箱的新密钥，返回旧的对象名。
+// 如果有对象不在 renamed 里 (在上传期间被添加), 则返回 errBoxChanged.
+func rekeyBox(tx storm.Node, shared *model.SharedBox, renamed map[string]string) (orphans []string, err error) {
+	var objects []Object
+	err = tx.Select(q.Eq("Box", shared.ID)).Find(&objects)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	for i := range objects {
+		obj := objects[i]
+		newName, ok := renamed[obj.Name]
+		if !ok {
+			return nil, errBoxChanged
+		}
+		var recos []Reco
+		err = tx.Select(q.Eq("Object", obj.Name)).Find(&recos)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+		for _, reco := range recos {
+			if err := tx.UpdateField(&Reco{ID: reco.ID}, "Object", newName); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.DeleteStruct(&obj); err != nil {
+			return nil, err
+		}
+		// 旧的衍生图片随旧的对象一起删除，之后用新的密钥重新生成。
+		orphans = append(orphans, obj.Name)
+		obj.Name = newName
+		obj.Previews = nil
+		obj.PreviewVersion = ""
+		if err := tx.Save(&obj); err != nil {
+			return nil, err
+		}
+	}
+	return orphans, tx.Save(shared)
+}
+
+func (db *DB) deleteOrphans(names []string) {
+	for _, name := range names {
+		db.deleteOrphan(name)
+	}
+}
+
+// BoxMembers 返回纸箱的全部成员 (不包括主人)。
+func (db *DB) BoxMembers(boxID string) ([]model.BoxMember, error) {
+	var members []model.BoxMember
+	err := db.DB.Find("BoxID", boxID, &members)
+	if err == storm.ErrNotFound {
+		return []model.BoxMember{}, nil
+	}
+	return members, err
+}
+
+// SharedWith 返回其他用户分享给用户 name 的全部纸箱。
+func (users *Users) SharedWith(name string) ([]SharedBoxInfo, error) {
+	var all []model.User
+	if err := users.root.All(&all); err != nil {
+		return nil, err
+	}
+	infos := []SharedBoxInfo{}
+	for _, user := range all {
+		if user.Name == name {
+			continue
+		}
+		owner, err := users.Vault(user.Name)
+		if err != nil {
+			return nil, err
+		}
+		var members []model.BoxMember
+		err = owner.DB.Find("User", name, &members)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			box, err := owner.GetBoxByID(member.BoxID)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, SharedBoxInfo{
+				Owner: owner.Name,
+				BoxID: box.ID,
+				Title: box.Title,
+				Perm:  member.Perm,
+			})
+		}
+	}
+	return infos, nil
+}
+
+// OpenSharedBox 检查 member 是否为 owner 的纸箱 boxID 的成员，
+// 如果是，则用 member 的私钥解密纸箱的密钥，返回 BoxAccess, 否则返回 ErrNoAccess.
+func (users *Users) OpenSharedBox(member *DB, owner, boxID string) (*BoxAccess, error) {
+	ownerDB, err := users.Vault(owner)
+	if err != nil {
+		return nil, err
+	}
+	membership := new(model.BoxMember)
+	err = ownerDB.DB.One("ID", boxID+":"+member.Name, membership)
+	if err == storm.ErrNotFound {
+		return nil, ErrNoAccess
+	}
+	if err != nil {
+		return nil, err
+	}
+	shared := new(model.SharedBox)
+	if err := ownerDB.DB.One("ID", boxID, shared); err != nil {
+		return nil, err
+	}
+	privateKey, err := member.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := util.Base64Decode(membership.Key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealbox.Open(sealed, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	cos, err := ownerDB.sharedCOS()
+	if err != nil {
+		return nil, err
+	}
+	box, err := ownerDB.GetBoxByID(boxID)
+	if err != nil {
+		return nil, err
+	}
+	return &BoxAccess{
+		Owner:  ownerDB,
+		Box:    box,
+		Member: membership,
+		store: &objectStore{
+			box:     boxID,
+			key:     key,
+			nameKey: objectNameKey(key),
+			gcm:     aesgcm.NewGCM(key),
+			cos:     cos,
+			prefix:  boxObjectPrefix(ownerDB.prefix, shared),
+		},
+	}, nil
+}
+
+// Recos 返回纸箱里的全部 reco.
+func (access *BoxAccess) Recos() ([]*Reco, error) {
+	return access.Owner.getRecosByIDs(access.Box.RecoIDs)
+}
+
+// GetReco 返回纸箱里的一个 reco, 如果该 reco 不在纸箱里则返回 ErrNoAccess.
+func (access *BoxAccess) GetReco(id string) (*Reco, error) {
+	if !util.HasString(access.Box.RecoIDs, id) {
+		return nil, ErrNoAccess
+	}
+	return access.Owner.GetRecoByID(id)
+}
+
+// Download 下载、解密纸箱里的一个文件，返回文件内容。
+func (access *BoxAccess) Download(id string) ([]byte, error) {
+	reco, err := access.GetReco(id)
+	if err != nil {
+		return nil, err
+	}
+	return access.store.download(reco.Object)
+}
+
+// OpenObject 打开纸箱里的文件 id, 以便边下载边解密 (参考 ObjectReader)。
+// 用完后要记得 Close.
+func (access *BoxAccess) OpenObject(id string) (*ObjectReader, error) {
+	reco, err := access.GetReco(id)
+	if err != nil {
+		return nil, err
+	}
+	return access.store.open(reco.Object)
+}
+
+// DownloadDecrypt 下载、解密纸箱里的一个文件并写入 filePath.
+func (access *BoxAccess) DownloadDecrypt(id, filePath string) error {
+	content, err := access.Download(id)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, content, 0600)
+}
+
+// InsertReco 向纸箱添加一个文件 (需要 model.ReadWrite 权限)。
+// 成员添加的文件不带标签，以免改动主人的标签。
+func (access *BoxAccess) InsertReco(reco *Reco, objBody []byte) error {
+	if !access.Member.CanWrite() {
+		return ErrNoAccess
+	}
+	reco.Box = access.Box.ID
+	reco.Tags = nil
+
+	tx, err := access.Owner.DB.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := addObjectRef(tx, access.store, reco, objBody); err != nil {
+		return err
+	}
+	if err := tx.Save(reco); err != nil {
+		return err
+	}
+	box := new(Box)
+	if err := tx.One("ID", access.Box.ID, box); err != nil {
+		return err
+	}
+	box.Add(reco.ID)
+	if err := tx.Save(box); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	access.Box = box
+	return nil
+}
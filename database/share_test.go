@@ -0,0 +1,457 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+// memCOS 是保存在内存中的云储存，用于测试。
+type memCOS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	failPut bool    // 为 true 时上传一律失败
+	ranges  []int64 // GetObjectRange 的 offset
+}
+
+func (cos *memCOS) PutObject(name string, body io.ReadSeeker) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	cos.mu.Lock()
+	defer cos.mu.Unlock()
+	if cos.failPut {
+		return errors.New("upload failed")
+	}
+	cos.objects[name] = data
+	return nil
+}
+
+func (cos *memCOS) GetObjectBody(name string) (io.ReadCloser, error) {
+	cos.mu.Lock()
+	defer cos.mu.Unlock()
+	data, ok := cos.objects[name]
+	if !ok {
+		return nil, errors.New("no such object: " + name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (cos *memCOS) GetObjectRange(name string, offset, length int64) (io.ReadCloser, error) {
+	cos.mu.Lock()
+	defer cos.mu.Unlock()
+	data, ok := cos.objects[name]
+	if !ok {
+		return nil, errors.New("no such object: " + name)
+	}
+	if offset >= int64(len(data)) {
+		return nil, errors.New("invalid range")
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	cos.ranges = append(cos.ranges, offset)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (cos *memCOS) DeleteObject(name string) error {
+	cos.mu.Lock()
+	defer cos.mu.Unlock()
+	delete(cos.objects, name)
+	return nil
+}
+
+func (cos *memCOS) TryUploadDelete() error { return nil }
+
+func (cos *memCOS) has(prefix string) bool {
+	cos.mu.Lock()
+	defer cos.mu.Unlock()
+	for name := range cos.objects {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type memSettings struct{ cos *memCOS }
+
+func (settings memSettings) GetProvider() cloud.Provider { return "memory" }
+func (settings memSettings) Encode() []byte              { return []byte(`{"Provider":"memory"}`) }
+func (settings memSettings) NewCOS() cloud.ObjectStorage { return settings.cos }
+
+// loginTestUser 创建并登入用户 name, 全部用户共用同一个 memCOS.
+func loginTestUser(t *testing.T, users *Users, cos *memCOS, name string) *DB {
+	if _, err := users.Create(name, name+"-pwd", false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := users.Vault(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Login(name + "-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.setupCloud(cos, memSettings{cos}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.EnsureKeyPair(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func tempPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "recoit-share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "file")
+}
+
+func downloadString(t *testing.T, download func(path string) error) string {
+	path := tempPath(t)
+	if err := download(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestShareBox(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	bob := loginTestUser(t, users, cos, "bob")
+	carol := loginTestUser(t, users, cos, "carol")
+	dave := loginTestUser(t, users, cos, "dave")
+
+	reco, _ := model.NewFile("report.txt")
+	reco.Checksum = "c1"
+	if err := alice.InsertReco(reco, []byte("report")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ChangeBox("", "team", reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	box, err := alice.getBoxByTitle("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ShareBox(alice, box.ID, "bob", model.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ShareBox(alice, box.ID, "carol", model.ReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if cos.has(alice.objectNameForTest("c1")) {
+		t.Error("the object encrypted with the master key should be deleted")
+	}
+	// 成员只得到纸箱的密钥，主人的云储存设置只由服务器保存。
+	sharedSettings, err := ioutil.ReadFile(alice.sharedPath)
+	if err != nil || strings.Contains(string(sharedSettings), "Provider") {
+		t.Errorf("the settings should be kept encrypted by the server: %v", err)
+	}
+	shared, err := users.SharedWith("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shared) != 1 || shared[0].Title != "team" || shared[0].Perm != model.ReadOnly {
+		t.Errorf("bob's shared boxes: %+v", shared)
+	}
+
+	// 主人锁定后，成员仍可读取。
+	alice.Lock()
+	bobAccess, err := users.OpenSharedBox(bob, "alice", box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := downloadString(t, func(path string) error {
+		return bobAccess.DownloadDecrypt(reco.ID, path)
+	})
+	if got != "report" {
+		t.Errorf("bob downloaded %q", got)
+	}
+	if err := bobAccess.InsertReco(&Reco{ID: "x"}, []byte("x")); err != ErrNoAccess {
+		t.Errorf("a read-only member should not add files, got %v", err)
+	}
+	if _, err := users.OpenSharedBox(dave, "alice", box.ID); err != ErrNoAccess {
+		t.Errorf("dave is not a member, got %v", err)
+	}
+
+	carolAccess, err := users.OpenSharedBox(carol, "alice", box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note, _ := model.NewFile("note.txt")
+	note.Checksum = "c2"
+	if err := carolAccess.InsertReco(note, []byte("note")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 撤销 bob 后更换密钥，bob 之前打开的纸箱也不能再下载。
+	if err := alice.Login("alice-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.LoadSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.RevokeBox(alice, box.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.OpenSharedBox(bob, "alice", box.ID); err != ErrNoAccess {
+		t.Errorf("bob has been revoked, got %v", err)
+	}
+	if err := bobAccess.DownloadDecrypt(reco.ID, tempPath(t)); err == nil {
+		t.Error("the old box key should not work after revoking")
+	}
+	carolAccess, err = users.OpenSharedBox(carol, "alice", box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = downloadString(t, func(path string) error {
+		return carolAccess.DownloadDecrypt(note.ID, path)
+	})
+	if got != "note" {
+		t.Errorf("carol downloaded %q", got)
+	}
+
+	// 移出共享纸箱后，改回用 masterKey 加密。
+	if err := alice.ChangeBox("", "private", reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !cos.has(alice.objectNameForTest("c1")) {
+		t.Error("the object should be encrypted with the master key again")
+	}
+	got = downloadString(t, func(path string) error {
+		reco, err := alice.GetRecoByID(reco.ID)
+		if err != nil {
+			return err
+		}
+		return alice.DownloadDecrypt(reco.Object, path)
+	})
+	if got != "report" {
+		t.Errorf("alice downloaded %q", got)
+	}
+}
+
+func (db *DB) objectNameForTest(checksum string) string {
+	return db.masterStore().name(checksum)
+}
+
+// 重新加密上传失败时，纸箱保持未分享，原来的对象仍然可用。
+func TestShareBoxUploadFails(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	loginTestUser(t, users, cos, "bob")
+	reco, _ := model.NewFile("report.txt")
+	reco.Checksum = "c1"
+	if err := alice.InsertReco(reco, []byte("report")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ChangeBox("", "team", reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	box, err := alice.getBoxByTitle("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cos.failPut = true
+	if err := users.ShareBox(alice, box.ID, "bob", model.ReadOnly); err == nil {
+		t.Fatal("sharing should fail when the upload fails")
+	}
+	cos.failPut = false
+	if err := alice.DB.One("ID", box.ID, new(model.SharedBox)); err != storm.ErrNotFound {
+		t.Errorf("the box should not be shared, got %v", err)
+	}
+	if !cos.has(alice.objectNameForTest("c1")) || cos.has(alice.prefix+"boxes/") {
+		t.Error("the original object should be kept and nothing else uploaded")
+	}
+	if err := users.ShareBox(alice, box.ID, "bob", model.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+
+	// 放进共享纸箱时上传失败，文件保持原状。
+	note, _ := model.NewFile("note.txt")
+	note.Checksum = "c2"
+	if err := alice.InsertReco(note, []byte("note")); err != nil {
+		t.Fatal(err)
+	}
+	cos.failPut = true
+	if err := alice.ChangeBox(box.ID, "", note.ID); err == nil {
+		t.Fatal("moving into the shared box should fail when the upload fails")
+	}
+	cos.failPut = false
+	got, err := alice.GetRecoByID(note.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Box != "" || got.Object != alice.objectNameForTest("c2") {
+		t.Errorf("the file should be unchanged, got box %q, object %q", got.Box, got.Object)
+	}
+	if err := alice.ChangeBox(box.ID, "", note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if cos.has(alice.objectNameForTest("c2")) {
+		t.Error("the old object should be deleted after moving")
+	}
+}
+
+// 成员可以为共享纸箱里的文件生成衍生图片，更换密钥后旧的衍生图片作废。
+func TestSharedBoxPreview(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	bob := loginTestUser(t, users, cos, "bob")
+	loginTestUser(t, users, cos, "carol")
+	photo, _ := model.NewFile("photo.png")
+	photo.Checksum = "p1"
+	private, _ := model.NewFile("private.png")
+	private.Checksum = "p2"
+	for _, reco := range []*Reco{photo, private} {
+		if err := alice.InsertReco(reco, []byte(reco.FileName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.ChangeBox("", "team", photo.ID); err != nil {
+		t.Fatal(err)
+	}
+	box, err := alice.getBoxByTitle("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []string{"bob", "carol"} {
+		if err := users.ShareBox(alice, box.ID, member, model.ReadOnly); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice.Lock()
+	access, err := users.OpenSharedBox(bob, "alice", box.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reco, err := access.GetReco(photo.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := access.UploadPreview(reco.Object, PreviewThumb, "v1", []byte("thumb")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := access.DownloadPreview(reco.Object, PreviewThumb, "v1")
+	if err != nil || string(got) != "thumb" {
+		t.Errorf("DownloadPreview() = %q, %v", got, err)
+	}
+	privateReco, _ := alice.GetRecoByID(private.ID)
+	if _, err := access.DownloadPreview(privateReco.Object, PreviewThumb, "v1"); err != ErrNoAccess {
+		t.Errorf("files outside the box should not be accessible, got %v", err)
+	}
+
+	if err := alice.Login("alice-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.LoadSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.RevokeBox(alice, box.ID, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	reco, _ = alice.GetRecoByID(photo.ID)
+	if _, err := alice.DownloadPreview(reco.Object, PreviewThumb, "v1"); err != ErrNoPreview {
+		t.Errorf("the old preview is deleted with the old object, got %v", err)
+	}
+}
+
+// 没有服务器密钥时，主人锁定后成员不能打开共享纸箱；旧版本保存在数据库里的服务器密钥在升级时被删除。
+func TestNoServerKey(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	users.serverGCM = nil
+	alice := loginTestUser(t, users, cos, "alice")
+	bob := loginTestUser(t, users, cos, "bob")
+	reco, _ := model.NewFile("report.txt")
+	reco.Checksum = "c1"
+	if err := alice.InsertReco(reco, []byte("report")); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ChangeBox("", "team", reco.ID); err != nil {
+		t.Fatal(err)
+	}
+	box, err := alice.getBoxByTitle("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.ShareBox(alice, box.ID, "bob", model.ReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	if util.PathIsExist(alice.sharedPath) {
+		t.Error("the settings should not be kept without a server key")
+	}
+	if _, err := users.OpenSharedBox(bob, "alice", box.ID); err != nil {
+		t.Fatalf("bob should open the box while alice is logged in: %v", err)
+	}
+	alice.Lock()
+	if _, err := users.OpenSharedBox(bob, "alice", box.ID); err == nil {
+		t.Error("bob should not open the box while alice is logged out")
+	}
+
+	if err := users.root.Set(metaBucket, serverKeyName, aesgcm.RandomKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(alice.sharedPath, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.root.Set(metaBucket, schemaKey, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var key []byte
+	if err := users.root.Get(metaBucket, serverKeyName, &key); err != storm.ErrNotFound {
+		t.Errorf("the stored server key should be deleted, got %v", err)
+	}
+	if util.PathIsExist(alice.sharedPath) {
+		t.Error("the settings encrypted with the stored server key should be deleted")
+	}
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/ahui2016/recoit/aesgcm"
+)
+
+// ObjectReader 边下载边解密一个对象，实现了 io.ReadSeeker, 可用于 http.ServeContent.
+// Seek 之后从所在的块开始下载 (参考 aesgcm.ChunkStart), 因此拖动视频进度条时
+// 不需要下载前面的内容，也不需要把整个对象读进内存。
+// 旧版本上传的对象不是分块加密的，只能完整下载后解密。
+type ObjectReader struct {
+	store  *objectStore
+	name   string
+	header []byte // 分块密文的 header, 旧对象为 nil
+	size   int64
+	pos    int64 // Seek 设置的位置
+	body   io.ReadCloser
+	r      io.Reader // 解密后的内容
+	rpos   int64     // r 已读取到的位置
+
+	plaintext *bytes.Reader // 旧对象解密后的内容
+}
+
+// open 打开对象 objName (参考 ObjectReader)。
+// 只下载 header 及第一块，以便验证密钥并得知对象的长度，之后才按需要下载。
+func (store *objectStore) open(objName string) (*ObjectReader, error) {
+	obj := &ObjectReader{store: store, name: objName}
+	body, err := store.cos.GetObjectRange(objName, 0, aesgcm.ChunkStart(1))
+	if err != nil {
+		return nil, err
+	}
+	cr, err := store.gcm.NewChunkReader(body)
+	body.Close()
+	if err == nil {
+		obj.header, obj.size = cr.Header(), cr.Size()
+		return obj, nil
+	}
+
+	// 旧对象，或碰巧以分块格式的标记开头的旧对象。
+	plaintext, err := store.download(objName)
+	if err != nil {
+		return nil, err
+	}
+	obj.plaintext, obj.size = bytes.NewReader(plaintext), int64(len(plaintext))
+	return obj, nil
+}
+
+// seekChunk 从 pos 所在的块开始下载。
+func (obj *ObjectReader) seekChunk() error {
+	obj.Close()
+	counter := obj.pos / aesgcm.ChunkSize
+	body, err := obj.store.cos.GetObjectRange(obj.name, aesgcm.ChunkStart(counter), -1)
+	if err != nil {
+		return err
+	}
+	cr, err := obj.store.gcm.NewChunkReaderAt(obj.header, body, counter)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	obj.body, obj.r, obj.rpos = body, cr, counter*aesgcm.ChunkSize
+	return nil
+}
+
+// Size 返回对象解密后的长度。
+func (obj *ObjectReader) Size() int64 {
+	return obj.size
+}
+
+// Read 实现 io.Reader.
+func (obj *ObjectReader) Read(p []byte) (int, error) {
+	if obj.pos >= obj.size {
+		return 0, io.EOF
+	}
+	if obj.plaintext != nil {
+		n, err := obj.plaintext.ReadAt(p, obj.pos)
+		obj.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+	// 往回或跳过一块以上时，重新从所在的块开始下载。
+	if obj.r == nil || obj.rpos > obj.pos || obj.pos-obj.rpos >= aesgcm.ChunkSize {
+		if err := obj.seekChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if obj.rpos < obj.pos {
+		n, err := io.CopyN(ioutil.Discard, obj.r, obj.pos-obj.rpos)
+		obj.rpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := obj.r.Read(p)
+	obj.pos += int64(n)
+	obj.rpos += int64(n)
+	return n, err
+}
+
+// Seek 实现 io.Seeker, 实际的下载在下一次 Read 时才进行。
+func (obj *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += obj.pos
+	case io.SeekEnd:
+		offset += obj.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	obj.pos = offset
+	return offset, nil
+}
+
+// Close 关闭下载连接。
+func (obj *ObjectReader) Close() error {
+	obj.r = nil
+	if obj.body == nil {
+		return nil
+	}
+	err := obj.body.Close()
+	obj.body = nil
+	return err
+}
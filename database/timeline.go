@@ -0,0 +1,45 @@
+package database
+
+import (
+	"sort"
+
+	"github.com/ahui2016/recoit/model"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// TimelineDay 是照片时间线上的一天 (参考 Timeline)。
+type TimelineDay struct {
+	Date  string // YYYY-MM-DD
+	Recos []*Reco
+}
+
+// Timeline 返回全部未删除的图片，按拍摄日期分组 (没有拍摄时间的按上传日期，参考 Reco.TimelineTime),
+// 最新的在前。
+func (db *DB) Timeline() ([]TimelineDay, error) {
+	var all []*Reco
+	err := db.DB.Select(q.Eq("DeletedAt", ""), q.Eq("Type", model.File)).Find(&all)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	var photos []*Reco
+	for _, reco := range all {
+		if reco.IsImage() {
+			photos = append(photos, reco)
+		}
+	}
+	sort.SliceStable(photos, func(i, j int) bool {
+		return photos[i].TimelineTime() > photos[j].TimelineTime()
+	})
+
+	var days []TimelineDay
+	for _, reco := range photos {
+		date := reco.TimelineDate()
+		if n := len(days); n > 0 && days[n-1].Date == date {
+			days[n-1].Recos = append(days[n-1].Recos, reco)
+			continue
+		}
+		days = append(days, TimelineDay{Date: date, Recos: []*Reco{reco}})
+	}
+	return days, nil
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestTimeline(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	cos := &memCOS{objects: make(map[string][]byte)}
+	oldNewCOS := newCOS
+	newCOS = func([]byte) cloud.ObjectStorage { return cos }
+	defer func() { newCOS = oldNewCOS }()
+
+	alice := loginTestUser(t, users, cos, "alice")
+	insert := func(name, createdAt, takenAt string) {
+		reco, _ := model.NewFile(name)
+		reco.Checksum = name
+		reco.CreatedAt = createdAt
+		if takenAt != "" {
+			reco.Photo = &model.Photo{TakenAt: takenAt}
+		}
+		if err := alice.InsertReco(reco, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 按拍摄日期分组，没有拍摄时间的按上传日期，非图片不在时间线上。
+	insert("old.jpg", "2021-03-01T10:00:00Z", "2019-07-01T08:00:00Z")
+	insert("same-day.png", "2019-07-01T09:00:00Z", "")
+	insert("new.jpg", "2021-03-01T11:00:00Z", "2020-01-01T08:00:00Z")
+	insert("notes.txt", "2021-03-02T10:00:00Z", "")
+
+	days, err := alice.Timeline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, day := range days {
+		var names []string
+		for _, reco := range day.Recos {
+			names = append(names, reco.FileName)
+		}
+		got = append(got, day.Date+":"+strings.Join(names, ","))
+	}
+	want := "2020-01-01:new.jpg|2019-07-01:same-day.png,old.jpg"
+	if strings.Join(got, "|") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, "|"), want)
+	}
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/util"
+	"github.com/asdine/storm/v3"
+)
+
+const (
+	// apiTokenSize 是 token 中随机部分的字节数 (编码前)。
+	apiTokenSize = 32
+
+	// tokenTouchInterval 是更新 APIToken.LastUsed 的最小间隔 (秒), 以免每次请求都写入数据库。
+	tokenTouchInterval = 60
+)
+
+// ErrInvalidToken 表示 API token 不存在或已被删除。
+var ErrInvalidToken = errors.New("invalid API token")
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenKey 由 token 派生用来加密 APIToken.Key 的密钥，与 hashAPIToken 的结果不同。
+func apiTokenKey(token string) []byte {
+	return aesgcm.Sha256("recoit-api-token-key:" + token)
+}
+
+// CreateAPIToken 新建一个权限为 scope 的 API token, 返回的 token 只在此时可以得到。
+// token 的格式为 "用户名.随机字符串", 以便找到保存它的 node.
+// masterKey 用由 token 派生的密钥加密后保存，因此 vault 未解锁时也能使用 (参考 Users.FromToken)。
+func (db *DB) CreateAPIToken(name, scope string) (token string, apiToken *model.APIToken, err error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errors.New("token name is empty")
+	}
+	if !model.IsValidScope(scope) {
+		return "", nil, errors.New("unknown scope: " + scope)
+	}
+	db.mu.RLock()
+	masterKey := db.masterKey
+	db.mu.RUnlock()
+	if masterKey == nil {
+		return "", nil, errors.New("require login")
+	}
+
+	b := make([]byte, apiTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token = db.Name + "." + base64.RawURLEncoding.EncodeToString(b)
+	apiToken = model.NewAPIToken(hashAPIToken(token), name, scope)
+	apiToken.Key = util.Base64Encode(aesgcm.NewGCM(apiTokenKey(token)).Encrypt(masterKey))
+	if err := db.DB.Save(apiToken); err != nil {
+		return "", nil, err
+	}
+	return token, apiToken, nil
+}
+
+// APITokens 返回全部 API token (不包括原始 token)。
+func (db *DB) APITokens() (tokens []model.APIToken, err error) {
+	err = db.DB.All(&tokens)
+	return
+}
+
+// DeleteAPIToken 删除一个 API token, 此后使用它的请求立即失效。
+func (db *DB) DeleteAPIToken(id string) error {
+	return db.DB.DeleteStruct(&model.APIToken{ID: id})
+}
+
+// deleteAPITokens 删除全部 API token, 用于重置账号或重设密码之后。
+func deleteAPITokens(tx storm.Node) error {
+	err := tx.Select().Delete(new(model.APIToken))
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// FromToken 返回 API token 所属用户的 vault 及该 token 的记录，
+// 必要时用 token 中的 masterKey 解锁 (与 ResumeSession 相同)。
+func (users *Users) FromToken(token string) (*DB, *model.APIToken, error) {
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return nil, nil, ErrInvalidToken
+	}
+	db, err := users.Vault(token[:i])
+	if err == ErrNoUser {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	apiToken := new(model.APIToken)
+	err = db.DB.One("ID", hashAPIToken(token), apiToken)
+	if err == storm.ErrNotFound {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if db.IsLocked() {
+		masterKey, err := decryptBase64(aesgcm.NewGCM(apiTokenKey(token)), apiToken.Key)
+		if err != nil {
+			return nil, nil, ErrInvalidToken
+		}
+		db.setMasterKey(masterKey)
+	}
+	if db.COS == nil {
+		if err := db.LoadSettings(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if now := time.Now().Unix(); now-apiToken.LastUsed >= tokenTouchInterval {
+		apiToken.LastUsed = now
+		if err := db.DB.UpdateField(apiToken, "LastUsed", now); err != nil {
+			log.Print(err)
+		}
+	}
+	return db, apiToken, nil
+}
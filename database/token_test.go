@@ -0,0 +1,63 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ahui2016/recoit/model"
+)
+
+func TestAPIToken(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+	if _, err := users.Create("alice", "alice-pwd", false); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := users.Vault("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alice.CreateAPIToken("script", model.ScopeUpload); err == nil {
+		t.Error("a locked vault should not create tokens")
+	}
+	if err := alice.Login("alice-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alice.CreateAPIToken("script", "root"); err == nil {
+		t.Error("unknown scope should be rejected")
+	}
+	token, apiToken, err := alice.CreateAPIToken("script", model.ScopeUpload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// vault 锁定后，token 可以重新解锁。
+	alice.Lock()
+	db, got, err := users.FromToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db != alice || db.IsLocked() {
+		t.Error("the token should unlock alice's vault")
+	}
+	if !got.Allows(model.ScopeRead) || !got.Allows(model.ScopeUpload) || got.Allows(model.ScopeAdmin) {
+		t.Errorf("wrong permissions for scope %q", got.Scope)
+	}
+	if got.LastUsed == 0 {
+		t.Error("LastUsed should be updated")
+	}
+
+	secret := token[strings.Index(token, "."):]
+	for _, bad := range []string{"", "alice", "bob" + secret, "alice.xxx"} {
+		if _, _, err := users.FromToken(bad); err != ErrInvalidToken {
+			t.Errorf("FromToken(%q): got %v", bad, err)
+		}
+	}
+
+	if err := alice.DeleteAPIToken(apiToken.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := users.FromToken(token); err != ErrInvalidToken {
+		t.Errorf("the token has been deleted, got %v", err)
+	}
+}
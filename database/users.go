@@ -0,0 +1,320 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/session"
+	"github.com/ahui2016/recoit/throttle"
+	"github.com/asdine/storm/v3"
+)
+
+const (
+	usersBucket = "users"
+
+	// legacyUser 是旧版本 (只有一个账号) 的账号升级后的用户名。
+	legacyUser = "admin"
+
+	// legacySettingsFileName 是旧版本的云储存设置文件名 (在数据库文件夹里)。
+	legacySettingsFileName = "settings.cloud"
+)
+
+// ErrNoUser 表示用户不存在。
+var ErrNoUser = errors.New("no such user")
+
+// 用户名会用作数据库 node 名、云储存对象名前缀及缓存文件夹名，因此只允许小写字母、数字、_ 及 -.
+var userNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Users 管理全部用户。每个用户有各自的 vault (DB): 各自的密码及 masterKey,
+// 数据库中各自的 node, 各自的云储存设置及云储存对象名前缀。
+// 数据库文件、session 及登入失败的记录则由全部用户共用。
+type Users struct {
+	mu     sync.Mutex
+	root   *storm.DB
+	dir    string         // 数据库文件夹
+	vaults map[string]*DB // key 是用户名
+	Sess   *session.Manager
+
+	// linkSecret 用来签名分享链接 (参考 CreateShareLink), 保存在数据库中。
+	linkSecret []byte
+
+	// serverGCM 用来加密分享了纸箱的用户的云储存设置 (参考 DB.shareSettings),
+	// 没有设置服务器密钥时为 nil (参考 LoadServerKey)。
+	serverGCM *aesgcm.AEAD
+}
+
+// Open .
+func (users *Users) Open(maxAge int, dbPath string) (err error) {
+	if users.root, err = storm.Open(dbPath); err != nil {
+		return err
+	}
+	users.dir = filepath.Dir(dbPath)
+	users.vaults = make(map[string]*DB)
+	users.Sess = session.NewManager(maxAge)
+	log.Print(dbPath)
+	if err := users.createIndexes(); err != nil {
+		return err
+	}
+	if err := users.migrate(); err != nil {
+		return err
+	}
+	return users.loadLinkSecret()
+}
+
+// Close .
+func (users *Users) Close() error {
+	users.Sess.Close()
+	return users.root.Close()
+}
+
+func (users *Users) createIndexes() error {
+	if err := users.root.Init(&model.User{}); err != nil {
+		return err
+	}
+	if err := users.root.Init(&session.Session{}); err != nil {
+		return err
+	}
+	if err := users.root.Init(&throttle.Record{}); err != nil {
+		return err
+	}
+	if err := users.root.Init(&model.LoginFailure{}); err != nil {
+		return err
+	}
+	if err := users.root.Init(&model.ShareLink{}); err != nil {
+		return err
+	}
+	return users.root.Init(&model.LinkAccess{})
+}
+
+func (users *Users) newVault(name string) *DB {
+	return &DB{
+		Name:         name,
+		dir:          users.dir,
+		settingsPath: filepath.Join(users.dir, "settings-"+name+".cloud"),
+		sharedPath:   filepath.Join(users.dir, "settings-"+name+".shared"),
+		serverGCM:    users.serverGCM,
+		prefix:       name + "/",
+		DB:           users.root.From(usersBucket, name),
+		Sess:         users.Sess,
+	}
+}
+
+// Vault 返回用户 name 的 vault, 用户不存在时返回 ErrNoUser.
+func (users *Users) Vault(name string) (*DB, error) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	if vault, ok := users.vaults[name]; ok {
+		return vault, nil
+	}
+	var user model.User
+	err := users.root.One("Name", name, &user)
+	if err == storm.ErrNotFound {
+		return nil, ErrNoUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	vault := users.newVault(name)
+	if err := vault.createIndexes(); err != nil {
+		return nil, err
+	}
+	users.vaults[name] = vault
+	return vault, nil
+}
+
+// HasUsers 判断是否已有任何用户。
+func (users *Users) HasUsers() bool {
+	n, err := users.root.Count(&model.User{})
+	if err != nil {
+		panic(err)
+	}
+	return n > 0
+}
+
+// Create 新建用户 (如果用户已被重置，则重新创建), 返回恢复码 (参考 DB.InsertFirstReco)。
+func (users *Users) Create(name, passphrase string, withRecoveryCode bool) (string, error) {
+	if !userNameRegexp.MatchString(name) {
+		return "", errors.New("user name should be 1-32 lowercase letters, digits, _ or -")
+	}
+	if passphrase == "" {
+		return "", errors.New("password is empty")
+	}
+	var user model.User
+	err := users.root.One("Name", name, &user)
+	if err != nil && err != storm.ErrNotFound {
+		return "", err
+	}
+	if err == storm.ErrNotFound {
+		user := model.NewUser(name)
+		user.Admin = !users.HasUsers()
+		if err := users.root.Save(user); err != nil {
+			return "", err
+		}
+	}
+	vault, err := users.Vault(name)
+	if err != nil {
+		return "", err
+	}
+	return vault.InsertFirstReco(passphrase, withRecoveryCode)
+}
+
+// IsAdmin 判断用户 name 是否管理员。
+func (users *Users) IsAdmin(name string) bool {
+	var user model.User
+	if err := users.root.One("Name", name, &user); err != nil {
+		return false
+	}
+	return user.Admin
+}
+
+// FromSession 返回请求的 session 所属用户的 vault, 必要时用 session 中的 masterKey 解锁。
+func (users *Users) FromSession(r *http.Request) (*DB, error) {
+	name, err := users.Sess.User(r)
+	if err != nil {
+		return nil, err
+	}
+	vault, err := users.Vault(name)
+	if err != nil {
+		return nil, err
+	}
+	return vault, vault.ResumeSession(r)
+}
+
+// AutoLock 对每个已打开的 vault 执行 DB.AutoLock.
+func (users *Users) AutoLock(idle time.Duration) {
+	users.mu.Lock()
+	vaults := make([]*DB, 0, len(users.vaults))
+	for _, vault := range users.vaults {
+		vaults = append(vaults, vault)
+	}
+	users.mu.Unlock()
+	for _, vault := range vaults {
+		vault.AutoLock(idle)
+	}
+}
+
+// migrate 检查数据库的版本，必要时更新数据结构。
+func (users *Users) migrate() error {
+	var version int
+	err := users.root.Get(metaBucket, schemaKey, &version)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if version >= schemaVersion {
+		return nil
+	}
+	if version < 1 {
+		legacy := &DB{DB: users.root}
+		if err := legacy.migrateObjects(); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		if err := users.migrateLegacyUser(); err != nil {
+			return err
+		}
+	}
+	if version < 3 {
+		if err := users.migrateAdmin(); err != nil {
+			return err
+		}
+	}
+	if version < 4 {
+		if err := users.deleteLegacyLinks(); err != nil {
+			return err
+		}
+	}
+	if version < 5 {
+		if err := users.deleteStoredServerKey(); err != nil {
+			return err
+		}
+	}
+	return users.root.Set(metaBucket, schemaKey, schemaVersion)
+}
+
+// migrateLegacyUser 把旧版本唯一的账号的数据移到用户 legacyUser 的 node 里。
+// 旧的云储存对象名没有前缀，但对象名保存在 Object 及 Reco 里，因此不需要改名。
+// (导入文件夹的进度不会被移动，再次导入时会因为内容相同而被视为重复。)
+func (users *Users) migrateLegacyUser() error {
+	err := users.root.One("ID", "1", new(Reco))
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := users.root.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dst := tx.From(usersBucket, legacyUser)
+	for _, all := range []interface{}{&[]Reco{}, &[]Tag{}, &[]Box{}, &[]Object{}, &[]model.WrappedKey{}} {
+		if err := moveAll(tx, dst, all); err != nil {
+			return err
+		}
+	}
+	if err := tx.Save(model.NewUser(legacyUser)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	oldSettings := filepath.Join(users.dir, legacySettingsFileName)
+	if _, err := os.Stat(oldSettings); err == nil {
+		newSettings := users.newVault(legacyUser).settingsPath
+		if err := os.Rename(oldSettings, newSettings); err != nil {
+			return err
+		}
+	}
+	log.Printf("the account is now the user %q", legacyUser)
+	return nil
+}
+
+// migrateAdmin 把最早创建的用户设为管理员 (旧版本没有管理员)。
+func (users *Users) migrateAdmin() error {
+	var all []model.User
+	if err := users.root.All(&all); err != nil {
+		return err
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	first := all[0]
+	for _, user := range all[1:] {
+		if user.CreatedAt < first.CreatedAt {
+			first = user
+		}
+	}
+	return users.root.UpdateField(&first, "Admin", true)
+}
+
+// moveAll 把 src 中的全部记录复制到 dst, 然后删除 src 中的记录。
+// all 是一个指向 slice 的指针，例如 &[]Reco{}.
+func moveAll(src, dst storm.Node, all interface{}) error {
+	if err := src.All(all); err != nil {
+		return err
+	}
+	items := reflect.ValueOf(all).Elem()
+	if items.Len() == 0 {
+		return nil
+	}
+	for i := 0; i < items.Len(); i++ {
+		if err := dst.Save(items.Index(i).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return src.Drop(reflect.New(items.Type().Elem()).Interface())
+}
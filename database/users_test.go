@@ -0,0 +1,109 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahui2016/recoit/model"
+	"github.com/asdine/storm/v3"
+)
+
+func TestUsersAreSeparate(t *testing.T) {
+	users, cleanup := openTestUsers(t)
+	defer cleanup()
+
+	if users.HasUsers() {
+		t.Fatal("should have no users")
+	}
+	if _, err := users.Create("Alice", "a", false); err == nil {
+		t.Error("should reject an invalid user name")
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := users.Create(name, name+"-pwd", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := users.Create("alice", "again", false); err == nil {
+		t.Error("should not create a user twice")
+	}
+	if !users.IsAdmin("alice") || users.IsAdmin("bob") {
+		t.Error("only the first user should be an admin")
+	}
+
+	alice, _ := users.Vault("alice")
+	bob, _ := users.Vault("bob")
+	if err := alice.Login("bob-pwd"); err == nil {
+		t.Error("alice should not login with bob's password")
+	}
+	if err := bob.Login("bob-pwd"); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.IsLocked() {
+		t.Error("alice's vault should stay locked")
+	}
+	if err := bob.DB.Save(model.NewTag("x", "id")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.GetTagByName("x"); err != storm.ErrNotFound {
+		t.Errorf("alice should not see bob's tags, got %v", err)
+	}
+	if _, err := users.Vault("carol"); err != ErrNoUser {
+		t.Errorf("Vault(carol) error = %v; want ErrNoUser", err)
+	}
+}
+
+func TestMigrateLegacyUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recoit-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "recoit.db")
+
+	// 旧版本：只有一个账号，数据保存在数据库的根部。
+	legacy := &DB{dir: dir}
+	firstReco, _ := legacy.newFirstReco("abc")
+	root, err := storm.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Save(firstReco); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Save(model.NewTag("x", "id")); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+	settings := filepath.Join(dir, legacySettingsFileName)
+	if err := ioutil.WriteFile(settings, []byte("settings"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	users := new(Users)
+	if err := users.Open(60, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	defer users.Close()
+
+	admin, err := users.Vault(legacyUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Login("abc"); err != nil {
+		t.Errorf("should login as %s: %v", legacyUser, err)
+	}
+	if _, err := admin.GetTagByName("x"); err != nil {
+		t.Errorf("the tag should be moved: %v", err)
+	}
+	if err := users.root.One("ID", "1", new(Reco)); err != storm.ErrNotFound {
+		t.Errorf("the legacy account should be moved, got %v", err)
+	}
+	if _, err := os.Stat(admin.settingsPath); err != nil {
+		t.Errorf("the settings file should be renamed: %v", err)
+	}
+	if !users.IsAdmin(legacyUser) {
+		t.Errorf("%s should be an admin", legacyUser)
+	}
+}
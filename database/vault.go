@@ -0,0 +1,92 @@
+package database
+
+import (
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
+)
+
+// 解锁后 masterKey 保存在内存中，全部 session 共用。
+// 退出登入只删除该设备的 session, 只有在以下情况才会锁定 (清除内存中的密钥):
+//   - 用户选择 "lock vault" (LockVault)
+//   - 已没有任何有效的 session
+//   - 闲置超过设定的时间 (AutoLock)
+
+func (db *DB) setMasterKey(masterKey []byte) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.masterKey = masterKey
+	db.GCM = aesgcm.NewGCM(masterKey)
+	db.localGCM = aesgcm.NewGCM(localKey(masterKey))
+	db.lastActive = time.Now()
+}
+
+// Lock 清除内存中的密钥，此后需要重新输入密码才能读写数据。
+func (db *DB) Lock() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.masterKey = nil
+	db.GCM = nil
+	db.localGCM = nil
+	db.COS = nil
+}
+
+// localKey 由 masterKey 派生用来加密本地文件的密钥，与 masterKey 不同，
+// 以免本地文件与云端数据使用同一个密钥。
+func localKey(masterKey []byte) []byte {
+	return aesgcm.Sha256("recoit-local-key:" + string(masterKey))
+}
+
+// LocalGCM 返回加密服务器上的本地文件 (临时文件、缓存文件及缩略图) 所用的 AEAD,
+// vault 已锁定时返回 nil. 因此只有解锁期间 (即持有有效的 session 时) 才能读取这些文件，
+// 服务器的硬盘被盗也不会泄露内容。
+func (db *DB) LocalGCM() *aesgcm.AEAD {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.localGCM
+}
+
+// LockVault 锁定并删除该用户的全部 session, 使该用户的全部设备都需要重新登入。
+func (db *DB) LockVault() {
+	db.Sess.DeleteUser(db.Name)
+	db.Lock()
+}
+
+// IsLocked .
+func (db *DB) IsLocked() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.GCM == nil
+}
+
+// IsReady .
+func (db *DB) IsReady() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.GCM != nil && db.COS != nil
+}
+
+// Touch 记录最近一次活动的时间，用于自动锁定。
+func (db *DB) Touch() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.lastActive = time.Now()
+}
+
+// AutoLock 如果该用户已没有任何有效的 session, 或者闲置超过 idle, 就锁定。
+// idle 为零表示不限闲置时间。应定期调用 (例如在清理过期 session 之后)。
+func (db *DB) AutoLock(idle time.Duration) {
+	if db.IsLocked() {
+		return
+	}
+	if db.Sess.CountUser(db.Name) == 0 {
+		db.Lock()
+		return
+	}
+	db.mu.RLock()
+	idleTooLong := idle > 0 && time.Since(db.lastActive) > idle
+	db.mu.RUnlock()
+	if idleTooLong {
+		db.LockVault()
+	}
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/recoit/session"
+)
+
+func TestAutoLock(t *testing.T) {
+	key := make([]byte, 32)
+
+	tests := []struct {
+		name       string
+		sessions   int
+		lastActive time.Duration // 距今多久
+		idle       time.Duration
+		locked     bool
+	}{
+		{"no session", 0, 0, 0, true},
+		{"active", 1, 0, time.Minute, false},
+		{"no idle limit", 1, time.Hour, 0, false},
+		{"idle too long", 2, time.Hour, time.Minute, true},
+	}
+	for _, tt := range tests {
+		db := &DB{Sess: session.NewManager(60)}
+		for i := 0; i < tt.sessions; i++ {
+			if err := db.Sess.Add(httptest.NewRecorder(), db.Name, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.setMasterKey(key)
+		db.lastActive = time.Now().Add(-tt.lastActive)
+
+		db.AutoLock(tt.idle)
+		if got := db.IsLocked(); got != tt.locked {
+			t.Errorf("%s: IsLocked() = %v, want %v", tt.name, got, tt.locked)
+		}
+		if tt.locked && tt.sessions > 0 && db.Sess.Count() != 0 {
+			t.Errorf("%s: sessions should be deleted after auto-lock", tt.name)
+		}
+	}
+}
+
+func TestLocalGCM(t *testing.T) {
+	db := &DB{}
+	if db.LocalGCM() != nil {
+		t.Fatal("a locked vault should not have a local key")
+	}
+	key := make([]byte, 32)
+	db.setMasterKey(key)
+	data := db.LocalGCM().Encrypt([]byte("cache"))
+	if _, err := db.GCM.Decrypt(data); err == nil {
+		t.Error("local files should not be encrypted with the master key")
+	}
+
+	// 重新解锁后仍能读取之前写入的本地文件。
+	db.Lock()
+	if db.LocalGCM() != nil {
+		t.Fatal("Lock should clear the local key")
+	}
+	db.setMasterKey(key)
+	if got, err := db.LocalGCM().Decrypt(data); err != nil || string(got) != "cache" {
+		t.Errorf("Decrypt() = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,303 @@
+package graphics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/recoit/model"
+)
+
+// EXIF 里用到的 tag.
+const (
+	tagMake            = 0x010F
+	tagModel           = 0x0110
+	tagDateTime        = 0x0132
+	tagExifIFD         = 0x8769
+	tagGPSIFD          = 0x8825
+	tagDateTimeOrig    = 0x9003
+	tagOffsetTimeOrig  = 0x9011
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+)
+
+// exifTimeLayout 是 EXIF 里的时间格式 (没有时区)。
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+var errBadExif = errors.New("bad EXIF data")
+
+// ReadPhoto 读取图片 img 的 EXIF (支持 JPEG, PNG 及 WebP) 中的拍摄时间、相机及 GPS 位置，
+// 没有 EXIF 或无法解析时返回 nil.
+func ReadPhoto(img []byte) *model.Photo {
+	data := findExif(img)
+	if data == nil {
+		return nil
+	}
+	photo, err := parseExif(data)
+	if err != nil {
+		return nil
+	}
+	return photo
+}
+
+// HasExif 判断图片 img 是否带有 EXIF.
+func HasExif(img []byte) bool {
+	return findExif(img) != nil
+}
+
+// findExif 返回图片中的 EXIF 数据 (TIFF 格式), 没有则返回 nil.
+func findExif(img []byte) []byte {
+	switch {
+	case bytes.HasPrefix(img, []byte("\xFF\xD8")):
+		return jpegExif(img)
+	case bytes.HasPrefix(img, []byte("\x89PNG\r\n\x1a\n")):
+		return pngExif(img)
+	case len(img) >= 12 && string(img[:4]) == "RIFF" && string(img[8:12]) == "WEBP":
+		return webpExif(img)
+	}
+	return nil
+}
+
+// jpegExif 在 JPEG 的 APP1 段里寻找 EXIF.
+func jpegExif(img []byte) []byte {
+	header := []byte("Exif\x00\x00")
+	for i := 2; i+4 <= len(img); {
+		if img[i] != 0xFF {
+			return nil
+		}
+		marker := img[i+1]
+		if marker == 0xD9 || marker == 0xDA { // 图片结束或开始图像数据
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(img[i+2:]))
+		end := i + 2 + size
+		if size < 2 || end > len(img) {
+			return nil
+		}
+		if segment := img[i+4 : end]; marker == 0xE1 && bytes.HasPrefix(segment, header) {
+			return segment[len(header):]
+		}
+		i = end
+	}
+	return nil
+}
+
+// pngExif 寻找 PNG 的 eXIf chunk.
+func pngExif(img []byte) []byte {
+	for i := 8; i+8 <= len(img); {
+		size := int(binary.BigEndian.Uint32(img[i:]))
+		kind := string(img[i+4 : i+8])
+		end := i + 8 + size
+		if size < 0 || end+4 > len(img) {
+			return nil
+		}
+		if kind == "eXIf" {
+			return img[i+8 : end]
+		}
+		if kind == "IEND" {
+			return nil
+		}
+		i = end + 4 // crc
+	}
+	return nil
+}
+
+// webpExif 寻找 WebP 的 EXIF chunk.
+func webpExif(img []byte) []byte {
+	for i := 12; i+8 <= len(img); {
+		size := int(binary.LittleEndian.Uint32(img[i+4:]))
+		end := i + 8 + size
+		if size < 0 || end > len(img) {
+			return nil
+		}
+		if string(img[i:i+4]) == "EXIF" {
+			return bytes.TrimPrefix(img[i+8:end], []byte("Exif\x00\x00"))
+		}
+		i = end + size%2 // chunk 的长度补齐为偶数
+	}
+	return nil
+}
+
+// tiffEntry 是 IFD 里的一项。
+type tiffEntry struct {
+	kind  uint16
+	count uint32
+	value []byte
+}
+
+// tiffReader 读取 TIFF 格式的 EXIF 数据。
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// typeSizes 是 TIFF 各种数据类型的字节数。
+var typeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+// ifd 读取位于 offset 的 IFD.
+func (t *tiffReader) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+	data := t.data
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, errBadExif
+	}
+	n := uint32(t.order.Uint16(data[offset:]))
+	start := offset + 2
+	if uint64(start)+uint64(n)*12 > uint64(len(data)) {
+		return nil, errBadExif
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := uint32(0); i < n; i++ {
+		e := data[start+i*12 : start+i*12+12]
+		kind := t.order.Uint16(e[2:])
+		count := t.order.Uint32(e[4:])
+		size := uint64(typeSizes[kind]) * uint64(count)
+		if size == 0 {
+			continue
+		}
+		value := e[8:12]
+		if size > 4 {
+			valueOffset := uint64(t.order.Uint32(e[8:]))
+			if valueOffset+size > uint64(len(data)) {
+				continue
+			}
+			value = data[valueOffset : valueOffset+size]
+		}
+		entries[t.order.Uint16(e)] = tiffEntry{kind: kind, count: count, value: value[:size]}
+	}
+	return entries, nil
+}
+
+func (t *tiffReader) str(e tiffEntry) string {
+	if e.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+func (t *tiffReader) long(e tiffEntry) (uint32, bool) {
+	switch e.kind {
+	case 3:
+		return uint32(t.order.Uint16(e.value)), true
+	case 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+func (t *tiffReader) rationals(e tiffEntry) []float64 {
+	if e.kind != 5 {
+		return nil
+	}
+	var values []float64
+	for i := uint32(0); i < e.count; i++ {
+		num := t.order.Uint32(e.value[i*8:])
+		den := t.order.Uint32(e.value[i*8+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+// subIFD 读取 entries 里的 tag 所指向的 IFD, 没有则返回 nil.
+func (t *tiffReader) subIFD(entries map[uint16]tiffEntry, tag uint16) map[uint16]tiffEntry {
+	e, ok := entries[tag]
+	if !ok {
+		return nil
+	}
+	offset, ok := t.long(e)
+	if !ok {
+		return nil
+	}
+	sub, err := t.ifd(offset)
+	if err != nil {
+		return nil
+	}
+	return sub
+}
+
+// parseExif 解析 TIFF 格式的 EXIF 数据。
+func parseExif(data []byte) (*model.Photo, error) {
+	if len(data) < 8 {
+		return nil, errBadExif
+	}
+	t := &tiffReader{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return nil, errBadExif
+	}
+	ifd0, err := t.ifd(t.order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	photo := new(model.Photo)
+	maker, cameraModel := t.str(ifd0[tagMake]), t.str(ifd0[tagModel])
+	if strings.HasPrefix(cameraModel, maker) {
+		maker = "" // 有些相机的型号已包括制造商
+	}
+	photo.Camera = strings.TrimSpace(maker + " " + cameraModel)
+
+	taken := t.str(ifd0[tagDateTime])
+	offset := ""
+	if exif := t.subIFD(ifd0, tagExifIFD); exif != nil {
+		if s := t.str(exif[tagDateTimeOrig]); s != "" {
+			taken = s
+		}
+		offset = t.str(exif[tagOffsetTimeOrig])
+	}
+	photo.TakenAt = exifTime(taken, offset)
+
+	if gps := t.subIFD(ifd0, tagGPSIFD); gps != nil {
+		lat := degrees(t.rationals(gps[tagGPSLatitude]), t.str(gps[tagGPSLatitudeRef]), "S")
+		lon := degrees(t.rationals(gps[tagGPSLongitude]), t.str(gps[tagGPSLongitudeRef]), "W")
+		if !math.IsNaN(lat) && !math.IsNaN(lon) {
+			photo.HasGPS = true
+			photo.Latitude, photo.Longitude = lat, lon
+		}
+	}
+	if *photo == (model.Photo{}) {
+		return nil, errBadExif
+	}
+	return photo, nil
+}
+
+// exifTime 把 EXIF 的时间转换为 ISO8601 格式。
+// EXIF 的时间没有时区，除非另有 OffsetTimeOriginal, 否则当作服务器所在的时区。
+func exifTime(s, offset string) string {
+	loc := time.Local
+	if t, err := time.Parse("-07:00", offset); err == nil {
+		_, seconds := t.Zone()
+		loc = time.FixedZone(offset, seconds)
+	}
+	t, err := time.ParseInLocation(exifTimeLayout, s, loc)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// degrees 把 "度、分、秒" 转换为十进制的度数，ref 等于 negative 时为负数 (南纬或西经)。
+// 格式不对时返回 NaN.
+func degrees(dms []float64, ref, negative string) float64 {
+	if len(dms) != 3 {
+		return math.NaN()
+	}
+	d := dms[0] + dms[1]/60 + dms[2]/3600
+	if ref == negative {
+		d = -d
+	}
+	return d
+}
@@ -0,0 +1,139 @@
+package graphics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+type testEntry struct {
+	tag, kind uint16
+	count     uint32
+	data      []byte
+}
+
+func asciiEntry(tag uint16, s string) testEntry {
+	return testEntry{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func longEntry(tag uint16, v uint32) testEntry {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, v)
+	return testEntry{tag, 4, 1, data}
+}
+
+func rationalEntry(tag uint16, values ...uint32) testEntry {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[i*4:], v)
+	}
+	return testEntry{tag, 5, uint32(len(values) / 2), data}
+}
+
+// tiffBuilder 生成 little-endian 的 TIFF 数据，sub IFD 要先于 IFD0 写入。
+type tiffBuilder struct {
+	buf []byte
+}
+
+func (b *tiffBuilder) writeIFD(entries []testEntry) uint32 {
+	le := binary.LittleEndian
+	offset := uint32(len(b.buf))
+	dataOffset := offset + 2 + uint32(len(entries))*12 + 4
+	ifd := make([]byte, 2, dataOffset-offset)
+	le.PutUint16(ifd, uint16(len(entries)))
+	var data []byte
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		le.PutUint16(entry, e.tag)
+		le.PutUint16(entry[2:], e.kind)
+		le.PutUint32(entry[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(entry[8:], e.data)
+		} else {
+			le.PutUint32(entry[8:], dataOffset+uint32(len(data)))
+			data = append(data, e.data...)
+		}
+		ifd = append(ifd, entry...)
+	}
+	ifd = append(ifd, 0, 0, 0, 0) // 没有下一个 IFD
+	b.buf = append(append(b.buf, ifd...), data...)
+	return offset
+}
+
+// jpegWithExif 生成一个带有 EXIF (相机、拍摄时间及 GPS 位置) 的 JPEG.
+func jpegWithExif(t *testing.T) []byte {
+	b := &tiffBuilder{buf: []byte("II*\x00\x00\x00\x00\x00")}
+	exif := b.writeIFD([]testEntry{
+		asciiEntry(tagDateTimeOrig, "2021:05:06 07:08:09"),
+		asciiEntry(tagOffsetTimeOrig, "+08:00"),
+	})
+	gps := b.writeIFD([]testEntry{
+		asciiEntry(tagGPSLatitudeRef, "N"),
+		rationalEntry(tagGPSLatitude, 22, 1, 30, 1, 0, 1),
+		asciiEntry(tagGPSLongitudeRef, "W"),
+		rationalEntry(tagGPSLongitude, 114, 1, 10, 1, 30, 1),
+	})
+	ifd0 := b.writeIFD([]testEntry{
+		asciiEntry(tagMake, "Canon"),
+		asciiEntry(tagModel, "Canon EOS 5D"),
+		longEntry(tagExifIFD, exif),
+		longEntry(tagGPSIFD, gps),
+	})
+	binary.LittleEndian.PutUint32(b.buf[4:], ifd0)
+
+	img := new(bytes.Buffer)
+	if err := jpeg.Encode(img, image.NewGray(image.Rect(0, 0, 10, 10)), nil); err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte("Exif\x00\x00"), b.buf...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(payload)+2))
+	data := img.Bytes()
+	return append(append(append([]byte{}, data[:2]...), append(app1, payload...)...), data[2:]...)
+}
+
+func TestReadPhoto(t *testing.T) {
+	img := jpegWithExif(t)
+	photo := ReadPhoto(img)
+	if photo == nil {
+		t.Fatal("no EXIF found")
+	}
+	if photo.Camera != "Canon EOS 5D" {
+		t.Errorf("Camera = %q", photo.Camera)
+	}
+	if photo.TakenAt != "2021-05-06T07:08:09+08:00" {
+		t.Errorf("TakenAt = %q", photo.TakenAt)
+	}
+	if !photo.HasGPS || photo.Latitude != 22.5 || math.Abs(photo.Longitude+114.175) > 1e-9 {
+		t.Errorf("GPS = %v, %v, %v", photo.HasGPS, photo.Latitude, photo.Longitude)
+	}
+
+	plain := new(bytes.Buffer)
+	if err := jpeg.Encode(plain, image.NewGray(image.Rect(0, 0, 10, 10)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if ReadPhoto(plain.Bytes()) != nil || HasExif(plain.Bytes()) {
+		t.Error("the image has no EXIF")
+	}
+}
+
+func TestStripExif(t *testing.T) {
+	img := jpegWithExif(t)
+	kept, err := DisplayImage(img, 1024*1024, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(kept, img) {
+		t.Error("small images should be kept as is")
+	}
+	stripped, err := DisplayImage(img, 1024*1024, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HasExif(stripped) {
+		t.Error("EXIF should be removed from the display image")
+	}
+}
@@ -2,47 +2,87 @@ package graphics
 
 import (
 	"bytes"
+	"errors"
 	"image"
-	"image/jpeg"
+	"image/gif"
 	"math"
 
 	"github.com/disintegration/imaging"
 	"golang.org/x/image/webp"
 )
 
+// Rendition 是由原图生成的衍生图片的种类，其尺寸、格式等参数由 Profile 决定 (参考 Derive)。
+type Rendition int
+
+// 衍生图片的种类。
 const (
-	thumbSize = 128
-	quality   = 85
-	longLimit = 900
+	Display Rendition = iota // 用于在网页中显示
+	Thumb                    // 缩略图
 )
 
-// ResizeLimit resizes the image if it's long side bigger than limit.
-func ResizeLimit(img []byte) (*bytes.Buffer, error) {
+// browserFormats 是浏览器可以直接显示的图片格式 (image.DecodeConfig 返回的名称)。
+var browserFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+	"webp": true,
+}
+
+// Derive 按 rendition 当前的 Profile 由原图 img 生成一种衍生图片，返回编码后的内容。
+// 支持 JPEG, PNG, GIF, BMP, TIFF 及 WebP, 动图只取第一帧。
+// 格式为 FormatAuto 时，有透明部分的图片编码为 PNG 以保留透明度，其他图片编码为 JPEG.
+func Derive(img []byte, rendition Rendition) (*bytes.Buffer, error) {
+	p := ProfileOf(rendition)
+	if p.Size == 0 {
+		return nil, errors.New("unknown rendition")
+	}
 	src, err := ReadImage(img)
 	if err != nil {
 		return nil, err
 	}
-	w, h := limitWidthHeight(src.Bounds())
-	small := imaging.Resize(src, w, h, imaging.Lanczos)
-	return jpegEncode(small)
+	if p.Crop == CropCenter {
+		side := shortSide(src.Bounds())
+		src = imaging.CropCenter(src, side, side)
+		src = imaging.Resize(src, p.Size, 0, imaging.Lanczos)
+	} else {
+		w, h := limitWidthHeight(src.Bounds(), p.Size)
+		if w != src.Bounds().Dx() || h != src.Bounds().Dy() {
+			src = imaging.Resize(src, w, h, imaging.Lanczos)
+		}
+	}
+	return encode(src, p)
 }
 
-// Thumbnail create a thumbnail of imgFile.
-func Thumbnail(img []byte) (*bytes.Buffer, error) {
-	src, err := ReadImage(img)
+// DisplayImage 返回用于在网页中显示的图片。
+// 动图 (GIF), 以及体积不超过 smallSize 并且尺寸不超过限制的图片直接使用原图
+// (只限浏览器可以显示的格式，并且 Display 的格式为 FormatAuto)，其他图片用 Derive(img, Display) 生成。
+// stripExif 为 true 时，带有 EXIF 的图片一律重新编码 (生成的图片不含 EXIF)。
+func DisplayImage(img []byte, smallSize int64, stripExif bool) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+	if format == "gif" && IsAnimated(img) {
+		return img, nil
+	}
+	p := ProfileOf(Display)
+	fits := config.Width <= p.Size && config.Height <= p.Size
+	keepExif := !stripExif || !HasExif(img)
+	keep := p.Format == FormatAuto && browserFormats[format] && fits && keepExif
+	if keep && int64(len(img)) <= smallSize {
+		return img, nil
+	}
+	buf, err := Derive(img, Display)
 	if err != nil {
 		return nil, err
 	}
-	side := shortSide(src.Bounds())
-	src = imaging.CropCenter(src, side, side)
-	src = imaging.Resize(src, thumbSize, 0, imaging.Lanczos)
-	return jpegEncode(src)
+	return buf.Bytes(), nil
 }
 
-func jpegEncode(src image.Image) (*bytes.Buffer, error) {
-	buf := new(bytes.Buffer)
-	err := jpeg.Encode(buf, src, &jpeg.Options{Quality: quality})
-	return buf, err
+// IsAnimated 判断 img 是否多于一帧的 GIF 动图。
+func IsAnimated(img []byte) bool {
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	return err == nil && len(g.Image) > 1
 }
 
 // ReadImage .
@@ -65,9 +105,11 @@ func shortSide(bounds image.Rectangle) int {
 	return bounds.Dy()
 }
 
-func limitWidthHeight(bounds image.Rectangle) (limitWidth, limitHeight int) {
+// limitWidthHeight 返回长边不超过 limit 的尺寸 (保持比例，不会放大)。
+func limitWidthHeight(bounds image.Rectangle, limit int) (limitWidth, limitHeight int) {
 	w := float64(bounds.Dx())
 	h := float64(bounds.Dy())
+	longLimit := float64(limit)
 	// 先限制宽度
 	if w > longLimit {
 		h *= longLimit / w
@@ -0,0 +1,116 @@
+package graphics
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func pngImage(t *testing.T, w, h int, c color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func animatedGIF(t *testing.T) []byte {
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 20, 10), palette),
+			image.NewPaletted(image.Rect(0, 0, 20, 10), palette),
+		},
+		Delay: []int{10, 10},
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDerive(t *testing.T) {
+	tests := []struct {
+		name      string
+		img       []byte
+		rendition Rendition
+		mime      string
+		w, h      int
+	}{
+		{"opaque display", pngImage(t, 1800, 600, color.White), Display, "image/jpeg", 900, 300},
+		{"transparent display", pngImage(t, 1800, 600, color.Transparent), Display, "image/png", 900, 300},
+		{"opaque thumb", pngImage(t, 300, 200, color.White), Thumb, "image/jpeg", 128, 128},
+		{"gif first frame", animatedGIF(t), Thumb, "image/jpeg", 128, 128},
+	}
+	for _, tt := range tests {
+		buf, err := Derive(tt.img, tt.rendition)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := http.DetectContentType(buf.Bytes()); got != tt.mime {
+			t.Errorf("%s: type = %s, want %s", tt.name, got, tt.mime)
+		}
+		config, _, err := image.DecodeConfig(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != tt.w || config.Height != tt.h {
+			t.Errorf("%s: size = %dx%d, want %dx%d", tt.name, config.Width, config.Height, tt.w, tt.h)
+		}
+	}
+}
+
+func TestDisplayImage(t *testing.T) {
+	small := pngImage(t, 100, 100, color.White)
+	animated := animatedGIF(t)
+	for _, img := range [][]byte{small, animated} {
+		got, err := DisplayImage(img, 1024*1024, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, img) {
+			t.Error("small images and animations should be used as is")
+		}
+	}
+	got, err := DisplayImage(small, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, small) {
+		t.Error("images bigger than smallSize should be re-encoded")
+	}
+}
+
+func TestGeneratorFor(t *testing.T) {
+	pdf := func(content []byte) ([]byte, error) { return content, nil }
+	Register("application/x-test", pdf)
+	defer Register("application/x-test", nil)
+
+	if !CanPreview("image/webp") || !CanPreview("application/x-test") {
+		t.Error("images and registered types should have previews")
+	}
+	if GeneratorFor("application/x-other") != nil {
+		t.Error("unregistered types should not have previews")
+	}
+
+	// 生成器的结果与图片一样生成缩略图。
+	img := pngImage(t, 300, 200, color.White)
+	preview, err := Preview("application/x-test", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Derive(preview, Thumb); err != nil {
+		t.Error(err)
+	}
+}
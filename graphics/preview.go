@@ -0,0 +1,98 @@
+package graphics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolTimeout 是调用外部工具生成预览图的最长时间。
+const toolTimeout = 30 * time.Second
+
+// Generator 由一种文件的内容生成一张预览图 (ReadImage 能读取的格式),
+// 之后与图片一样用 Derive 生成显示用的图片及缩略图。
+type Generator func(content []byte) ([]byte, error)
+
+var (
+	generatorsMu sync.RWMutex
+	generators   = make(map[string]Generator) // key 是 Reco.FileType 或以 "/" 结尾的大类
+)
+
+// 默认支持全部图片，PDF 及视频则需要本机装有相应的工具 (pdftoppm 及 ffmpeg)。
+func init() {
+	Register("image/", func(content []byte) ([]byte, error) {
+		return content, nil
+	})
+	if path, err := exec.LookPath("pdftoppm"); err == nil {
+		Register("application/pdf", ToolGenerator(path, "-f", "1", "-l", "1", "-singlefile", "-png", "-"))
+	}
+	if path, err := exec.LookPath("ffmpeg"); err == nil {
+		Register("video/", ToolGenerator(path, "-loglevel", "error", "-i", "pipe:0",
+			"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "pipe:1"))
+	}
+}
+
+// Register 登记 fileType 的预览图生成器 (会替换已有的)，gen 为 nil 时取消登记。
+// fileType 以 "/" 结尾时适用于该大类的全部文件，例如 "video/".
+func Register(fileType string, gen Generator) {
+	generatorsMu.Lock()
+	defer generatorsMu.Unlock()
+	if gen == nil {
+		delete(generators, fileType)
+		return
+	}
+	generators[fileType] = gen
+}
+
+// GeneratorFor 返回 fileType 的预览图生成器，优先使用完全相同的，其次是大类的，没有则返回 nil.
+func GeneratorFor(fileType string) Generator {
+	generatorsMu.RLock()
+	defer generatorsMu.RUnlock()
+	if gen, ok := generators[fileType]; ok {
+		return gen
+	}
+	if i := strings.Index(fileType, "/"); i > 0 {
+		return generators[fileType[:i+1]]
+	}
+	return nil
+}
+
+// CanPreview 判断能否为 fileType 的文件生成预览图。
+func CanPreview(fileType string) bool {
+	return GeneratorFor(fileType) != nil
+}
+
+// Preview 用 fileType 的生成器由 content 生成预览图。
+func Preview(fileType string, content []byte) ([]byte, error) {
+	gen := GeneratorFor(fileType)
+	if gen == nil {
+		return nil, errors.New("no preview for " + fileType)
+	}
+	return gen(content)
+}
+
+// ToolGenerator 返回一个调用本地工具的生成器：文件内容从 stdin 传入，预览图从 stdout 读取，
+// 因此不需要把解密后的文件写入硬盘。(注意有些视频的索引在文件末尾，无法从 stdin 读取。)
+func ToolGenerator(path string, args ...string) Generator {
+	return func(content []byte) ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), toolTimeout)
+		defer cancel()
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, path, args...)
+		cmd.Stdin = bytes.NewReader(content)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%s: %v: %s", path, err, strings.TrimSpace(stderr.String()))
+		}
+		if stdout.Len() == 0 {
+			return nil, errors.New(path + ": no output")
+		}
+		return stdout.Bytes(), nil
+	}
+}
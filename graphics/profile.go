@@ -0,0 +1,189 @@
+package graphics
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 衍生图片的格式 (Profile.Format)。
+const (
+	FormatAuto = "auto" // 有透明部分则 PNG, 否则 JPEG
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatWebP = "webp" // 需要本机装有 cwebp
+)
+
+// 衍生图片的裁剪方式 (Profile.Crop)。
+const (
+	CropFit    = "fit"    // 保持比例，长边不超过 Size
+	CropCenter = "center" // 从中间裁剪为 Size 见方
+)
+
+// Profile 是一种衍生图片的参数 (参考 SetProfile)。
+type Profile struct {
+	Size    int    // 长边上限 (CropFit) 或边长 (CropCenter), 单位是像素
+	Format  string // FormatAuto, FormatJPEG, FormatPNG 或 FormatWebP
+	Quality int    // JPEG 及 WebP 的质量 (1-100)
+	Crop    string // CropFit 或 CropCenter
+}
+
+// DefaultProfiles 是默认的参数。
+var DefaultProfiles = map[Rendition]Profile{
+	Display: {Size: 900, Format: FormatAuto, Quality: 85, Crop: CropFit},
+	Thumb:   {Size: 128, Format: FormatAuto, Quality: 85, Crop: CropCenter},
+}
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[Rendition]Profile{
+		Display: DefaultProfiles[Display],
+		Thumb:   DefaultProfiles[Thumb],
+	}
+
+	// cwebpPath 是用来生成 WebP 的工具，没有安装时为空。
+	cwebpPath, _ = exec.LookPath("cwebp")
+)
+
+// Validate 检查参数是否有效。
+func (p Profile) Validate() error {
+	if p.Size <= 0 {
+		return errors.New("size must be positive")
+	}
+	if p.Quality < 1 || p.Quality > 100 {
+		return errors.New("quality must be 1-100")
+	}
+	switch p.Format {
+	case FormatAuto, FormatJPEG, FormatPNG:
+	case FormatWebP:
+		if cwebpPath == "" {
+			return errors.New("webp output requires cwebp")
+		}
+	default:
+		return errors.New("unknown format: " + p.Format)
+	}
+	if p.Crop != CropFit && p.Crop != CropCenter {
+		return errors.New("unknown crop mode: " + p.Crop)
+	}
+	return nil
+}
+
+// ParseProfile 在 base 的基础上解析 "size=256,format=webp,quality=80,crop=center" 形式的设置，
+// 没有提及的参数保持 base 的值，s 为空时直接返回 base.
+func ParseProfile(s string, base Profile) (Profile, error) {
+	p := base
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("%q should be key=value", item)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "size":
+			p.Size, err = strconv.Atoi(value)
+		case "quality":
+			p.Quality, err = strconv.Atoi(value)
+		case "format":
+			p.Format = value
+		case "crop":
+			p.Crop = value
+		default:
+			err = errors.New("unknown key")
+		}
+		if err != nil {
+			return p, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return p, p.Validate()
+}
+
+// SetProfile 设置一种衍生图片的参数，应在启动时调用。
+func SetProfile(r Rendition, p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles[r] = p
+	return nil
+}
+
+// ProfileOf 返回一种衍生图片当前的参数。
+func ProfileOf(r Rendition) Profile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	return profiles[r]
+}
+
+// ProfilesVersion 返回当前全部参数的指纹，参数改变时指纹随之改变，
+// 用来判断已生成的衍生图片是否过时。stripExif 与 DisplayImage 的同名参数相同。
+func ProfilesVersion(stripExif bool) string {
+	return profilesVersion(ProfileOf(Display), ProfileOf(Thumb), stripExif)
+}
+
+// DefaultProfilesVersion 返回默认参数的指纹 (旧版本生成的衍生图片使用默认参数)。
+func DefaultProfilesVersion() string {
+	return profilesVersion(DefaultProfiles[Display], DefaultProfiles[Thumb], false)
+}
+
+func profilesVersion(display, thumb Profile, stripExif bool) string {
+	s := fmt.Sprintf("%+v|%+v", display, thumb)
+	if stripExif {
+		s += "|strip-exif" // 不删除 EXIF 时保持原来的指纹，以免已有的衍生图片被当作过时。
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encode 按 p.Format 编码图片。
+func encode(src image.Image, p Profile) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	switch p.Format {
+	case FormatJPEG:
+		err := jpeg.Encode(buf, src, &jpeg.Options{Quality: p.Quality})
+		return buf, err
+	case FormatPNG:
+		err := png.Encode(buf, src)
+		return buf, err
+	case FormatWebP:
+		return webpEncode(src, p.Quality)
+	}
+	// FormatAuto
+	if opaque, ok := src.(interface{ Opaque() bool }); ok && !opaque.Opaque() {
+		err := png.Encode(buf, src)
+		return buf, err
+	}
+	err := jpeg.Encode(buf, src, &jpeg.Options{Quality: p.Quality})
+	return buf, err
+}
+
+// webpEncode 先编码为 PNG (无损), 再经 stdin/stdout 交给 cwebp 转换。
+func webpEncode(src image.Image, quality int) (*bytes.Buffer, error) {
+	if cwebpPath == "" {
+		return nil, errors.New("webp output requires cwebp")
+	}
+	pngData := new(bytes.Buffer)
+	if err := png.Encode(pngData, src); err != nil {
+		return nil, err
+	}
+	gen := ToolGenerator(cwebpPath, "-quiet", "-q", strconv.Itoa(quality), "-o", "-", "--", "-")
+	data, err := gen(pngData.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
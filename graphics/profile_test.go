@@ -0,0 +1,57 @@
+package graphics
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+func TestParseProfile(t *testing.T) {
+	base := DefaultProfiles[Thumb]
+	p, err := ParseProfile("size=256, format=png", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Size != 256 || p.Format != FormatPNG || p.Quality != base.Quality || p.Crop != base.Crop {
+		t.Errorf("got %+v", p)
+	}
+	for _, s := range []string{"size=0", "quality=101", "format=gif", "crop=zoom", "size", "color=red"} {
+		if _, err := ParseProfile(s, base); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	defer SetProfile(Thumb, DefaultProfiles[Thumb])
+	version := ProfilesVersion(false)
+	if version != DefaultProfilesVersion() {
+		t.Fatal("the default profiles should be used")
+	}
+
+	p := Profile{Size: 64, Format: FormatPNG, Quality: 50, Crop: CropFit}
+	if err := SetProfile(Thumb, p); err != nil {
+		t.Fatal(err)
+	}
+	if ProfilesVersion(false) == version {
+		t.Error("the version should change with the profiles")
+	}
+	if ProfilesVersion(true) == ProfilesVersion(false) {
+		t.Error("the version should change with strip-exif")
+	}
+	buf, err := Derive(pngImage(t, 300, 150, color.White), Thumb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := http.DetectContentType(buf.Bytes()); got != "image/png" {
+		t.Errorf("type = %s, want image/png", got)
+	}
+	config, _, err := image.DecodeConfig(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 64 || config.Height != 32 {
+		t.Errorf("size = %dx%d, want 64x32", config.Width, config.Height)
+	}
+}
@@ -2,11 +2,13 @@ package ibm
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/IBM/ibm-cos-sdk-go/aws"
@@ -133,6 +135,26 @@ func (cos *COS) GetObjectBody(name string) (io.ReadCloser, error) {
 	return output.Body, nil
 }
 
+// GetObjectRange 返回对象从 offset 开始的 length 个字节 (length < 0 表示直到结尾),
+// 要记得关闭资源.
+func (cos *COS) GetObjectRange(name string, offset, length int64) (io.ReadCloser, error) {
+	cos.makeSureConfig()
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	input := s3.GetObjectInput{
+		Bucket: aws.String(cos.bucketName),
+		Key:    aws.String(name),
+		Range:  aws.String(byteRange),
+	}
+	output, err := cos.client.GetObject(&input)
+	if err != nil {
+		return nil, err
+	}
+	return output.Body, nil
+}
+
 // DeleteObject 删除云端的一个对象。
 func (cos *COS) DeleteObject(name string) error {
 	cos.makeSureConfig()
@@ -1,55 +1,94 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ahui2016/goutil"
+	"github.com/ahui2016/recoit/cache"
+	"github.com/ahui2016/recoit/config"
 	"github.com/ahui2016/recoit/database"
 	"github.com/ahui2016/recoit/graphics"
 	"github.com/ahui2016/recoit/model"
+	"github.com/ahui2016/recoit/throttle"
+	"github.com/ahui2016/recoit/util"
 )
 
 const (
-	recoitDataFolderName = "recoit_data_folder"
-	databaseFolderName   = "RecoitDB"         // inside "recoit_data_folder"
+	databaseFolderName   = "RecoitDB"         // inside cfg.DataDir
 	databaseFileName     = "recoit.db"        // inside "RecoitDB"
-	cosSettingsFileName  = "settings.cloud"   // inside "RecoitDB"
-	cacheFolderName      = "RecoitCacheDir"   // inside "recoit_data_folder"
-	cacheThumbFolderName = "RecoitCacheThumb" // inside "recoit_data_folder"
-	tempFolderName       = "RecoitTempDir"    // inside "recoit_data_folder"
+	cacheFolderName      = "RecoitCacheDir"   // inside cfg.DataDir
+	cacheThumbFolderName = "RecoitCacheThumb" // inside cfg.DataDir
+	tempFolderName       = "RecoitTempDir"    // inside cfg.DataDir
+	tlsFolderName        = "RecoitTLS"        // inside cfg.DataDir
+	certFileName         = "cert.pem"         // inside "RecoitTLS"
+	keyFileName          = "key.pem"          // inside "RecoitTLS"
 	recoFileExt          = ".reco"
 	thumbFileExt         = ".small"
 	staticFolder         = "static"
-	passwordMaxTry       = 5
 
-	// 3 MB, for http.MaxBytesReader
-	maxBytes int64 = 1024 * 1024 * 3
+	// encryptedMarker 标记缓存文件夹里的本地文件已被加密 (参考 writeLocalFile)。
+	// 旧版本的本地文件是明文，没有这个标记的文件夹在启动时被清空。
+	encryptedMarker = ".encrypted"
 
-	// maxAge = 60 * 60 * 24 * 30
-	// 30 days, for session
-	maxAge = 60 * 30
+	// profilesMarker 记录生成缓存文件夹里的衍生图片时的参数的指纹 (参考 graphics.ProfilesVersion),
+	// 参数改变后，启动时删除过时的衍生图片，并在用户登入后重新生成 (参考 startRenditionJob)。
+	profilesMarker = ".profiles"
 
-	// 500KB, 当一个图片小于 smallImageSize, 它就是小图片，小图片不需要生成缩略图。
-	smallImageSize = 500 * 1024
+	// 每隔一段时间删除已过期的 session.
+	sessionCleanupInterval = time.Minute
+
+	// 登入失败后的等待时间，每次失败加倍。
+	loginBaseDelay = time.Second
+	loginMaxDelay  = time.Minute
+
+	// 全部 IP 合计连续输错密码的次数达到 PasswordMaxTry 的这个倍数时，锁定全部 IP.
+	globalMaxTryFactor = 10
+
+	// /api/login-failures 最多返回多少条记录。
+	loginFailuresLimit = 100
+
+	// 公开的分享链接的路径前缀，及其最长有效期 (小时)。
+	shareLinkPrefix   = "/s/"
+	maxShareLinkHours = 24 * 30
+
+	// 直接下载原文件的路径前缀 (参考 streamHandler)。
+	streamPrefix = "/api/stream/"
+
+	// /api/link-accesses 最多返回多少条记录。
+	linkAccessesLimit = 100
 )
 
 var (
-	recoitDataDir   string
-	dbPath          string
-	cosSettingsPath string
-	tempDir         string
-	cacheDir        string
-	cacheThumbDir   string
+	recoitDataDir string
+	dbPath        string
+	tempDir       string // 每个用户在里面有各自的文件夹，下同
+	cacheDir      string
+	cacheThumbDir string
 )
 
 var (
-	passwordTry = 0
-	HTML        = make(map[string]string)
-	db          = new(database.DB)
+	HTML  = make(map[string]string)
+	users = new(database.Users)
+
+	// loginLimiter 限制登入尝试的频率，在 setup 里设置。
+	loginLimiter *throttle.Limiter
+
+	// linkLimiter 限制输入分享链接密码的频率 (只保存在内存中), 在 setup 里设置。
+	linkLimiter *throttle.Limiter
+
+	// localFiles 管理解密后的本地文件 (临时文件、缓存文件及缩略图), 在 setup 里设置。
+	localFiles *cache.Manager
+
+	// cfg 包括监听地址、数据文件夹、上传大小限制等设置，在 setup 里设置。
+	cfg *config.Config
 )
 
 // Types from model.
@@ -60,32 +99,87 @@ type (
 )
 
 func init() {
-	recoitDataDir = filepath.Join(userHomeDir(), recoitDataFolderName)
+	fillHTML()
+}
+
+// setup 根据 c 设置各文件夹的路径，并打开数据库 (在 main 里关闭数据库)。
+func setup(c *config.Config) {
+	cfg = c
+	recoitDataDir = cfg.DataDir
 	dbDefaultDir := filepath.Join(recoitDataDir, databaseFolderName)
 	dbPath = filepath.Join(dbDefaultDir, databaseFileName)
-	cosSettingsPath = filepath.Join(dbDefaultDir, cosSettingsFileName)
 	tempDir = filepath.Join(recoitDataDir, tempFolderName)
 	cacheDir = filepath.Join(recoitDataDir, cacheFolderName)
 	cacheThumbDir = filepath.Join(recoitDataDir, cacheThumbFolderName)
 
-	fillHTML()
 	goutil.MustMkdir(dbDefaultDir)
 	goutil.MustMkdir(tempDir)
 	goutil.MustMkdir(cacheDir)
 	goutil.MustMkdir(cacheThumbDir)
 
 	// open the db here, close the db in main().
-	if err := db.Open(maxAge, dbPath, cosSettingsPath); err != nil {
+	if err := users.Open(cfg.MaxAge, dbPath); err != nil {
+		panic(err)
+	}
+	if cfg.ServerKeyFile != "" {
+		if err := users.LoadServerKey(cfg.ServerKeyFile); err != nil {
+			panic(err)
+		}
+	}
+	if err := removeLegacyLocalFiles(); err != nil {
+		panic(err)
+	}
+	if err := setupProfiles(); err != nil {
 		panic(err)
 	}
+	if err := setupLocalFiles(); err != nil {
+		panic(err)
+	}
+	if cfg.PersistSessions {
+		if err := users.PersistSessions(); err != nil {
+			panic(err)
+		}
+	}
+	throttleOpts := throttle.Options{
+		MaxTry:       cfg.PasswordMaxTry,
+		GlobalMaxTry: cfg.PasswordMaxTry * globalMaxTryFactor,
+		BaseDelay:    loginBaseDelay,
+		MaxDelay:     loginMaxDelay,
+		Lockout:      time.Duration(cfg.Lockout) * time.Second,
+	}
+	loginLimiter = throttle.New(throttleOpts)
+	if err := loginLimiter.SetStore(users.ThrottleStore()); err != nil {
+		panic(err)
+	}
+	// 分享链接不设全局锁定，否则任何人都可以用错误的密码令全部链接无法使用。
+	linkOpts := throttleOpts
+	linkOpts.GlobalMaxTry = 0
+	linkLimiter = throttle.New(linkOpts)
+	idle := time.Duration(cfg.AutoLock) * time.Second
+	users.Sess.StartCleanup(sessionCleanupInterval, func() {
+		users.AutoLock(idle)
+		if err := users.DeleteExpiredLinks(); err != nil {
+			log.Print(err)
+		}
+	})
 }
 
-func userHomeDir() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		panic(err)
+// setupProfiles 按设置修改衍生图片的参数 (参考 graphics.ParseProfile)。
+func setupProfiles() error {
+	settings := map[graphics.Rendition]string{
+		graphics.Display: cfg.DisplayProfile,
+		graphics.Thumb:   cfg.ThumbProfile,
+	}
+	for rendition, s := range settings {
+		p, err := graphics.ParseProfile(s, graphics.DefaultProfiles[rendition])
+		if err != nil {
+			return err
+		}
+		if err := graphics.SetProfile(rendition, p); err != nil {
+			return err
+		}
 	}
-	return homeDir
+	return nil
 }
 
 // fillHTML 把读取 html 文件的内容，塞进 HTML (map[string]string)。
@@ -107,49 +201,397 @@ func fillHTML() {
 	}
 }
 
-func tempFilePath(id string) string {
-	return filepath.Join(tempDir, addRecoExt(id))
+func tempFilePath(user, id string) string {
+	return filepath.Join(tempDir, user, addRecoExt(id))
 }
 
-func cacheFilePath(id string) string {
-	return filepath.Join(cacheDir, addRecoExt(id))
+func cacheFilePath(user, id string) string {
+	return filepath.Join(cacheDir, user, addRecoExt(id))
 }
 
-func cacheThumbPath(id string) string {
-	return filepath.Join(cacheThumbDir, id+thumbFileExt)
+func cacheThumbPath(user, id string) string {
+	return filepath.Join(cacheThumbDir, user, id+thumbFileExt)
 }
 
-// writeCacheFile 在服务器保留缓存文件，如果是图片则顺便生成缩略图，
-// 如果是图片并且不是 gif 动图，则压缩图片尺寸。
-// 被压缩的图片与未经处理的文件保存在不同的文件夹。
-func writeCacheFile(file *Reco, fileContents []byte) error {
-	tempPath := tempFilePath(file.ID)
-	cachePath := cacheFilePath(file.ID)
-	thumbPath := cacheThumbPath(file.ID)
+// makeUserDirs 新建用户 user 的临时文件、缓存文件及缩略图文件夹。
+func makeUserDirs(user string) error {
+	for _, dir := range []string{tempDir, cacheDir, cacheThumbDir} {
+		if err := os.MkdirAll(filepath.Join(dir, user), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// 当且只当是图片但不是 gif, 并且图片体积大于极限时，才压缩图片尺寸。
-	if file.FileSize > smallImageSize && file.IsImage() && file.IsNotGIF() {
-		buf, err := graphics.ResizeLimit(fileContents)
+// removeLegacyLocalFiles 删除旧版本 (只有一个账号) 直接放在 tempDir 等文件夹里的文件。
+// 这些文件不属于任何用户的文件夹，删除后需要时会重新下载。
+func removeLegacyLocalFiles() error {
+	for _, dir := range []string{tempDir, cacheDir, cacheThumbDir} {
+		files, err := ioutil.ReadDir(dir)
 		if err != nil {
 			return err
 		}
-		if err := goutil.CreateFile(cachePath, buf); err != nil {
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") { // 跳过 encryptedMarker 等标记
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setupLocalFiles 清空临时文件，并登记已有的缓存文件及缩略图 (参考 localFiles)。
+// 临时文件通常是未压缩的原文件，不需要保留到下次启动。
+func setupLocalFiles() error {
+	localFiles = cache.New(cfg.CacheSize)
+	if err := localFiles.Clear(tempDir); err != nil {
+		return err
+	}
+	marker := filepath.Join(cacheDir, profilesMarker)
+	version, err := ioutil.ReadFile(marker)
+	if os.IsNotExist(err) {
+		version, err = []byte(graphics.DefaultProfilesVersion()), nil // 旧版本使用默认参数
+	}
+	if err != nil {
+		return err
+	}
+	accessedAt := recoAccessedAt
+	if string(version) != graphics.ProfilesVersion(cfg.StripExif) {
+		accessedAt = markStaleRendition
+	}
+	for _, dir := range []string{cacheDir, cacheThumbDir} {
+		if err := removePlainLocalFiles(dir); err != nil {
 			return err
 		}
-	} else {
-		// 否则就直接写文件。
-		err := ioutil.WriteFile(tempPath, fileContents, 0600)
-		if err != nil {
+		if err := localFiles.Scan(dir, accessedAt); err != nil {
 			return err
 		}
 	}
+	return ioutil.WriteFile(marker, []byte(graphics.ProfilesVersion(cfg.StripExif)), 0600)
+}
+
+// markStaleRendition 用于 localFiles.Scan, 记下过时的衍生图片所属的 reco (参考 takeStaleRenditions),
+// 并一律返回 false 使 Scan 删除该文件。
+func markStaleRendition(user, id string) (string, bool) {
+	if _, ok := recoAccessedAt(user, id); ok {
+		renditionJobsMu.Lock()
+		defer renditionJobsMu.Unlock()
+		if !util.HasString(staleRenditions[user], id) {
+			staleRenditions[user] = append(staleRenditions[user], id)
+		}
+	}
+	return "", false
+}
+
+// removePlainLocalFiles 删除旧版本留下的未加密的本地文件 (只执行一次)，需要时会重新下载。
+func removePlainLocalFiles(dir string) error {
+	marker := filepath.Join(dir, encryptedMarker)
+	if goutil.PathIsExist(marker) {
+		return nil
+	}
+	if err := localFiles.Clear(dir); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(marker, nil, 0600)
+}
+
+// recoAccessedAt 返回用户 user 的 reco id 的访问时间，reco 不存在时 ok 为 false.
+// (Reco.AccessedAt 没有被加密，因此 vault 未解锁时也能读取。)
+func recoAccessedAt(user, id string) (accessedAt string, ok bool) {
+	db, err := users.Vault(user)
+	if err != nil {
+		return "", false
+	}
+	reco, err := db.GetRecoByID(id)
+	if err != nil {
+		return "", false
+	}
+	return reco.AccessedAt, true
+}
+
+// addLocalFile 把刚写入的本地文件交给 localFiles 管理，必要时删除最久未访问的文件。
+func addLocalFile(path, user, id string) error {
+	return localFiles.Add(path, user, id, goutil.TimeNow())
+}
+
+// writeLocalFile 用 db 的本地密钥 (参考 database.DB.LocalGCM) 加密 contents 后写入 path,
+// 并交给 localFiles 管理。服务器上的本地文件一律加密，只能通过 localFileServer 读取。
+func writeLocalFile(db *database.DB, path, id string, contents []byte) error {
+	gcm := db.LocalGCM()
+	if gcm == nil {
+		return errors.New("require login")
+	}
+	if err := ioutil.WriteFile(path, gcm.Encrypt(contents), 0600); err != nil {
+		return err
+	}
+	return addLocalFile(path, db.Name, id)
+}
+
+// readLocalFile 读取并解密 writeLocalFile 写入的文件。
+// 解密失败 (例如重设密码后 masterKey 已改变) 时删除该文件。
+func readLocalFile(db *database.DB, path string) ([]byte, error) {
+	gcm := db.LocalGCM()
+	if gcm == nil {
+		return nil, errors.New("require login")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := gcm.Decrypt(data)
+	if err != nil {
+		if err2 := localFiles.Remove(path); err2 != nil {
+			log.Print(err2)
+		}
+		return nil, err
+	}
+	return contents, nil
+}
+
+// readPhotoInfo 如果 reco 是图片，从 contents 的 EXIF 中读取拍摄时间、相机及 GPS 位置。
+// 应在设置 reco 的文件名及内容之后调用。
+func readPhotoInfo(reco *Reco, contents []byte) {
+	reco.Photo = nil
+	if reco.IsImage() {
+		reco.Photo = graphics.ReadPhoto(contents)
+	}
+}
 
-	// 如果是图片则一律生成缩略图
+// writeCacheFile 在服务器保留缓存文件：如果是图片则生成显示用的图片及缩略图
+// (参考 writeRenditions)，否则把原文件保存在临时文件夹，
+// 并且如果能生成预览图 (例如 PDF 及视频，参考 graphics.Register) 也生成其衍生图片。
+// 无法解码的图片 (例如 SVG, HEIC) 与其他文件一样保留原文件。
+func writeCacheFile(db *database.DB, file *Reco, fileContents []byte) error {
 	if file.IsImage() {
-		err := goutil.BytesToThumb(fileContents, thumbPath)
+		err := writeRenditions(db, db, file, fileContents)
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed to create the preview of %s: %v", file.ID, err)
+		return writeLocalFile(db, tempFilePath(db.Name, file.ID), file.ID, fileContents)
+	}
+	if err := writeLocalFile(db, tempFilePath(db.Name, file.ID), file.ID, fileContents); err != nil {
+		return err
+	}
+	if graphics.CanPreview(file.FileType) {
+		// 预览图只是辅助，生成失败不影响上传。
+		if err := writeRenditions(db, db, file, fileContents); err != nil {
+			log.Printf("failed to create the preview of %s: %v", file.ID, err)
+		}
+	}
+	return nil
+}
+
+// renditionPaths 返回图片 id 的各种衍生图片在本地的路径。
+func renditionPaths(user, id string) map[string]string {
+	return map[string]string{
+		database.PreviewDisplay: cacheFilePath(user, id),
+		database.PreviewThumb:   cacheThumbPath(user, id),
+	}
+}
+
+// previewStore 是上传、下载衍生图片的地方：当前用户自己的 vault (*database.DB),
+// 或其他用户分享给当前用户的纸箱 (*database.BoxAccess)。
+type previewStore interface {
+	UploadPreview(objName, kind, version string, content []byte) error
+	DownloadPreview(objName, kind, version string) ([]byte, error)
+}
+
+// writeRenditions 由原文件 content 的预览图 (图片则是原图本身) 生成显示用的图片及缩略图，
+// 分别保存在当前用户 (db) 的 cacheDir 及 cacheThumbDir,
+// 同时加密上传到 store (放在原对象旁边), 使其他设备或缓存被清空后不必再下载原图。
+// 上传失败只写入日志，下次需要时会重新生成。
+func writeRenditions(db *database.DB, store previewStore, reco *Reco, content []byte) error {
+	img, err := graphics.Preview(reco.FileType, content)
+	if err != nil {
+		return err
+	}
+	display, err := graphics.DisplayImage(img, cfg.SmallImageSize, cfg.StripExif)
+	if err != nil {
+		return err
+	}
+	thumb, err := graphics.Derive(img, graphics.Thumb)
+	if err != nil {
+		return err
+	}
+	version := graphics.ProfilesVersion(cfg.StripExif)
+	previews := map[string][]byte{
+		database.PreviewDisplay: display,
+		database.PreviewThumb:   thumb.Bytes(),
+	}
+	for kind, path := range renditionPaths(db.Name, reco.ID) {
+		if err := writeLocalFile(db, path, reco.ID, previews[kind]); err != nil {
+			return err
+		}
+		if err := store.UploadPreview(reco.Object, kind, version, previews[kind]); err != nil {
+			log.Printf("failed to upload the %s of %s: %v", kind, reco.ID, err)
+		}
+	}
+	return nil
+}
+
+// regenerateRenditions 恢复文件 id 的显示用的图片及缩略图 (例如已被 localFiles 删除)。
+// 优先从 COS 下载已上传的衍生图片，没有才用原文件重新生成
+// (原文件优先使用临时文件夹里的，没有才从 COS 下载)。
+// 不能生成预览图的文件返回 os.ErrNotExist.
+func regenerateRenditions(db *database.DB, id string) error {
+	reco, err := db.GetRecoByID(id)
+	if err != nil {
+		return err
+	}
+	return restoreRenditions(db, db, reco, func() ([]byte, error) {
+		return db.Download(reco.Object)
+	})
+}
+
+// regenerateRenditionsFor 与 regenerateRenditions 相同，但请求带有 owner 参数时，
+// 文件 id 在该用户分享给当前用户的纸箱 box-id 里 (参考 openSharedBox)。
+// 衍生图片保存在当前用户的缓存文件夹里，与下载共享纸箱里的文件一样。
+func regenerateRenditionsFor(r *http.Request, db *database.DB, id string) error {
+	access, err := openSharedBox(r, db)
+	if err != nil {
+		return err
+	}
+	if access == nil {
+		return regenerateRenditions(db, id)
+	}
+	reco, err := access.GetReco(id)
+	if err != nil {
+		return err
+	}
+	return restoreRenditions(db, access, reco, func() ([]byte, error) {
+		return access.Download(id)
+	})
+}
+
+// restoreRenditions 是 regenerateRenditions 的具体操作，download 用来下载原文件。
+func restoreRenditions(db *database.DB, store previewStore, reco *Reco, download func() ([]byte, error)) error {
+	if reco.Object == "" || !graphics.CanPreview(reco.FileType) {
+		return os.ErrNotExist
+	}
+	if fetchRenditions(db, store, reco) == nil {
+		return nil
+	}
+	content, err := readLocalFile(db, tempFilePath(db.Name, reco.ID))
+	if err != nil {
+		if content, err = download(); err != nil {
+			return err
+		}
+	}
+	return writeRenditions(db, store, reco, content)
+}
+
+// fetchRenditions 从 store 下载 reco 的全部衍生图片并保存到本地 (只限用当前的参数生成的)。
+func fetchRenditions(db *database.DB, store previewStore, reco *Reco) error {
+	version := graphics.ProfilesVersion(cfg.StripExif)
+	for kind, path := range renditionPaths(db.Name, reco.ID) {
+		preview, err := store.DownloadPreview(reco.Object, kind, version)
 		if err != nil {
 			return err
 		}
+		if err := writeLocalFile(db, path, reco.ID, preview); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenditionJob 是一个用户的重新生成衍生图片的任务的进度 (参考 startRenditionJob)。
+type RenditionJob struct {
+	Running bool
+	Total   int
+	Done    int
+	Failed  int
+}
+
+var (
+	renditionJobsMu sync.Mutex
+	renditionJobs   = make(map[string]*RenditionJob) // key 是用户名
+
+	// staleRenditions 是启动时因参数改变而被删除的衍生图片所属的 reco id, key 是用户名。
+	staleRenditions = make(map[string][]string)
+)
+
+// takeStaleRenditions 取出 (并清除) 用户 user 的过时的衍生图片所属的 reco id.
+func takeStaleRenditions(user string) []string {
+	renditionJobsMu.Lock()
+	defer renditionJobsMu.Unlock()
+	ids := staleRenditions[user]
+	delete(staleRenditions, user)
+	return ids
+}
+
+// renditionJobOf 返回用户 user 的最近一次任务的进度，没有则返回零值。
+func renditionJobOf(user string) RenditionJob {
+	renditionJobsMu.Lock()
+	defer renditionJobsMu.Unlock()
+	if job, ok := renditionJobs[user]; ok {
+		return *job
+	}
+	return RenditionJob{}
+}
+
+// startRenditionJob 在后台逐个重新生成 ids 的衍生图片，同一用户已有任务在运行时返回 false.
+// 需要 masterKey 解密，因此 vault 被锁定时中止任务 (未完成的等下次访问时再生成)。
+func startRenditionJob(db *database.DB, ids []string) bool {
+	renditionJobsMu.Lock()
+	defer renditionJobsMu.Unlock()
+	if job, ok := renditionJobs[db.Name]; ok && job.Running {
+		return false
+	}
+	job := &RenditionJob{Running: true, Total: len(ids)}
+	renditionJobs[db.Name] = job
+	go func() {
+		for _, id := range ids {
+			if db.IsLocked() {
+				break
+			}
+			err := regenerateRenditions(db, id)
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("regenerate renditions of %s: %v", id, err)
+			}
+			renditionJobsMu.Lock()
+			if err != nil && !os.IsNotExist(err) {
+				job.Failed++
+			} else {
+				job.Done++
+			}
+			renditionJobsMu.Unlock()
+		}
+		renditionJobsMu.Lock()
+		job.Running = false
+		renditionJobsMu.Unlock()
+	}()
+	return true
+}
+
+// clearLocalFiles 删除用户 user 的全部临时文件、缓存文件及缩略图。
+func clearLocalFiles(user string) error {
+	for _, dir := range []string{tempDir, cacheDir, cacheThumbDir} {
+		if err := localFiles.Clear(filepath.Join(dir, user)); err != nil {
+			return err
+		}
+	}
+	return makeUserDirs(user)
+}
+
+// clearTempFiles 删除用户 user 的全部临时文件 (在该用户的 vault 被锁定时)，
+// 缓存文件及缩略图则保留到超出 cfg.CacheSize 时才删除。
+func clearTempFiles(user string) {
+	if err := localFiles.Clear(filepath.Join(tempDir, user)); err != nil {
+		log.Print(err)
+	}
+}
+
+// removeLocalFiles 删除用户 user 的 reco id 的临时文件、缓存文件及缩略图。
+func removeLocalFiles(user, id string) error {
+	for _, path := range []string{tempFilePath(user, id), cacheFilePath(user, id), cacheThumbPath(user, id)} {
+		if err := localFiles.Remove(path); err != nil {
+			return err
+		}
 	}
 	return nil
 }
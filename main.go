@@ -3,85 +3,166 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ahui2016/goutil"
 	"github.com/ahui2016/recoit/cloud"
+	"github.com/ahui2016/recoit/config"
+	"github.com/ahui2016/recoit/database"
+	"github.com/ahui2016/recoit/graphics"
 	"github.com/ahui2016/recoit/ibm"
 	"github.com/ahui2016/recoit/model"
-	"github.com/ahui2016/recoit/util"
+	"github.com/ahui2016/recoit/tlscert"
 	"github.com/asdine/storm/v3"
 	"github.com/asdine/storm/v3/q"
 )
 
 func main() {
-	defer db.Close()
+	c, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	setup(c)
+	defer users.Close()
 
 	fs := http.FileServer(http.Dir("public"))
 	http.Handle("/public/", http.StripPrefix("/public/", fs))
 
-	tempFS := http.FileServer(http.Dir(tempDir))
-	tempFS = http.StripPrefix("/temp/", tempFS)
-	http.Handle("/temp/", checkLoginForFileServer(tempFS))
-
-	cacheFS := http.FileServer(http.Dir(cacheDir))
-	cacheFS = http.StripPrefix("/cache/", cacheFS)
-	http.Handle("/cache/", checkLoginForFileServer(cacheFS))
-
-	thumbFS := http.FileServer(http.Dir(cacheThumbDir))
-	thumbFS = http.StripPrefix("/thumb/", thumbFS)
-	http.Handle("/thumb/", checkLoginForFileServer(thumbFS))
+	http.HandleFunc("/temp/", localFileServer("/temp/", tempDir, nil))
+	http.HandleFunc("/cache/", localFileServer("/cache/", cacheDir, regenerateRenditionsFor))
+	http.HandleFunc("/thumb/", localFileServer("/thumb/", cacheThumbDir, regenerateRenditionsFor))
 
 	http.HandleFunc("/", homePage)
 	http.HandleFunc("/index", checkLogin(indexPage))
 	http.HandleFunc("/api/all-recos", checkLogin(getAllRecos))
+	http.HandleFunc("/api/timeline", checkLogin(timelineHandler))
 
 	http.HandleFunc("/tag", checkLogin(tagPage))
 	http.HandleFunc("/api/tag", checkLogin(getRecosByTag))
 
 	http.HandleFunc("/add-file", checkLogin(addFilePage))
 	http.HandleFunc("/api/upload-file", checkLogin(
-		setMaxBytes(uploadHandler)))
+		setMaxBytes(checkCSRFOrScope(model.ScopeUpload, uploadHandler))))
 	http.HandleFunc("/api/checksum", checkLogin(checksumHandler))
 
+	http.HandleFunc("/add-files", checkLogin(addFilesPage))
+	http.HandleFunc("/api/upload-files", checkLogin(
+		setMaxBatchBytes(checkCSRFOrScope(model.ScopeUpload, uploadFilesHandler))))
+
 	http.HandleFunc("/file", checkLogin(editFilePage))
 	http.HandleFunc("/api/update-file", checkLogin(
-		setMaxBytes(updateHandler)))
+		setMaxBytes(checkCSRF(updateHandler))))
 	http.HandleFunc("/api/reco", checkLogin(getRecoHandler))
-	http.HandleFunc("/api/delete-reco", checkLogin(deleteRecoHandler))
-	http.HandleFunc("/api/create-thumb", checkLogin(createThumbHandler))
-	http.HandleFunc("/api/download-file", checkLogin(downloadFile))
+	http.HandleFunc("/api/delete-reco", checkLogin(checkCSRF(deleteRecoHandler)))
+	http.HandleFunc("/api/purge-reco", checkLogin(checkCSRF(purgeRecoHandler)))
+	http.HandleFunc("/api/create-thumb", checkLogin(checkCSRFOrScope(model.ScopeRead, createThumbHandler)))
+	http.HandleFunc("/api/download-file", checkLogin(checkCSRFOrScope(model.ScopeRead, downloadFile)))
+	http.HandleFunc(streamPrefix, checkLogin(streamHandler))
+	http.HandleFunc("/api/export", checkLogin(checkCSRFOrScope(model.ScopeRead, exportHandler)))
+	http.HandleFunc("/api/cache-stats", checkLogin(cacheStatsHandler))
+	http.HandleFunc("/api/regenerate-renditions", checkLogin(checkCSRF(regenerateRenditionsHandler)))
+	http.HandleFunc("/api/regenerate-status", checkLogin(regenerateStatusHandler))
+	http.HandleFunc("/api/import-dir", checkLogin(checkCSRF(importDirHandler)))
 
 	http.HandleFunc("/change-box", checkLogin(changeBoxPage))
-	http.HandleFunc("/api/change-box", checkLogin(changeBox))
+	http.HandleFunc("/api/change-box", checkLogin(checkCSRF(changeBox)))
 	http.HandleFunc("/api/all-boxes", checkLogin(getAllBoxes))
 
 	http.HandleFunc("/box", checkLogin(boxPage))
 	http.HandleFunc("/api/get-box", checkLogin(getBoxHandler))
 	http.HandleFunc("/api/get-recos-by-box", checkLogin(getRecosByBox))
-	http.HandleFunc("/api/rename-box", checkLogin(renameBoxHandler))
+	http.HandleFunc("/api/rename-box", checkLogin(checkCSRF(renameBoxHandler)))
+	http.HandleFunc("/api/box-members", checkLogin(boxMembersHandler))
+	http.HandleFunc("/api/share-box", checkLogin(checkCSRF(shareBoxHandler)))
+	http.HandleFunc("/api/revoke-box", checkLogin(checkCSRF(revokeBoxHandler)))
+
+	http.HandleFunc("/shared-boxes", checkLogin(sharedBoxesPage))
+	http.HandleFunc("/api/shared-boxes", checkLogin(sharedBoxesHandler))
+	http.HandleFunc("/api/upload-to-shared-box", checkLogin(
+		setMaxBytes(checkCSRFOrScope(model.ScopeUpload, uploadToSharedBoxHandler))))
+
+	http.HandleFunc("/api/create-share-link", checkLogin(checkCSRF(createShareLinkHandler)))
+	http.HandleFunc("/api/share-links", checkLogin(shareLinksHandler))
+	http.HandleFunc("/api/delete-share-link", checkLogin(checkCSRF(deleteShareLinkHandler)))
+	http.HandleFunc("/api/link-accesses", checkLogin(linkAccessesHandler))
+	http.HandleFunc(shareLinkPrefix, shareLinkHandler)
+
+	http.HandleFunc("/settings", checkLogin(settingsPage))
+	http.HandleFunc("/api/api-tokens", checkLogin(sessionOnly(apiTokensHandler)))
+	http.HandleFunc("/api/create-api-token", checkLogin(sessionOnly(checkCSRF(createAPITokenHandler))))
+	http.HandleFunc("/api/delete-api-token", checkLogin(sessionOnly(checkCSRF(deleteAPITokenHandler))))
 
 	http.HandleFunc("/setup-cloud/ibm", setupIbmCosPage)
-	http.HandleFunc("/api/setup-ibm-cos", setupIbmCosHandler)
+	http.HandleFunc("/api/setup-ibm-cos", checkCSRF(setupIbmCosHandler))
 	http.HandleFunc("/api/check-cloud-settings", checkCloudSettings)
 
 	http.HandleFunc("/create-account", createAccountPage)
-	http.HandleFunc("/api/create-account", createAccountHandler)
+	http.HandleFunc("/api/create-account", requirePost(createAccountHandler))
 	http.HandleFunc("/api/is-account-exist", isAccountExist)
+	http.HandleFunc("/api/restore-account", requirePost(restoreAccountHandler))
+	http.HandleFunc("/recover-account", recoverAccountPage)
+	http.HandleFunc("/api/recover-account", requirePost(recoverAccountHandler))
+	http.HandleFunc("/api/new-recovery-code", checkLogin(checkCSRF(newRecoveryCodeHandler)))
+	http.HandleFunc("/reset-account", checkLogin(resetAccountPage))
+	http.HandleFunc("/api/reset-account", checkLogin(checkCSRF(resetAccountHandler)))
 
 	http.HandleFunc("/login", loginPage)
 	http.HandleFunc("/logout", logoutHandler)
-	http.HandleFunc("/api/login", loginHandler)
+	http.HandleFunc("/api/lock-vault", checkLogin(checkCSRF(lockVaultHandler)))
+	http.HandleFunc("/api/login-failures", checkLogin(loginFailuresHandler))
+	http.HandleFunc("/api/login", requirePost(loginHandler))
 	http.HandleFunc("/api/check-login", checkLoginHandler)
 	http.HandleFunc("/api/check-cos", checkCOS)
 
-	http.HandleFunc("/danger/delete-first-reco", deleteFirstReco)
+	fmt.Println(cfg.Addr)
+	log.Fatal(serve())
+}
+
+// serve 根据设置以 HTTP 或 HTTPS 启动服务器。
+// 启用 HTTPS 但没有提供证书时，使用 (必要时生成) 保存在数据文件夹里的自签名证书。
+func serve() error {
+	if !cfg.TLS {
+		return http.ListenAndServe(cfg.Addr, nil)
+	}
+	certFile, keyFile := cfg.CertFile, cfg.KeyFile
+	if certFile == "" {
+		certFile = filepath.Join(recoitDataDir, tlsFolderName, certFileName)
+		keyFile = filepath.Join(recoitDataDir, tlsFolderName, keyFileName)
+		if err := tlscert.EnsureSelfSigned(certFile, keyFile, tlsHosts()); err != nil {
+			return err
+		}
+	}
+	users.Sess.SetSecure(true)
+
+	if cfg.RedirectAddr != "" {
+		go func() {
+			redirect := http.HandlerFunc(redirectToHTTPS)
+			log.Fatal(http.ListenAndServe(cfg.RedirectAddr, redirect))
+		}()
+	}
+	return http.ListenAndServeTLS(cfg.Addr, certFile, keyFile, withHSTS(http.DefaultServeMux))
+}
 
-	addr := "127.0.0.1:80"
-	fmt.Println(addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+// tlsHosts 返回自签名证书适用的主机名。
+func tlsHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1"}
+	if host, _, err := net.SplitHostPort(cfg.Addr); err == nil && host != "" {
+		hosts = append(hosts, host)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
@@ -104,10 +185,18 @@ func addFilePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, HTML["add-file"])
 }
 
+func addFilesPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, HTML["add-files"])
+}
+
 func editFilePage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, HTML["file"])
 }
 
+func settingsPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, HTML["settings"])
+}
+
 func changeBoxPage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, HTML["change-box"])
 }
@@ -121,7 +210,7 @@ func boxPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func setupIbmCosPage(w http.ResponseWriter, r *http.Request) {
-	if db.GCM == nil {
+	if db, err := users.FromSession(r); err != nil || db.IsLocked() {
 		fmt.Fprint(w, HTML["login"])
 		return
 	}
@@ -137,7 +226,7 @@ func loginPage(w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-
+	db := vaultOf(r)
 	fileContents, err := goutil.GetFileContents(r)
 	if goutil.CheckErr(w, err, 400) {
 		return
@@ -149,8 +238,10 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reco.Checksum = r.FormValue("checksum")
+	// 对象以 checksum 命名，因此不可信任前端传来的 checksum, 要在服务器端计算。
+	reco.Checksum = goutil.Sha256Hex(fileContents)
 	reco.FileSize = int64(len(fileContents))
+	readPhotoInfo(reco, fileContents)
 
 	// 添加标签到 Reco, 后续还要添加 Reco.ID 到 Tag 数据表。
 	fileTags := []byte(r.FormValue("file-tags"))
@@ -159,13 +250,13 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 在 insertReco 里会添加 Reco.ID 到 Tag 数据表，并且会上传文件到 COS.
-	if goutil.CheckErr(w, db.InsertReco(reco, addRecoExt(reco.ID), fileContents), 500) {
+	if goutil.CheckErr(w, db.InsertReco(reco, fileContents), 500) {
 		return
 	}
 
 	// 数据库操作成功，生成缓存文件（如果是图片，则顺便生成缩略图）。
 	// 不可在数据库操作结束之前生成缓存文件，因为数据库操作发生错误时不应生成缓存文件。
-	if goutil.CheckErr(w, writeCacheFile(reco, fileContents), 500) {
+	if goutil.CheckErr(w, writeCacheFile(db, reco, fileContents), 500) {
 		return
 	}
 
@@ -173,8 +264,136 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	goutil.JsonMessage(w, reco.ID, 200)
 }
 
-func updateHandler(w http.ResponseWriter, r *http.Request) {
+// uploadResult 是批量上传时每个文件的处理结果。
+type uploadResult struct {
+	FileName string
+	ID       string
+	Status   string // uploaded, linked, duplicate, error
+	Message  string
+}
+
+// uploadFilesHandler 一次上传多个文件，这些文件共用同一组标签和同一个纸箱。
+// 校验和在服务器端计算，如果发现重复文件，则根据 duplicates 参数跳过 (skip),
+// 或把标签和纸箱添加到已存在的 reco 上 (link), 或新建一个与之共用同一个 Object
+// 的 reco (share)。最后返回每个文件的处理结果。
+func uploadFilesHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	if goutil.CheckErr(w, r.ParseMultipartForm(cfg.MaxBatchBytes), 400) {
+		return
+	}
+	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		goutil.JsonMessage(w, "no file", 400)
+		return
+	}
+
+	var fileTags []string
+	if goutil.CheckErr(w, json.Unmarshal([]byte(r.FormValue("file-tags")), &fileTags), 400) {
+		return
+	}
+	boxTitle := strings.TrimSpace(r.FormValue("box-title"))
+	dupMode := r.FormValue("duplicates")
+
+	var results []uploadResult
+	for _, fileHeader := range files {
+		result := uploadResult{FileName: fileHeader.Filename}
+		id, status, err := uploadOneFile(db, fileHeader, fileTags, boxTitle, dupMode)
+		result.ID = id
+		result.Status = status
+		if err != nil {
+			result.Status = "error"
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+	goutil.JsonResponse(w, results, 200)
+}
+
+// uploadOneFile 处理批量上传中的一个文件，返回 reco 的 ID 及处理状态。
+func uploadOneFile(db *database.DB, fileHeader *multipart.FileHeader, fileTags []string,
+	boxTitle, dupMode string) (id, status string, err error) {
 
+	// 批量上传的总大小已由 cfg.MaxBatchBytes 限制，每个文件仍受 cfg.MaxBytes 限制。
+	if fileHeader.Size > cfg.MaxBytes {
+		err = fmt.Errorf("the file is larger than %d bytes", cfg.MaxBytes)
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fileContents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return
+	}
+	checksum := goutil.Sha256Hex(fileContents)
+
+	// 先检查有无重复文件。
+	existing, err := db.GetRecoByChecksum(checksum)
+	if err != nil && err != storm.ErrNotFound {
+		return
+	}
+	found := err == nil
+	if found && dupMode != "share" {
+		id = existing.ID
+		if dupMode != "link" || existing.DeletedAt != "" {
+			return id, "duplicate", nil
+		}
+		if err = db.AddTagsToReco(existing, fileTags); err != nil {
+			return
+		}
+		if err = putIntoBox(db, existing, boxTitle); err != nil {
+			return
+		}
+		return id, "linked", nil
+	}
+
+	// 找不到重复文件 (或需要共用 Object), 新建一个 Reco.
+	reco, err := model.NewFile(fileHeader.Filename)
+	if err != nil {
+		return
+	}
+	id = reco.ID
+	reco.Checksum = checksum
+	reco.FileSize = int64(len(fileContents))
+	reco.Tags = fileTags
+	readPhotoInfo(reco, fileContents)
+
+	if err = db.InsertReco(reco, fileContents); err != nil {
+		return
+	}
+	if err = writeCacheFile(db, reco, fileContents); err != nil {
+		return
+	}
+	if err = putIntoBox(db, reco, boxTitle); err != nil {
+		return
+	}
+	if found {
+		return id, "shared", nil
+	}
+	return id, "uploaded", nil
+}
+
+// putIntoBox 把 reco 放进标题为 boxTitle 的纸箱，boxTitle 为空时不进行任何操作。
+func putIntoBox(db *database.DB, reco *Reco, boxTitle string) error {
+	if boxTitle == "" {
+		return nil
+	}
+	if reco.Box != "" {
+		box, err := db.GetBoxByID(reco.Box)
+		if err != nil {
+			return err
+		}
+		if box.Title == boxTitle {
+			return nil
+		}
+	}
+	return db.ChangeBox("", boxTitle, reco.ID)
+}
+
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	fileContents, err := goutil.GetFileContents(r)
 	if err != nil && err != http.ErrMissingFile {
 		goutil.JsonMessage(w, err.Error(), 500)
@@ -188,8 +407,7 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 为节省流量、减少出错，禁止上传相同文件。(在前端防止)
-	// 本来还应该检查 checksum 的唯一性，但替换文件是低频操作，因此可以偷懒。
+	// 内容相同的文件会共用同一个 Object, 因此不需要检查 checksum 的唯一性。
 
 	// 更新 reco 的内容
 	if goutil.CheckErr(w, updateReco(r, fileContents, reco), 500) {
@@ -210,13 +428,13 @@ func updateHandler(w http.ResponseWriter, r *http.Request) {
 	reco.AccessedAt = goutil.TimeNow()
 	reco.UpdatedAt = reco.AccessedAt
 
-	if goutil.CheckErr(w, db.UpdateReco(oldReco, reco, addRecoExt(id), fileContents), 500) {
+	if goutil.CheckErr(w, db.UpdateReco(oldReco, reco, fileContents), 500) {
 		return
 	}
 
 	// 更新缓存文件
 	if fileContents != nil && reco.Checksum != oldReco.Checksum {
-		if goutil.CheckErr(w, writeCacheFile(reco, fileContents), 500) {
+		if goutil.CheckErr(w, writeCacheFile(db, reco, fileContents), 500) {
 			return
 		}
 	}
@@ -232,6 +450,9 @@ func updateReco(r *http.Request, fileContents []byte, reco *Reco) error {
 	if err := reco.SetFileNameType(r.FormValue("file-name")); err != nil {
 		return err
 	}
+	if fileContents != nil {
+		readPhotoInfo(reco, fileContents)
+	}
 	reco.Message = strings.TrimSpace(r.FormValue("description"))
 
 	fileLinks := []byte(r.FormValue("file-links"))
@@ -246,6 +467,7 @@ func updateReco(r *http.Request, fileContents []byte, reco *Reco) error {
 }
 
 func checksumHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	hashHex := r.FormValue("hashHex")
 	var reco Reco
 	err := db.DB.One("Checksum", hashHex, &reco)
@@ -261,11 +483,13 @@ func checksumHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// err == nil, 正常找到已存在 hashHex, 表示发生文件冲突。
-	goutil.JsonMessage(w, "Checksum Already Exists", 400)
+	// err == nil, 正常找到已存在 hashHex, 表示已有内容相同的文件。
+	// 内容相同的文件可以共用同一个 Object, 因此返回 409 由前端询问用户是否继续。
+	goutil.JsonMessage(w, reco.ID, 409)
 }
 
 func getRecoHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	id := r.FormValue("id")
 	reco, err := db.GetRecoByID(id)
 	if goutil.CheckErr(w, err, 500) {
@@ -274,10 +498,12 @@ func getRecoHandler(w http.ResponseWriter, r *http.Request) {
 	if goutil.CheckErr(w, db.SetRecoAccessed(id, reco.AccessCount+1), 500) {
 		return
 	}
+	localFiles.Touch(db.Name, id, goutil.TimeNow())
 	goutil.JsonResponse(w, reco, 200)
 }
 
 func getAllRecos(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	var all []*Reco
 	err := db.DB.
 		Select(q.Eq("DeletedAt", ""), q.Gt("ID", "1")).
@@ -288,15 +514,30 @@ func getAllRecos(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, reco := range all {
 		reco.Checksum = ""
-		if goutil.CheckErr(w, boxShowTitle(reco), 500) {
+		if goutil.CheckErr(w, boxShowTitle(db, reco), 500) {
 			return
 		}
 	}
 	goutil.JsonResponse(w, all, 200)
 }
 
+// timelineHandler 返回按拍摄日期分组的全部照片 (参考 database.DB.Timeline)。
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	days, err := db.Timeline()
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	for _, day := range days {
+		for _, reco := range day.Recos {
+			reco.Checksum = ""
+		}
+	}
+	goutil.JsonResponse(w, days, 200)
+}
+
 // 把 box.ID 转换为 box.Title 方便前端显示。
-func boxShowTitle(reco *Reco) error {
+func boxShowTitle(db *database.DB, reco *Reco) error {
 	if reco.Box != "" {
 		box, err := db.GetBoxByID(reco.Box)
 		if err != nil {
@@ -308,6 +549,7 @@ func boxShowTitle(reco *Reco) error {
 }
 
 func getAllBoxes(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	var boxes []Box
 	err := db.DB.AllByIndex("UpdatedAt", &boxes, storm.Reverse())
 	if goutil.CheckErr(w, err, 500) {
@@ -317,34 +559,36 @@ func getAllBoxes(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteRecoHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	id := r.FormValue("id")
 	goutil.CheckErr(w, db.DeleteReco(id), 500)
 }
 
-func createThumbHandler(w http.ResponseWriter, r *http.Request) {
+// purgeRecoHandler 彻底删除垃圾桶里的一个 reco, 同时删除缓存文件。
+func purgeRecoHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	id := r.FormValue("id")
 	if checkIDEmpty(w, id) {
 		return
 	}
+	if goutil.CheckErr(w, db.PurgeReco(id), 500) {
+		return
+	}
+	goutil.CheckErr(w, removeLocalFiles(db.Name, id), 500)
+}
 
-	imgPath := cacheFilePath(id)
-	thumbPath := cacheThumbPath(id)
-
-	// 验证这个文件是图片（省略，因为省略也不会出大问题）
-
-	// 本来还要检查缩略图是否存在，但为了同时适用于别的场景
-	// （比如缩略图存在，但大图不存在的情况）因此不检查缩略图是否存在。
-
-	if goutil.PathIsNotExist(imgPath) {
-		err := db.DownloadDecrypt(addRecoExt(id), imgPath)
-		if goutil.CheckErr(w, err, 500) {
-			return
-		}
+// createThumbHandler 重新生成图片的显示用的图片及缩略图。
+func createThumbHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	id := r.FormValue("id")
+	if checkIDEmpty(w, id) {
+		return
 	}
-	goutil.CheckErr(w, util.CreateThumb(imgPath, thumbPath), 500)
+	goutil.CheckErr(w, regenerateRenditions(db, id), 500)
 }
 
 func getRecosByTag(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	tagName := r.FormValue("tag")
 	recos, err := db.GetRecosByTag(tagName)
 	if goutil.CheckErr(w, err, 500) {
@@ -354,7 +598,7 @@ func getRecosByTag(w http.ResponseWriter, r *http.Request) {
 	// 在返回给前端之前进行一些处理（删除不需要的，添加需要的）。
 	for _, reco := range recos {
 		reco.Checksum = ""
-		if goutil.CheckErr(w, boxShowTitle(reco), 500) {
+		if goutil.CheckErr(w, boxShowTitle(db, reco), 500) {
 			return
 		}
 	}
@@ -362,8 +606,17 @@ func getRecosByTag(w http.ResponseWriter, r *http.Request) {
 }
 
 func getRecosByBox(w http.ResponseWriter, r *http.Request) {
-	boxID := r.FormValue("box-id")
-	recos, err := db.GetRecosByBox(boxID)
+	db := vaultOf(r)
+	access, err := openSharedBox(r, db)
+	if goutil.CheckErr(w, err, 403) {
+		return
+	}
+	var recos []*Reco
+	if access != nil {
+		recos, err = access.Recos()
+	} else {
+		recos, err = db.GetRecosByBox(r.FormValue("box-id"))
+	}
 	if goutil.CheckErr(w, err, 500) {
 		return
 	}
@@ -376,7 +629,8 @@ func getRecosByBox(w http.ResponseWriter, r *http.Request) {
 }
 
 func setupIbmCosHandler(w http.ResponseWriter, r *http.Request) {
-	if db.GCM == nil {
+	db, err := users.FromSession(r)
+	if err != nil || db.IsLocked() {
 		goutil.JsonRequireLogin(w)
 		return
 	}
@@ -392,7 +646,12 @@ func setupIbmCosHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkCloudSettings(w http.ResponseWriter, r *http.Request) {
-	if goutil.PathIsExist(cosSettingsPath) {
+	db, err := users.FromSession(r)
+	if err != nil {
+		goutil.JsonRequireLogin(w)
+		return
+	}
+	if db.HasCloudSettings() {
 		goutil.JsonMsgOK(w)
 	} else {
 		goutil.JsonMsg404(w)
@@ -400,7 +659,7 @@ func checkCloudSettings(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkCOS(w http.ResponseWriter, r *http.Request) {
-	if db.COS == nil {
+	if db, err := users.FromSession(r); err != nil || db.COS == nil {
 		goutil.JsonMsg404(w)
 	} else {
 		goutil.JsonMsgOK(w)
@@ -415,21 +674,151 @@ func checkLoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 func isAccountExist(w http.ResponseWriter, r *http.Request) {
-	if db.IsFirstRecoExist() {
+	if users.HasUsers() {
 		goutil.JsonMessage(w, "true", 200)
 	} else {
 		goutil.JsonMessage(w, "false", 200)
 	}
 }
 
-func deleteFirstReco(w http.ResponseWriter, r *http.Request) {
-	reco := Reco{ID: "1"}
-	goutil.CheckErr(w, db.DB.DeleteStruct(&reco), 500)
+func resetAccountPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, HTML["reset-account"])
+}
+
+// resetAccountHandler 重置账号 (需要输入当前的密码), 成功后返回 RecoveryFile.
+// 如果 wipe 为 "true", 则同时删除云储存中的全部文件。
+func resetAccountHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	ip := clientIP(r)
+	if wait, ok := loginLimiter.Allow(ip, db.Name); !ok {
+		tooManyTries(w, wait)
+		return
+	}
+	passphrase := r.FormValue("passphrase")
+	if err := db.VerifyPassphrase(passphrase); err != nil {
+		loginFailed(r, db.Name, ip, err)
+		goutil.JsonMessage(w, err.Error(), 400)
+		return
+	}
+	// 重置成功后才撤销分享链接 (参考 Users.ResetAccount)。
+	file, err := users.ResetAccount(db, passphrase, r.FormValue("wipe") == "true")
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	// 缓存文件是解密后的文件，无论是否清空云储存都要删除。
+	if err := clearLocalFiles(db.Name); err != nil {
+		log.Print(err)
+	}
+	users.Sess.DeleteSID(w, r)
+	w.Header().Set("Content-Disposition", `attachment; filename="recoit-recovery.json"`)
+	goutil.JsonResponse(w, file, 200)
+}
+
+// restoreAccountHandler 用 RecoveryFile 及原来的密码恢复用户 user 被重置的账号。
+// 与登入一样受频率限制。
+func restoreAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	name := r.FormValue("user")
+	if wait, ok := loginLimiter.Allow(ip, name); !ok {
+		tooManyTries(w, wait)
+		return
+	}
+	db, err := users.Vault(name)
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	f, _, err := r.FormFile("recovery-file")
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	defer f.Close()
+	var file database.RecoveryFile
+	if goutil.CheckErr(w, json.NewDecoder(f).Decode(&file), 400) {
+		return
+	}
+	if err := db.RestoreAccount(&file, r.FormValue("passphrase")); err != nil {
+		if err == database.ErrNothingToRestore {
+			loginFailed(r, name, ip, err)
+		}
+		goutil.JsonMessage(w, err.Error(), 400)
+		return
+	}
+	if err := loginLimiter.Succeed(ip, name); err != nil {
+		log.Print(err)
+	}
 }
 
+// createAccountHandler 创建用户，如果 recovery-code 为 "true" 则同时生成恢复码并返回。
+// 第一个用户 (管理员) 可以直接创建，之后只有已登入的管理员才可以创建新用户
+// 或重新创建已被重置的用户。
 func createAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if users.HasUsers() {
+		if !isLoggedIn(r) {
+			goutil.JsonRequireLogin(w)
+			return
+		}
+		if !users.Sess.CheckCSRF(r) {
+			goutil.JsonMessage(w, "Invalid CSRF token", 403)
+			return
+		}
+		caller, err := users.Sess.User(r)
+		if goutil.CheckErr(w, err, 500) {
+			return
+		}
+		if !users.IsAdmin(caller) {
+			goutil.JsonMessage(w, "only an admin can create accounts", 403)
+			return
+		}
+	}
+	name := strings.TrimSpace(r.FormValue("user"))
 	passphrase := r.FormValue("passphrase")
-	goutil.CheckErr(w, db.InsertFirstReco(passphrase), 500)
+	code, err := users.Create(name, passphrase, r.FormValue("recovery-code") == "true")
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	goutil.JsonMessage(w, code, 200)
+}
+
+func recoverAccountPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, HTML["recover-account"])
+}
+
+// recoverAccountHandler 用恢复码重设密码。恢复码与密码一样受登入频率限制。
+func recoverAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	name := r.FormValue("user")
+	if wait, ok := loginLimiter.Allow(ip, name); !ok {
+		tooManyTries(w, wait)
+		return
+	}
+	db, err := users.Vault(name)
+	if err == nil {
+		err = db.RecoverAccount(r.FormValue("recovery-code"), r.FormValue("passphrase"))
+	}
+	if err != nil {
+		loginFailed(r, name, ip, err)
+		goutil.JsonMessage(w, err.Error(), 400)
+		return
+	}
+	if err := loginLimiter.Succeed(ip, name); err != nil {
+		log.Print(err)
+	}
+	// 账号可能已被别人知道了密码，因此撤销全部分享链接。
+	if err := users.DeleteShareLinks(name); err != nil {
+		log.Print(err)
+	}
+	users.Sess.DeleteSID(w, r)
+	goutil.JsonMsgOK(w)
+}
+
+// newRecoveryCodeHandler 重新生成恢复码 (需要输入当前的密码), 旧的恢复码随之失效。
+func newRecoveryCodeHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	code, err := db.NewRecoveryCode(r.FormValue("passphrase"))
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	goutil.JsonMessage(w, code, 200)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -438,14 +827,21 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// db.Login 的作用是验证密码。
-	passphrase := r.FormValue("passphrase")
-	if err := db.Login(passphrase); err != nil {
-		passwordTry++
-		if checkPasswordTry(w) {
-			return
-		}
-		goutil.JsonMessage(w, err.Error(), 400)
+	ip := clientIP(r)
+	name := strings.TrimSpace(r.FormValue("user"))
+	if wait, ok := loginLimiter.Allow(ip, name); !ok {
+		tooManyTries(w, wait)
+		return
+	}
+
+	// db.Login 的作用是验证密码。不区分用户不存在与密码错误，以免泄露用户名。
+	db, err := users.Vault(name)
+	if err == nil {
+		err = db.Login(r.FormValue("passphrase"))
+	}
+	if err != nil {
+		loginFailed(r, name, ip, err)
+		goutil.JsonMessage(w, "Wrong user name or password.", 400)
 		return
 	}
 
@@ -457,51 +853,576 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 成功登入
-	passwordTry = 0
-	db.Sess.Add(w, goutil.NewID())
+	if err := loginLimiter.Succeed(ip, name); err != nil {
+		log.Print(err)
+	}
+	if goutil.CheckErr(w, makeUserDirs(db.Name), 500) {
+		return
+	}
+	// 旧版本的用户没有密钥对，无法接收共享纸箱，因此在登入时补上。
+	if err := users.EnsureKeyPair(db); err != nil {
+		log.Print(err)
+	}
+	if err := db.RefreshSharedSettings(); err != nil {
+		log.Print(err)
+	}
+	// 衍生图片的参数改变后，启动时删除了的衍生图片在登入后重新生成。
+	if ids := takeStaleRenditions(db.Name); len(ids) > 0 {
+		startRenditionJob(db, ids)
+	}
+	goutil.CheckErr(w, db.NewSession(w), 500)
+}
+
+func tooManyTries(w http.ResponseWriter, wait time.Duration) {
+	goutil.JsonMessage(w, retryAfter(w, wait), 429)
+}
+
+// retryAfter 设置 Retry-After header, 返回提示用户等待的消息。
+func retryAfter(w http.ResponseWriter, wait time.Duration) string {
+	wait = wait.Round(time.Second) + time.Second
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+	return "Too many wrong passwords. Try again in " + wait.String()
+}
+
+// loginFailed 记录以用户名 user 失败的登入尝试。记录失败不影响本次请求。
+func loginFailed(r *http.Request, user, ip string, reason error) {
+	if err := loginLimiter.Fail(ip, user); err != nil {
+		log.Print(err)
+	}
+	if err := users.AddLoginFailure(user, ip, r.UserAgent(), reason.Error()); err != nil {
+		log.Print(err)
+	}
+	log.Printf("login failed for %q from %s: %v", user, ip, reason)
+}
+
+// loginFailuresHandler 返回当前用户最近的失败的登入尝试。
+func loginFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	failures, err := users.LoginFailures(db.Name, loginFailuresLimit)
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	goutil.JsonResponse(w, failures, 200)
 }
 
+// logoutHandler 只退出本设备，不影响其他已登入的设备。
+// 如果这是该用户最后一个 session, 则同时锁定该用户的 vault.
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	db.Reset()
-	db.Sess.DeleteSID(w, r)
+	name, err := users.Sess.User(r)
+	users.Sess.DeleteSID(w, r)
+	if err == nil && users.Sess.CountUser(name) == 0 {
+		if db, err := users.Vault(name); err == nil {
+			db.Lock()
+		}
+		clearTempFiles(name)
+	}
 	http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 }
 
+// lockVaultHandler 锁定并退出全部设备。
+func lockVaultHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	db.LockVault()
+	users.Sess.DeleteSID(w, r)
+	clearTempFiles(db.Name)
+	goutil.JsonMsgOK(w)
+}
+
 // downloadFile 检查本地缓存有无该 id 的文件，如果没有就从 COS 下载。
-// 最后向前端返回该文件的 url.
+// 最后向前端返回该文件的 url. 如果有 owner 参数，则从该用户分享的纸箱 box-id 里下载。
 func downloadFile(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	id := r.FormValue("id")
 	if checkIDEmpty(w, id) {
 		return
 	}
+	access, err := openSharedBox(r, db)
+	if goutil.CheckErr(w, err, 403) {
+		return
+	}
+	if access != nil {
+		tempFile := tempFilePath(db.Name, id)
+		if goutil.PathIsNotExist(tempFile) {
+			contents, err := access.Download(id)
+			if goutil.CheckErr(w, err, 403) {
+				return
+			}
+			if goutil.CheckErr(w, writeLocalFile(db, tempFile, id, contents), 500) {
+				return
+			}
+		}
+		goutil.JsonMessage(w, tempFileURL(id), 200)
+		return
+	}
+
+	reco, err := db.GetRecoByID(id)
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
 
-	// 如果 cache 文件夹有文件，就直接使用。
-	if goutil.PathIsExist(cacheFilePath(id)) {
+	// 如果是图片并且 cache 文件夹有文件，就直接使用。
+	// (其他文件在 cache 文件夹里的是预览图，不是原文件。)
+	if reco.IsImage() && goutil.PathIsExist(cacheFilePath(db.Name, id)) {
+		localFiles.Touch(db.Name, id, goutil.TimeNow())
 		goutil.JsonMessage(w, cacheFileURL(id), 200)
 		return
 	}
 
 	// 如果 cache 文件夹找不到文件，就下载到 temp 文件夹里。
-	tempFile := tempFilePath(id)
+	tempFile := tempFilePath(db.Name, id)
 	if goutil.PathIsNotExist(tempFile) {
-		err := db.DownloadDecrypt(addRecoExt(id), tempFile)
+		contents, err := db.Download(reco.Object)
 		if goutil.CheckErr(w, err, 500) {
 			return
 		}
+		if goutil.CheckErr(w, writeLocalFile(db, tempFile, id, contents), 500) {
+			return
+		}
+	} else {
+		localFiles.Touch(db.Name, id, goutil.TimeNow())
 	}
 	goutil.JsonMessage(w, tempFileURL(id), 200)
 }
 
+// streamHandler 把文件 id 的原文件直接发送给浏览器 (路径为 streamPrefix + id),
+// 不需要先调用 downloadFile. 如果有 owner 参数，则从该用户分享的纸箱 box-id 里下载。
+// 参数 download 不为空时作为附件下载，否则在浏览器中打开 (只限 canShowInline 的文件)。
+// 支持 Range 请求，以便拖动视频进度条。
+// 文件从云储存边下载边解密，不会完整读进内存，也不写入临时文件夹。
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	id := strings.TrimPrefix(r.URL.Path, streamPrefix)
+	if checkIDEmpty(w, id) {
+		return
+	}
+	access, err := openSharedBox(r, db)
+	if goutil.CheckErr(w, err, 403) {
+		return
+	}
+	var reco *Reco
+	if access != nil {
+		reco, err = access.GetReco(id)
+	} else {
+		reco, err = db.GetRecoByID(id)
+	}
+	if err == storm.ErrNotFound || (err == nil && reco.Object == "") {
+		goutil.JsonMessage(w, "file not found", 404)
+		return
+	}
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+
+	var obj *database.ObjectReader
+	if access != nil {
+		obj, err = access.OpenObject(id)
+	} else {
+		obj, err = db.OpenObject(reco.Object)
+	}
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	defer obj.Close()
+
+	disposition := "attachment"
+	if r.FormValue("download") == "" && canShowInline(reco.FileType) {
+		disposition = "inline"
+	}
+	if reco.FileType != "" {
+		w.Header().Set("Content-Type", reco.FileType)
+	}
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType(disposition, map[string]string{"filename": reco.FileName}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, reco.FileName, time.Time{}, obj)
+}
+
+// canShowInline 判断 fileType 的文件能否在浏览器中直接打开。
+// 只限图片 (SVG 除外), 视频, 音频及 PDF, 其他文件 (例如 HTML) 可能包含脚本，
+// 在本站打开就能读取 CSRF token 并调用任何 API, 因此一律作为附件下载。
+func canShowInline(fileType string) bool {
+	mediaType, _, err := mime.ParseMediaType(fileType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return mediaType == "application/pdf"
+}
+
+// cacheStatsHandler 返回本地缓存的统计数据 (参考 cache.Stats)。
+// 全部用户合计的数据会透露其他用户的使用情况，因此只返回给管理员。
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	stats := localFiles.Stats(db.Name)
+	admin := users.IsAdmin(db.Name)
+	if !admin {
+		stats.Files, stats.Bytes, stats.Evictions = 0, 0, 0
+	}
+	goutil.JsonResponse(w, map[string]interface{}{
+		"Stats": stats,
+		"Admin": admin,
+	}, 200)
+}
+
+// regenerateRenditionsHandler 在后台重新生成全部文件的衍生图片 (例如修改参数后),
+// 进度用 regenerateStatusHandler 查看。
+func regenerateRenditionsHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	var all []*Reco
+	err := db.DB.Select(q.Eq("DeletedAt", ""), q.Eq("Type", model.File)).Find(&all)
+	if err != nil && err != storm.ErrNotFound {
+		goutil.CheckErr(w, err, 500)
+		return
+	}
+	var ids []string
+	for _, reco := range all {
+		if graphics.CanPreview(reco.FileType) {
+			ids = append(ids, reco.ID)
+		}
+	}
+	if !startRenditionJob(db, ids) {
+		goutil.JsonMessage(w, "A regeneration job is already running.", 409)
+		return
+	}
+	goutil.JsonResponse(w, renditionJobOf(db.Name), 200)
+}
+
+func regenerateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	goutil.JsonResponse(w, renditionJobOf(db.Name), 200)
+}
+
+// exportHandler 把全部数据导出为一个 tar 包，直接发送给前端下载。
+// 如果提供了 password, 文件内容及元数据会用该密码派生的密钥加密 (参考 database.Export)。
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	password := r.PostFormValue("password")
+	filename := "recoit-export-" + time.Now().Format("20060102-150405") + ".tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// 已经开始发送数据，因此出错时无法再返回 json 消息，只能记录下来。
+	if err := db.Export(w, password); err != nil {
+		log.Print("export: ", err)
+	}
+}
+
+// importDirHandler 导入服务器本地的一个文件夹 (只限 cfg.ImportRoot 里面的), 返回每个文件的处理结果。
+// 子文件夹的名称根据 dir-as 转换为纸箱或标签 (参考 database.ImportRules)。
+func importDirHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	dir := strings.TrimSpace(r.FormValue("dir"))
+	if dir == "" {
+		goutil.JsonMessage(w, "dir is empty", 400)
+		return
+	}
+	rules := database.ImportRules{
+		DirAs:      r.FormValue("dir-as"),
+		SkipHidden: r.FormValue("skip-hidden") != "false",
+	}
+	if fileTags := r.FormValue("file-tags"); fileTags != "" {
+		if goutil.CheckErr(w, json.Unmarshal([]byte(fileTags), &rules.Tags), 400) {
+			return
+		}
+	}
+	results, err := db.ImportDir(cfg.ImportRoot, dir, rules)
+	if err == database.ErrImportDisabled {
+		goutil.JsonMessage(w, err.Error(), 403)
+		return
+	}
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	goutil.JsonResponse(w, results, 200)
+}
+
 func getBoxHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	access, err := openSharedBox(r, db)
+	if goutil.CheckErr(w, err, 403) {
+		return
+	}
+	if access != nil {
+		goutil.JsonResponse(w, access.Box, 200)
+		return
+	}
+	box, err := db.GetBoxByID(r.FormValue("box-id"))
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	goutil.JsonResponse(w, box, 200)
+}
+
+// openSharedBox 如果请求带有 owner 参数 (且不是当前用户), 则打开该用户分享给当前用户的
+// 纸箱 box-id, 不是成员时返回 database.ErrNoAccess. 返回 nil 表示是当前用户自己的纸箱。
+func openSharedBox(r *http.Request, db *database.DB) (*database.BoxAccess, error) {
+	owner := r.FormValue("owner")
+	if owner == "" || owner == db.Name {
+		return nil, nil
+	}
+	return users.OpenSharedBox(db, owner, r.FormValue("box-id"))
+}
+
+func sharedBoxesPage(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, HTML["shared-boxes"])
+}
+
+// sharedBoxesHandler 返回其他用户分享给当前用户的全部纸箱。
+func sharedBoxesHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	boxes, err := users.SharedWith(db.Name)
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	goutil.JsonResponse(w, boxes, 200)
+}
+
+// boxMembersHandler 返回当前用户的纸箱的全部成员。
+func boxMembersHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	members, err := db.BoxMembers(r.FormValue("box-id"))
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	// 被加密的纸箱密钥不需要返回给前端。
+	for i := range members {
+		members[i].Key = ""
+	}
+	goutil.JsonResponse(w, members, 200)
+}
+
+// shareBoxHandler 把当前用户的纸箱分享给另一个用户 (perm 为 read 或 write)。
+func shareBoxHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	boxID := r.FormValue("box-id")
+	member := strings.TrimSpace(r.FormValue("user"))
+	perm := r.FormValue("perm")
+	goutil.CheckErr(w, users.ShareBox(db, boxID, member, perm), 400)
+}
+
+// revokeBoxHandler 撤销一个成员的访问权限 (纸箱会更换密钥)，
+// 并删除该成员在服务器上的纸箱文件缓存。
+func revokeBoxHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	boxID := r.FormValue("box-id")
+	member := r.FormValue("user")
 	box, err := db.GetBoxByID(boxID)
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	if goutil.CheckErr(w, users.RevokeBox(db, boxID, member), 400) {
+		return
+	}
+	for _, id := range box.RecoIDs {
+		if err := removeLocalFiles(member, id); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// uploadToSharedBoxHandler 上传一个文件到其他用户分享给当前用户的纸箱 (需要 write 权限)。
+func uploadToSharedBoxHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	access, err := openSharedBox(r, db)
+	if goutil.CheckErr(w, err, 403) {
+		return
+	}
+	if access == nil {
+		goutil.JsonMessage(w, "owner is empty", 400)
+		return
+	}
+	fileContents, err := goutil.GetFileContents(r)
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	reco, err := model.NewFile(r.FormValue("file-name"))
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	reco.Checksum = goutil.Sha256Hex(fileContents)
+	reco.FileSize = int64(len(fileContents))
+	readPhotoInfo(reco, fileContents)
+	if goutil.CheckErr(w, access.InsertReco(reco, fileContents), 403) {
+		return
+	}
+	goutil.JsonMessage(w, reco.ID, 200)
+}
+
+// createShareLinkHandler 为一个文件新建公开的分享链接。
+// hours 是有效期 (小时), max-downloads 为 0 或空表示不限次数, password 可以为空。
+func createShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil || hours <= 0 || hours > maxShareLinkHours {
+		goutil.JsonMessage(w, fmt.Sprintf("hours should be 1-%d", maxShareLinkHours), 400)
+		return
+	}
+	maxDownloads := 0
+	if value := r.FormValue("max-downloads"); value != "" {
+		if maxDownloads, err = strconv.Atoi(value); err != nil {
+			goutil.JsonMessage(w, "max-downloads should be a number", 400)
+			return
+		}
+	}
+	token, link, err := users.CreateShareLink(db, r.FormValue("id"),
+		r.FormValue("password"), time.Duration(hours)*time.Hour, maxDownloads)
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	link.Key, link.Salt = "", ""
+	goutil.JsonResponse(w, map[string]interface{}{
+		"URL":  shareLinkPrefix + token,
+		"Link": link,
+	}, 200)
+}
+
+// shareLinksHandler 返回当前用户的分享链接，提供 id 时只返回该文件的链接。
+// (链接本身只在新建时返回一次，这里只能用来查看及删除。)
+func shareLinksHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	links, err := users.ShareLinks(db.Name, r.FormValue("id"))
 	if goutil.CheckErr(w, err, 500) {
 		return
 	}
-	goutil.JsonResponse(w, box, 200)
+	for i := range links {
+		links[i].Key, links[i].Salt = "", ""
+	}
+	goutil.JsonResponse(w, links, 200)
+}
+
+func deleteShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	goutil.CheckErr(w, users.DeleteShareLink(db.Name, r.FormValue("link-id")), 400)
+}
+
+// linkAccessesHandler 返回一个分享链接最近的下载尝试。
+func linkAccessesHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	accesses, err := users.LinkAccesses(db.Name, r.FormValue("link-id"), linkAccessesLimit)
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	goutil.JsonResponse(w, accesses, 200)
+}
+
+// shareLinkHandler 处理公开的分享链接 (不需要登入)。
+// GET 请求只返回下载页面 (需要密码时包括输入密码的表单), 再用 POST 下载，
+// 因此聊天软件等预览链接时不会占用下载次数。
+// 文件在每次请求时从 COS 下载、解密，发送后立即删除，不会留在 temp 文件夹里。
+func shareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, shareLinkPrefix)
+	if r.Method != http.MethodPost {
+		link, err := users.ShareLinkInfo(token)
+		switch {
+		case err == database.ErrLinkInvalid:
+			http.Error(w, err.Error(), 404)
+		case err != nil:
+			log.Print(err)
+			http.Error(w, "Failed to open the link", 500)
+		case link.UsedUp():
+			http.Error(w, database.ErrLinkUsedUp.Error(), 410)
+		case link.HasPassword:
+			fmt.Fprint(w, HTML["share-link"])
+		default:
+			fmt.Fprint(w, HTML["share-link-download"])
+		}
+		return
+	}
+	password := r.PostFormValue("password")
+	ip := clientIP(r)
+	if password != "" {
+		if wait, ok := linkLimiter.Allow(ip, ""); !ok {
+			http.Error(w, retryAfter(w, wait), 429)
+			return
+		}
+	}
+	file, err := users.OpenShareLink(token, password, ip, r.UserAgent())
+	switch {
+	case err == database.ErrLinkPassword && password == "":
+		http.Error(w, "Password required", 401)
+		return
+	case err == database.ErrLinkPassword:
+		if err := linkLimiter.Fail(ip, ""); err != nil {
+			log.Print(err)
+		}
+		http.Error(w, err.Error(), 401)
+		return
+	case err == database.ErrLinkInvalid:
+		http.Error(w, err.Error(), 404)
+		return
+	case err == database.ErrLinkUsedUp:
+		http.Error(w, err.Error(), 410)
+		return
+	case err != nil:
+		log.Print(err)
+		http.Error(w, "Failed to open the link", 500)
+		return
+	}
+
+	// 边下载边解密，不在服务器上留下解密后的副本。
+	obj, err := file.Open()
+	if err != nil {
+		if err == database.ErrLinkUsedUp {
+			http.Error(w, err.Error(), 410)
+			return
+		}
+		log.Print(err)
+		http.Error(w, "Failed to download the file", 500)
+		return
+	}
+	w.Header().Set("Content-Type", file.Reco.FileType)
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": file.Reco.FileName}))
+	defer obj.Close()
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	http.ServeContent(w, r, file.Reco.FileName, time.Time{}, obj)
+}
+
+// apiTokensHandler 返回当前用户的全部 API token (不包括 token 本身)。
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	tokens, err := db.APITokens()
+	if goutil.CheckErr(w, err, 500) {
+		return
+	}
+	for i := range tokens {
+		tokens[i].Key = ""
+	}
+	goutil.JsonResponse(w, tokens, 200)
+}
+
+// createAPITokenHandler 新建一个 API token, token 本身只在此时返回一次。
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	token, apiToken, err := db.CreateAPIToken(r.FormValue("name"), r.FormValue("scope"))
+	if goutil.CheckErr(w, err, 400) {
+		return
+	}
+	apiToken.Key = ""
+	goutil.JsonResponse(w, map[string]interface{}{
+		"Token":    token,
+		"APIToken": apiToken,
+	}, 200)
+}
+
+func deleteAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
+	goutil.CheckErr(w, db.DeleteAPIToken(r.FormValue("token-id")), 400)
 }
 
 func changeBox(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	recoID := r.FormValue("id")
 	boxID := r.FormValue("box-id")
 	boxTitle := strings.TrimSpace(r.FormValue("box-title"))
@@ -515,6 +1436,7 @@ func changeBox(w http.ResponseWriter, r *http.Request) {
 }
 
 func renameBoxHandler(w http.ResponseWriter, r *http.Request) {
+	db := vaultOf(r)
 	boxID := r.FormValue("box-id")
 	boxTitle := strings.TrimSpace(r.FormValue("box-title"))
 
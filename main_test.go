@@ -1,9 +1,43 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ahui2016/recoit/config"
+	"github.com/ahui2016/recoit/database"
+)
+
+// TestMain 在临时的数据文件夹里运行 setup, 以免改动开发者自己的数据。
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "recoit-main")
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := config.Default()
+	c.DataDir = dir
+	setup(c)
+	code := m.Run()
+	users.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
 
 func TestFindAll(t *testing.T) {
-	defer db.Close()
+	db, err := users.Vault("admin")
+	if err == database.ErrNoUser {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
 	var all []Reco
 	if err := db.DB.All(&all); err != nil {
 		t.Fatal(err)
@@ -16,3 +50,57 @@ func TestFindAll(t *testing.T) {
 	}
 	t.Log("tags: ", tags)
 }
+
+func TestUploadFilesTooLarge(t *testing.T) {
+	if _, err := users.Create("uploader", "pwd", false); err != nil {
+		t.Fatal(err)
+	}
+	db, err := users.Vault("uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxBytes := cfg.MaxBytes
+	cfg.MaxBytes = 10
+	defer func() { cfg.MaxBytes = maxBytes }()
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("files", "big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(bytes.Repeat([]byte("x"), 20))
+	form.WriteField("file-tags", "[]")
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/api/upload-files", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), vaultKey{}, db))
+	w := httptest.NewRecorder()
+	uploadFilesHandler(w, r)
+
+	var results []uploadResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(results) != 1 || results[0].Status != "error" {
+		t.Errorf("a file over MaxBytes should be rejected, got %+v", results)
+	}
+}
+
+func TestCanShowInline(t *testing.T) {
+	for fileType, want := range map[string]bool{
+		"image/png":                true,
+		"video/mp4":                true,
+		"audio/mpeg":               true,
+		"application/pdf":          true,
+		"image/svg+xml":            false,
+		"text/html; charset=utf-8": false,
+		"application/xhtml+xml":    false,
+		"":                         false,
+	} {
+		if got := canShowInline(fileType); got != want {
+			t.Errorf("canShowInline(%q) = %v, want %v", fileType, got, want)
+		}
+	}
+}
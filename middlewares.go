@@ -1,35 +1,84 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/ahui2016/goutil"
+	"github.com/ahui2016/recoit/database"
+	"github.com/ahui2016/recoit/model"
 )
 
+// vaultKey 是 checkLogin 把当前用户的 vault 放进请求 context 时使用的 key.
+type vaultKey struct{}
+
+// tokenKey 是 checkLogin 把请求所用的 API token 放进请求 context 时使用的 key.
+type tokenKey struct{}
+
 // func handlerToFunc(h http.Handler) http.HandlerFunc {
 // 	return func(w http.ResponseWriter, r *http.Request) {
 // 		h.ServeHTTP(w, r)
 // 	}
 // }
 
-func checkLoginForFileServer(h http.Handler) http.HandlerFunc {
+// localFileServer 解密并提供 baseDir 里当前用户的文件 (参考 writeLocalFile)，
+// 用户之间看不到对方的文件。解密后的内容不允许浏览器缓存到硬盘。
+// 与 streamHandler 一样，只有 canShowInline 的文件才在浏览器中打开。
+// 如果文件不存在并且 regenerate 不为 nil, 则先用 regenerate 重新生成该 reco 的文件。
+func localFileServer(prefix, baseDir string, regenerate func(r *http.Request, db *database.DB, id string) error) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if passwordTry >= passwordMaxTry {
-			db.Reset()
+		db, _, ok := authenticate(w, r)
+		if !ok {
 			http.NotFound(w, r)
 			return
 		}
-		if isLoggedOut(r) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
 			http.NotFound(w, r)
 			return
 		}
-		h.ServeHTTP(w, r)
+		path := filepath.Join(baseDir, db.Name, name)
+		contents, err := readLocalFile(db, path)
+		if err != nil && regenerate != nil {
+			id := strings.SplitN(name, ".", 2)[0]
+			if err = regenerate(r, db, id); err == nil {
+				contents, err = readLocalFile(db, path)
+			}
+		}
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Print(err)
+			}
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if regenerate != nil {
+			// 衍生图片的格式由参数决定 (参考 graphics.Profile), 与文件名的后缀无关。
+			w.Header().Set("Content-Type", http.DetectContentType(contents))
+		} else if !canShowInline(mime.TypeByExtension(filepath.Ext(name))) {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(contents))
 	}
 }
 
+// checkLogin 检查是否已登入，并把当前用户的 vault 放进请求 (用 vaultOf 取出)。
 func checkLogin(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if isLoggedOut(r) {
+		db, apiToken, ok := authenticate(w, r)
+		if !ok {
 			// 凡是以 "/api/" 开头的请求都返回 json 消息。
 			if strings.HasPrefix(r.URL.Path, "/api/") {
 				jsonRequireLogin(w)
@@ -39,32 +88,177 @@ func checkLogin(fn http.HandlerFunc) http.HandlerFunc {
 			fmt.Fprint(w, HTML["login"])
 			return
 		}
+		ctx := context.WithValue(r.Context(), vaultKey{}, db)
+		if apiToken != nil {
+			ctx = context.WithValue(ctx, tokenKey{}, apiToken)
+		}
+		fn(w, r.WithContext(ctx))
+	}
+}
+
+// authenticate 根据 API token (如果请求带有 "Authorization: Bearer") 或 session
+// 返回当前用户的 vault, 并推迟自动锁定。使用 session 时 apiToken 为 nil.
+func authenticate(w http.ResponseWriter, r *http.Request) (db *database.DB, apiToken *model.APIToken, ok bool) {
+	token := bearerToken(r)
+	if token == "" {
+		if db, ok = loggedInVault(r); ok {
+			keepAlive(w, r, db)
+		}
+		return db, nil, ok
+	}
+	db, apiToken, err := users.FromToken(token)
+	if err != nil {
+		if err != database.ErrInvalidToken {
+			log.Print(err)
+		}
+		return nil, nil, false
+	}
+	if !db.IsReady() {
+		return nil, nil, false
+	}
+	db.Touch()
+	return db, apiToken, true
+}
+
+// bearerToken 返回请求的 Authorization header 里的 API token, 没有时返回空字符串。
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// tokenOf 返回 checkLogin 放进请求的 API token, 使用 session 的请求返回 nil.
+func tokenOf(r *http.Request) *model.APIToken {
+	apiToken, _ := r.Context().Value(tokenKey{}).(*model.APIToken)
+	return apiToken
+}
+
+// sessionOnly 拒绝使用 API token 的请求，用于管理 API token 等只能在浏览器里进行的操作。
+// 应放在 checkLogin 的里面。
+func sessionOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokenOf(r) != nil {
+			goutil.JsonMessage(w, "Not allowed with an API token", 403)
+			return
+		}
 		fn(w, r)
 	}
 }
 
+// vaultOf 返回 checkLogin 放进请求的 vault, 只能在 checkLogin 里面使用。
+func vaultOf(r *http.Request) *database.DB {
+	return r.Context().Value(vaultKey{}).(*database.DB)
+}
+
 // 限制从前端传输过来的数据大小。
 func setMaxBytes(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes)
 		fn(w, r)
 	}
 }
 
+// 限制批量上传的数据大小。
+func setMaxBatchBytes(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBatchBytes)
+		fn(w, r)
+	}
+}
+
+// withHSTS 要求浏览器今后只通过 HTTPS 访问本站 (仅在启用 HTTPS 时使用)。
+func withHSTS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS 把 HTTP 请求重定向到 HTTPS 地址 (端口采用 cfg.Addr 的端口)。
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host // r.Host 里没有端口
+	}
+	if _, port, err := net.SplitHostPort(cfg.Addr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// loggedInVault 返回 session 所属用户的 vault, 未登入或 vault 未准备好时 ok 为 false.
+func loggedInVault(r *http.Request) (db *database.DB, ok bool) {
+	if !users.Sess.Check(r) {
+		return nil, false
+	}
+	// 例如服务器重启后，尝试用 session 中保存的密钥解锁。
+	db, err := users.FromSession(r)
+	if err != nil {
+		return nil, false
+	}
+	return db, db.IsReady()
+}
+
 func isLoggedIn(r *http.Request) bool {
-	return db.IsReady() && db.Sess.Check(r)
+	_, ok := loggedInVault(r)
+	return ok
+}
+
+// keepAlive 为活跃的 session 续期，并推迟自动锁定。续期失败不影响本次请求。
+func keepAlive(w http.ResponseWriter, r *http.Request, db *database.DB) {
+	db.Touch()
+	if err := users.Sess.Renew(w, r); err != nil {
+		log.Print(err)
+	}
 }
 
-func isLoggedOut(r *http.Request) bool {
-	return !isLoggedIn(r)
+// requirePost 只允许 POST 及 DELETE 请求，用于会改变数据的 API.
+func requirePost(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			goutil.JsonMessage(w, "Method Not Allowed", 405)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// checkCSRF 与 requirePost 相同，并且检查 CSRF token (参考 session.CheckCSRF)。
+// 应放在 checkLogin 及 setMaxBytes 的里面，以便在限制大小之后才读取表单。
+// 使用 API token 的请求不是由浏览器自动发送的，因此不检查 CSRF token, 但需要 admin 权限。
+func checkCSRF(fn http.HandlerFunc) http.HandlerFunc {
+	return checkCSRFOrScope(model.ScopeAdmin, fn)
+}
+
+// checkCSRFOrScope 与 checkCSRF 相同，但使用 API token 时只要求拥有 scope 权限。
+func checkCSRFOrScope(scope string, fn http.HandlerFunc) http.HandlerFunc {
+	return requirePost(func(w http.ResponseWriter, r *http.Request) {
+		if apiToken := tokenOf(r); apiToken != nil {
+			if !apiToken.Allows(scope) {
+				goutil.JsonMessage(w, "The API token does not allow this", 403)
+				return
+			}
+			fn(w, r)
+			return
+		}
+		if !users.Sess.CheckCSRF(r) {
+			goutil.JsonMessage(w, "Invalid CSRF token", 403)
+			return
+		}
+		fn(w, r)
+	})
 }
 
-func checkPasswordTry(w http.ResponseWriter) bool {
-	if passwordTry >= passwordMaxTry {
-		// log.Fatal()
-		db.Reset()
-		jsonMessage(w, "No more try. Input wrong password too many times.", 403)
-		return true
+// clientIP 返回请求来源的 IP. 不信任 X-Forwarded-For 等可伪造的 header,
+// 因此如果放在反向代理后面，全部请求都会被视为来自同一个 IP.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return false
+	return host
 }
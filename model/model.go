@@ -33,8 +33,10 @@ type Reco struct {
 	Tags        []string // []Tag.Name
 	FileName    string   `storm:"index"`
 	FileSize    int64
-	Checksum    string `storm:"unique"` // hex(sha256)
+	Checksum    string `storm:"index"` // hex(sha256)
+	Object      string // Object.Name, 多个 Reco 可共用同一个 Object
 	FileType    string
+	Photo       *Photo // 照片的 EXIF 资料，不是照片或没有 EXIF 时为 nil
 	AccessCount int64
 	AccessedAt  string `storm:"index"` // ISO8601
 	CreatedAt   string `storm:"index"`
@@ -42,6 +44,32 @@ type Reco struct {
 	DeletedAt   string `storm:"index"`
 }
 
+// Photo 是上传照片时从其 EXIF 中读取的资料 (参考 graphics.ReadPhoto)。
+type Photo struct {
+	TakenAt   string // ISO8601, 拍摄时间，可能为空
+	Camera    string // 相机的制造商及型号
+	HasGPS    bool
+	Latitude  float64 // 北纬为正数
+	Longitude float64 // 东经为正数
+}
+
+// TimelineTime 返回用于照片时间线的时间 (ISO8601): 优先使用拍摄时间，没有才使用 CreatedAt.
+func (reco *Reco) TimelineTime() string {
+	if reco.Photo != nil && reco.Photo.TakenAt != "" {
+		return reco.Photo.TakenAt
+	}
+	return reco.CreatedAt
+}
+
+// TimelineDate 返回 TimelineTime 的日期部分 (YYYY-MM-DD)。
+func (reco *Reco) TimelineDate() string {
+	date := reco.TimelineTime()
+	if len(date) > 10 {
+		date = date[:10]
+	}
+	return date
+}
+
 // NewReco .
 func NewReco(recoType RecoType) *Reco {
 	now := util.TimeNow()
@@ -63,7 +91,9 @@ func NewFirstReco() *Reco {
 // NewFile .
 func NewFile(filename string) (*Reco, error) {
 	reco := NewReco(File)
-	reco.SetFileNameType(filename)
+	if err := reco.SetFileNameType(filename); err != nil {
+		return nil, err
+	}
 	return reco, nil
 }
 
@@ -107,6 +137,84 @@ func (reco *Reco) EqualContent(other *Reco) bool {
 	return false
 }
 
+// Object 是 COS 里的一个加密对象，以文件内容的 checksum 命名。
+// 多个 Reco 可以引用同一个 Object, 当 RefCount 归零时才从 COS 里删除。
+type Object struct {
+	Name      string `storm:"id"` // COS 里的对象名
+	Checksum  string `storm:"index"`
+	Box       string // 共享纸箱的 ID, 表示用该纸箱的密钥加密；空字符串表示用 masterKey 加密
+	RefCount  int
+	Previews  []string // 已上传的衍生图片的种类 (参考 database.UploadPreview)
+	CreatedAt string
+
+	// PreviewVersion 是生成衍生图片时的参数的指纹 (参考 graphics.ProfilesVersion),
+	// 参数改变后旧的衍生图片作废。
+	PreviewVersion string
+}
+
+// NewObject .
+func NewObject(name, checksum string) *Object {
+	return &Object{
+		Name:      name,
+		Checksum:  checksum,
+		RefCount:  1,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
+// User 是一个用户，其数据保存在数据库中以用户名命名的 node 里。
+// PublicKey 用来加密分享给该用户的纸箱密钥 (base64), 对应的私钥被 masterKey 加密保存。
+// 第一个用户是管理员，只有管理员可以创建新用户或重新创建已被重置的用户。
+type User struct {
+	Name      string `storm:"id"`
+	PublicKey string
+	Admin     bool
+	CreatedAt string
+}
+
+// NewUser .
+func NewUser(name string) *User {
+	return &User{Name: name, CreatedAt: util.TimeNow()}
+}
+
+// WrappedKey 保存被另一个密钥加密的 masterKey (base64), 除了 firstReco 之外，
+// 还可以用来恢复 masterKey. 例如 ID 为 "recovery" 的记录被恢复码加密。
+type WrappedKey struct {
+	ID        string `storm:"id"`
+	Key       string
+	CreatedAt string
+}
+
+// NewWrappedKey .
+func NewWrappedKey(id, key string) *WrappedKey {
+	return &WrappedKey{
+		ID:        id,
+		Key:       key,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
+// LoginFailure 记录一次失败的登入尝试，用于审计。
+type LoginFailure struct {
+	ID        int    `storm:"id,increment"`
+	User      string `storm:"index"`
+	IP        string `storm:"index"`
+	UserAgent string
+	Reason    string
+	CreatedAt string `storm:"index"` // ISO8601
+}
+
+// NewLoginFailure .
+func NewLoginFailure(user, ip, userAgent, reason string) *LoginFailure {
+	return &LoginFailure{
+		User:      user,
+		IP:        ip,
+		UserAgent: userAgent,
+		Reason:    reason,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
 // Tag .
 type Tag struct {
 	Name    string `storm:"id"`
@@ -189,3 +297,159 @@ func (box *Box) Rename(title string) error {
 	box.UpdatedAt = util.TimeNow()
 	return nil
 }
+
+// 共享纸箱的成员权限。
+const (
+	ReadOnly  = "read"
+	ReadWrite = "write"
+)
+
+// SharedBox 表示一个已共享的纸箱 (ID 与 Box.ID 相同), 保存在纸箱主人的 node 里。
+// 纸箱里的文件用纸箱的密钥加密，该密钥被主人的 masterKey 加密后保存在 OwnerKey,
+// 被各成员的公钥加密后保存在 BoxMember.Key. 每次撤销成员都会更换密钥 (KeyVersion 加一)。
+// 成员在主人未解锁时也能下载文件，所需的云储存设置由服务器密钥加密 (参考 database 包的 shareSettings)。
+type SharedBox struct {
+	ID         string `storm:"id"`
+	KeyVersion int
+	OwnerKey   string // base64
+	CreatedAt  string
+	UpdatedAt  string
+}
+
+// NewSharedBox .
+func NewSharedBox(boxID string) *SharedBox {
+	now := util.TimeNow()
+	return &SharedBox{
+		ID:        boxID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// BoxMember 是共享纸箱的一个成员，保存在纸箱主人的 node 里。
+type BoxMember struct {
+	ID        string `storm:"id"` // BoxID + ":" + User
+	BoxID     string `storm:"index"`
+	User      string `storm:"index"`
+	Perm      string // ReadOnly 或 ReadWrite
+	Key       string // 被成员的公钥加密的纸箱密钥 (base64)
+	CreatedAt string
+}
+
+// NewBoxMember .
+func NewBoxMember(boxID, user, perm string) *BoxMember {
+	return &BoxMember{
+		ID:        boxID + ":" + user,
+		BoxID:     boxID,
+		User:      user,
+		Perm:      perm,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
+// CanWrite 判断成员能否向纸箱添加文件。
+func (member *BoxMember) CanWrite() bool {
+	return member.Perm == ReadWrite
+}
+
+// ShareLink 是一个公开的分享链接，任何人凭链接 (及密码) 即可下载一个文件，不需要登入。
+// 保存在全部用户共用的 node 里，因为打开链接时还不知道是哪个用户。
+// 与 session 一样，只保存链接中 secret 的 hash, 不保存原始 secret.
+type ShareLink struct {
+	ID           string `storm:"id"` // hex(sha256(secret))
+	Owner        string `storm:"index"`
+	RecoID       string `storm:"index"`
+	FileName     string
+	Object       string // 该链接专用的文件副本在 COS 里的对象名
+	Key          string // 被由 secret 及密码派生的密钥加密的文件副本的密钥 (base64)
+	Salt         string // 派生密钥所用的 salt (base64)
+	HasPassword  bool
+	MaxDownloads int // 0 表示不限次数
+	Downloads    int
+	ExpiresAt    int64 // Unix time, 同时包含在链接的签名中
+	CreatedAt    string
+}
+
+// NewShareLink .
+func NewShareLink(id, owner string, reco *Reco, expiresAt int64, maxDownloads int) *ShareLink {
+	return &ShareLink{
+		ID:           id,
+		Owner:        owner,
+		RecoID:       reco.ID,
+		FileName:     reco.FileName,
+		MaxDownloads: maxDownloads,
+		ExpiresAt:    expiresAt,
+		CreatedAt:    util.TimeNow(),
+	}
+}
+
+// Expired 判断链接在 now (Unix time) 时是否已过期。
+func (link *ShareLink) Expired(now int64) bool {
+	return now >= link.ExpiresAt
+}
+
+// UsedUp 判断链接的下载次数是否已用完。
+func (link *ShareLink) UsedUp() bool {
+	return link.MaxDownloads > 0 && link.Downloads >= link.MaxDownloads
+}
+
+// LinkAccess 记录通过分享链接的一次下载尝试，用于审计。
+type LinkAccess struct {
+	ID        int    `storm:"id,increment"`
+	LinkID    string `storm:"index"`
+	IP        string
+	UserAgent string
+	Result    string // 成功时为 "ok", 否则是失败的原因
+	CreatedAt string `storm:"index"` // ISO8601
+}
+
+// NewLinkAccess .
+func NewLinkAccess(linkID, ip, userAgent, result string) *LinkAccess {
+	return &LinkAccess{
+		LinkID:    linkID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Result:    result,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
+// API token 的权限，后者包含前者的全部权限。
+const (
+	ScopeRead   = "read"   // 只能读取及下载
+	ScopeUpload = "upload" // 还可以上传文件
+	ScopeAdmin  = "admin"  // 可以使用全部 API
+)
+
+var scopeLevels = map[string]int{ScopeRead: 1, ScopeUpload: 2, ScopeAdmin: 3}
+
+// IsValidScope .
+func IsValidScope(scope string) bool {
+	return scopeLevels[scope] > 0
+}
+
+// APIToken 让脚本等非浏览器的客户端通过 "Authorization: Bearer" 使用 API,
+// 保存在用户自己的 node 里。与 session 一样，只保存 token 的 hash, 不保存原始 token.
+type APIToken struct {
+	ID        string `storm:"id"` // hex(sha256(token))
+	Name      string
+	Scope     string
+	Key       string // 被由 token 派生的密钥加密的 masterKey (base64)
+	CreatedAt string
+	LastUsed  int64 // Unix time, 0 表示从未使用
+}
+
+// NewAPIToken .
+func NewAPIToken(id, name, scope string) *APIToken {
+	return &APIToken{
+		ID:        id,
+		Name:      name,
+		Scope:     scope,
+		CreatedAt: util.TimeNow(),
+	}
+}
+
+// Allows 判断该 token 是否拥有 scope 所需的权限。
+func (token *APIToken) Allows(scope string) bool {
+	return scopeLevels[token.Scope] >= scopeLevels[scope]
+}
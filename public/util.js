@@ -1,5 +1,14 @@
 const thumbWidth = 128, thumbHeight = 128;
 
+// 登入时服务器把 CSRF token 放在这个 cookie 里，会改变数据的请求都要带上它。
+const csrfCookie = 'RecoitCSRF', csrfHeader = 'X-CSRF-Token';
+
+// 从 cookie 中读取 CSRF token.
+function csrfToken() {
+  let cookie = document.cookie.split('; ').find(c => c.startsWith(csrfCookie + '='));
+  return cookie ? cookie.slice(csrfCookie.length + 1) : '';
+}
+
 // 向服务器提交表单，在等待过程中 btn 会失效，避免重复提交。
 function ajaxPost(form, url, btn, onloadHandler) {
   if (btn) {
@@ -9,6 +18,7 @@ function ajaxPost(form, url, btn, onloadHandler) {
 
   xhr.responseType = 'json';
   xhr.open('POST', url);
+  xhr.setRequestHeader(csrfHeader, csrfToken());
 
   xhr.onerror = function () {
     window.alert('An error occurred during the transaction');
@@ -37,6 +47,7 @@ function ajaxPostWithSpinner(form, url, button_name, onloadHandler) {
   xhr.responseType = 'json';
 
   xhr.open('POST', url);
+  xhr.setRequestHeader(csrfHeader, csrfToken());
   xhr.onerror = function () {
     window.alert('An error occurred during the transaction');
   };
@@ -185,6 +196,15 @@ function tempURL(id) {
   return '/temp/' + id + '.reco';
 }
 
+// 直接下载原文件的url, params 是附加的参数 (例如 {download: 1})。
+function streamURL(id, params) {
+  let url = '/api/stream/' + id;
+  if (params) {
+    url += '?' + new URLSearchParams(params).toString();
+  }
+  return url;
+}
+
 // 带时间的url, 用于刷新文件。
 function urlWithDate(originURL) {
   let d = new Date();
@@ -0,0 +1,78 @@
+/*
+Package sealbox 用接收者的公钥 (X25519) 加密数据，只有持有对应私钥的人才能解密。
+用于把共享纸箱的密钥分发给各个成员。
+*/
+package sealbox
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// KeySize 是公钥及私钥的长度。
+	KeySize   = 32
+	nonceSize = 24
+)
+
+// ErrOpen 表示解密失败 (私钥不对或数据已被篡改)。
+var ErrOpen = errors.New("sealbox: message authentication failed")
+
+// GenerateKey 随机生成一对公钥及私钥。
+func GenerateKey() (publicKey, privateKey []byte) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return pub[:], priv[:]
+}
+
+// Seal 用 publicKey 加密 message. 每次都生成一对临时的密钥，
+// 结果由临时公钥、nonce 及密文组成，因此不需要发送者的密钥。
+func Seal(message, publicKey []byte) ([]byte, error) {
+	peer, err := toKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub, ephemeralPriv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	out := append(ephemeralPub[:], nonce[:]...)
+	return box.Seal(out, message, &nonce, peer, ephemeralPriv), nil
+}
+
+// Open 用 privateKey 解密由 Seal 生成的 sealed.
+func Open(sealed, privateKey []byte) ([]byte, error) {
+	priv, err := toKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < KeySize+nonceSize+box.Overhead {
+		return nil, ErrOpen
+	}
+	var ephemeralPub [KeySize]byte
+	var nonce [nonceSize]byte
+	copy(ephemeralPub[:], sealed[:KeySize])
+	copy(nonce[:], sealed[KeySize:KeySize+nonceSize])
+	message, ok := box.Open(nil, sealed[KeySize+nonceSize:], &nonce, &ephemeralPub, priv)
+	if !ok {
+		return nil, ErrOpen
+	}
+	return message, nil
+}
+
+func toKey(b []byte) (*[KeySize]byte, error) {
+	if len(b) != KeySize {
+		return nil, errors.New("sealbox: wrong key size")
+	}
+	key := new([KeySize]byte)
+	copy(key[:], b)
+	return key, nil
+}
@@ -0,0 +1,35 @@
+package sealbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	pub, priv := GenerateKey()
+	_, otherPriv := GenerateKey()
+	message := []byte("box key")
+
+	sealed, err := Seal(message, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := Open(sealed, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, message) {
+		t.Fatalf("got %q, want %q", opened, message)
+	}
+
+	if _, err := Open(sealed, otherPriv); err != ErrOpen {
+		t.Errorf("open with another key: got %v, want ErrOpen", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Open(sealed, priv); err != ErrOpen {
+		t.Errorf("open tampered message: got %v, want ErrOpen", err)
+	}
+	if _, err := Open(sealed[:10], priv); err != ErrOpen {
+		t.Errorf("open short message: got %v, want ErrOpen", err)
+	}
+}
@@ -0,0 +1,70 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// CSRF token 由 sid 派生，不需要额外保存。登入时随 session 一起发给浏览器，
+// 保存在一个前端 JS 可以读取的 cookie 中 (非 HttpOnly), 前端发送请求时
+// 再把它放进 CSRFHeader. 其他网站无法读取该 cookie, 因此无法伪造请求。
+const (
+	CSRFCookie = "RecoitCSRF"
+	CSRFHeader = "X-CSRF-Token"
+	CSRFField  = "csrf-token" // 不方便设置 header 时，也可以放在表单中
+)
+
+func csrfToken(sid string) string {
+	mac := hmac.New(sha256.New, []byte(sid))
+	mac.Write([]byte("recoit-csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (manager *Manager) newCSRFCookie(sid string) http.Cookie {
+	cookie := manager.newCookie("")
+	cookie.Name = CSRFCookie
+	cookie.HttpOnly = false
+	if sid != "" {
+		cookie.Value = csrfToken(sid)
+	}
+	return cookie
+}
+
+// setCookies 设置 session cookie 及 CSRF cookie, sid 为空时使两者都过期。
+func (manager *Manager) setCookies(w http.ResponseWriter, sid string) {
+	cookie := manager.newCookie(sid)
+	csrf := manager.newCSRFCookie(sid)
+	if sid == "" {
+		cookie.MaxAge = -1
+		csrf.MaxAge = -1
+	}
+	http.SetCookie(w, &cookie)
+	http.SetCookie(w, &csrf)
+}
+
+// CSRFToken 返回请求中的 session 对应的 CSRF token.
+func (manager *Manager) CSRFToken(r *http.Request) (string, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	sid, _, ok := manager.get(r)
+	if !ok {
+		return "", ErrNoSession
+	}
+	return csrfToken(sid), nil
+}
+
+// CheckCSRF 检查请求中的 CSRF token (优先读取 CSRFHeader, 其次是表单中的 CSRFField)
+// 是否与 session 对应。
+func (manager *Manager) CheckCSRF(r *http.Request) bool {
+	want, err := manager.CSRFToken(r)
+	if err != nil {
+		return false
+	}
+	got := r.Header.Get(CSRFHeader)
+	if got == "" {
+		got = r.FormValue(CSRFField)
+	}
+	return hmac.Equal([]byte(got), []byte(want))
+}
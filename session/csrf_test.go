@@ -0,0 +1,60 @@
+package session
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	manager := NewManager(60)
+	r := login(t, manager, nil)
+	token, err := manager.CSRFToken(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrfCookie, err := r.Cookie(CSRFCookie)
+	if err != nil || csrfCookie.Value != token {
+		t.Fatalf("the csrf cookie should hold the token, got %v", csrfCookie)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		field  string
+		ok     bool
+	}{
+		{"header", token, "", true},
+		{"form field", "", token, true},
+		{"missing", "", "", false},
+		{"wrong", "x" + token[1:], "", false},
+	}
+	for _, tt := range tests {
+		form := url.Values{CSRFField: {tt.field}}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range r.Cookies() {
+			req.AddCookie(cookie)
+		}
+		if tt.header != "" {
+			req.Header.Set(CSRFHeader, tt.header)
+		}
+		if got := manager.CheckCSRF(req); got != tt.ok {
+			t.Errorf("%s: CheckCSRF() = %v; want %v", tt.name, got, tt.ok)
+		}
+	}
+
+	// 其他 session 的 token 无效
+	other := login(t, manager, nil)
+	req := httptest.NewRequest("POST", "/", nil)
+	for _, cookie := range other.Cookies() {
+		if cookie.Name == SessionID {
+			req.AddCookie(cookie)
+		}
+	}
+	req.Header.Set(CSRFHeader, token)
+	if manager.CheckCSRF(req) {
+		t.Error("a token of another session should not be valid")
+	}
+}
@@ -1,68 +1,340 @@
 package session
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/recoit/aesgcm"
 )
 
 // SessionID 是 session 在 cookie 中的 name.
 const SessionID = "RecoitSessionID"
 
-// Manager 是 session manager.
+// sidSize 是 session id 的字节数 (编码前)。
+const sidSize = 32
+
+// ErrNoSession 表示请求中没有有效的 session.
+var ErrNoSession = errors.New("no valid session")
+
+// Session 是保存在服务器端的 session.
+// 为了避免数据库泄露时 session 被盗用，只保存 sid 的 hash, 不保存原始 sid.
+type Session struct {
+	ID        string `storm:"id"` // hex(sha256(sid))
+	User      string `storm:"index"`
+	Data      []byte // 用由 sid 派生的密钥加密的数据
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func (sess *Session) expired(now time.Time) bool {
+	return now.After(sess.ExpiresAt)
+}
+
+// Store 用来持久化 session, 使服务器重启后不需要重新登入。
+type Store interface {
+	Save(sess *Session) error
+	Delete(id string) error
+	All() ([]Session, error)
+}
+
+// Manager 是 session manager, 可在多个 goroutine 中同时使用。
 type Manager struct {
-	store  map[string]bool
-	name   string
-	maxAge int
+	mu       sync.Mutex
+	sessions map[string]*Session // key 是 Session.ID
+	store    Store               // 可以为 nil, 此时 session 只保存在内存中
+	name     string
+	maxAge   int
+	secure   bool
+	done     chan struct{}
 }
 
 // NewManager .
 func NewManager(maxAge int) *Manager {
 	return &Manager{
-		store:  make(map[string]bool),
-		name:   SessionID,
-		maxAge: maxAge,
+		sessions: make(map[string]*Session),
+		name:     SessionID,
+		maxAge:   maxAge,
+		done:     make(chan struct{}),
 	}
 }
 
-func (manager *Manager) newSession(sid string) http.Cookie {
+// SetSecure 设置 cookie 的 Secure 属性，启用 HTTPS 时应设为 true,
+// 使浏览器只通过 HTTPS 发送 session.
+func (manager *Manager) SetSecure(secure bool) {
+	manager.secure = secure
+}
+
+// SetStore 设置用来持久化 session 的 store, 并导入 store 中未过期的 session.
+func (manager *Manager) SetStore(store Store) error {
+	all, err := store.All()
+	if err != nil {
+		return err
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.store = store
+	now := time.Now()
+	for i := range all {
+		sess := all[i]
+		if sess.expired(now) {
+			manager.deleteFromStore(sess.ID)
+			continue
+		}
+		manager.sessions[sess.ID] = &sess
+	}
+	return nil
+}
+
+func (manager *Manager) newCookie(sid string) http.Cookie {
 	return http.Cookie{
 		Name:     manager.name,
 		Value:    sid,
 		Path:     "/", // important
 		MaxAge:   manager.maxAge,
 		HttpOnly: true,
+		Secure:   manager.secure,
 		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-// Add adds a new sid into manager.store.
-func (manager *Manager) Add(w http.ResponseWriter, sid string) {
-	session := manager.newSession(sid)
-	http.SetCookie(w, &session)
-	manager.store[sid] = true
+// Add 为用户 user 新建一个 session 并设置 cookie.
+// data 会用由 sid 派生的密钥加密后保存在 session 中 (data 可以为 nil),
+// 因此只有持有该 cookie 的请求才能通过 Data 取回 data.
+func (manager *Manager) Add(w http.ResponseWriter, user string, data []byte) error {
+	sid := newSID()
+	now := time.Now()
+	sess := &Session{
+		ID:        hashSID(sid),
+		User:      user,
+		CreatedAt: now,
+		ExpiresAt: now.Add(manager.duration()),
+	}
+	if data != nil {
+		sess.Data = aesgcm.NewGCM(sessionKey(sid)).Encrypt(data)
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if manager.store != nil {
+		if err := manager.store.Save(sess); err != nil {
+			return err
+		}
+	}
+	manager.sessions[sess.ID] = sess
+	manager.setCookies(w, sid)
+	return nil
+}
+
+func (manager *Manager) duration() time.Duration {
+	return time.Duration(manager.maxAge) * time.Second
+}
+
+// get 返回请求中的 sid 及对应的有效 session, 调用者必须持有 manager.mu.
+func (manager *Manager) get(r *http.Request) (string, *Session, bool) {
+	cookie, err := r.Cookie(manager.name)
+	if err != nil || cookie.Value == "" {
+		return "", nil, false
+	}
+	sess, ok := manager.sessions[hashSID(cookie.Value)]
+	if !ok || sess.expired(time.Now()) {
+		return "", nil, false
+	}
+	return cookie.Value, sess, true
 }
 
 // Check 检查 session 的有效性，有效时返回 true.
 func (manager *Manager) Check(r *http.Request) bool {
-	cookie, err := r.Cookie(manager.name)
-	if err != nil || cookie.Value == "" || !manager.store[cookie.Value] {
-		return false
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	_, _, ok := manager.get(r)
+	return ok
+}
+
+// User 返回 session 所属的用户。
+func (manager *Manager) User(r *http.Request) (string, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	_, sess, ok := manager.get(r)
+	if !ok {
+		return "", ErrNoSession
+	}
+	return sess.User, nil
+}
+
+// Data 返回 session 中解密后的 data.
+func (manager *Manager) Data(r *http.Request) ([]byte, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	sid, sess, ok := manager.get(r)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	if sess.Data == nil {
+		return nil, errors.New("no data in the session")
+	}
+	return aesgcm.NewGCM(sessionKey(sid)).Decrypt(sess.Data)
+}
+
+// Renew 实现滑动续期：当 session 的剩余有效期少于一半时，重新计算有效期并更新 cookie.
+// (不在每次请求都续期，以免频繁写入 store.)
+func (manager *Manager) Renew(w http.ResponseWriter, r *http.Request) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	sid, sess, ok := manager.get(r)
+	if !ok {
+		return ErrNoSession
 	}
-	return true
+	now := time.Now()
+	if sess.ExpiresAt.Sub(now) > manager.duration()/2 {
+		return nil
+	}
+	renewed := *sess
+	renewed.ExpiresAt = now.Add(manager.duration())
+	if manager.store != nil {
+		if err := manager.store.Save(&renewed); err != nil {
+			return err
+		}
+	}
+	*sess = renewed
+	manager.setCookies(w, sid)
+	return nil
 }
 
-// DeleteSID 同时删除 manager.store 中的 sid 并使 session 过期。
+// DeleteSID 同时删除 manager 中的 session 并使 cookie (包括 CSRF cookie) 过期。
 func (manager *Manager) DeleteSID(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie(manager.name)
 	if err == nil {
-		manager.store[cookie.Value] = false
+		manager.mu.Lock()
+		id := hashSID(cookie.Value)
+		delete(manager.sessions, id)
+		manager.deleteFromStore(id)
+		manager.mu.Unlock()
 	}
-	session := http.Cookie{
-		Name:     manager.name,
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
+	manager.setCookies(w, "")
+}
+
+// DeleteAll 删除全部 session, 使全部设备都需要重新登入。
+func (manager *Manager) DeleteAll() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for id := range manager.sessions {
+		delete(manager.sessions, id)
+		manager.deleteFromStore(id)
+	}
+}
+
+// DeleteUser 删除用户 user 的全部 session, 使该用户的全部设备都需要重新登入。
+func (manager *Manager) DeleteUser(user string) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	for id, sess := range manager.sessions {
+		if sess.User == user {
+			delete(manager.sessions, id)
+			manager.deleteFromStore(id)
+		}
+	}
+}
+
+// Count 返回有效 session 的数量。
+func (manager *Manager) Count() int {
+	return manager.count(func(*Session) bool { return true })
+}
+
+// CountUser 返回用户 user 的有效 session 的数量。
+func (manager *Manager) CountUser(user string) int {
+	return manager.count(func(sess *Session) bool { return sess.User == user })
+}
+
+func (manager *Manager) count(match func(*Session) bool) int {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, sess := range manager.sessions {
+		if !sess.expired(now) && match(sess) {
+			n++
+		}
+	}
+	return n
+}
+
+// Cleanup 删除全部已过期的 session, 返回删除的数量。
+func (manager *Manager) Cleanup() int {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for id, sess := range manager.sessions {
+		if sess.expired(now) {
+			delete(manager.sessions, id)
+			manager.deleteFromStore(id)
+			n++
+		}
+	}
+	return n
+}
+
+// StartCleanup 每隔 interval 执行一次 Cleanup, 直到 Close.
+// onCleanup 在每次 Cleanup 之后被调用 (可以为 nil)。
+func (manager *Manager) StartCleanup(interval time.Duration, onCleanup func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				manager.Cleanup()
+				if onCleanup != nil {
+					onCleanup()
+				}
+			case <-manager.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close 停止 StartCleanup 启动的 goroutine.
+func (manager *Manager) Close() {
+	select {
+	case <-manager.done:
+	default:
+		close(manager.done)
+	}
+}
+
+// deleteFromStore 调用者必须持有 manager.mu. 删除失败只记录下来，
+// 因为该 session 已从内存中删除，而导入 store 时会忽略已过期的 session.
+func (manager *Manager) deleteFromStore(id string) {
+	if manager.store == nil {
+		return
+	}
+	if err := manager.store.Delete(id); err != nil {
+		log.Printf("failed to delete session: %v", err)
+	}
+}
+
+func newSID() string {
+	b := make([]byte, sidSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
-	http.SetCookie(w, &session)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashSID(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionKey 由 sid 派生用来加密 Session.Data 的密钥，与 hashSID 的结果不同。
+func sessionKey(sid string) []byte {
+	return aesgcm.Sha256("recoit-session-key:" + sid)
 }
@@ -0,0 +1,174 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore 是用于测试的 Store.
+type memStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func (s *memStore) Save(sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.ID] = *sess
+	return nil
+}
+
+func (s *memStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memStore) All() (all []Session, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		all = append(all, sess)
+	}
+	return
+}
+
+// login 为 alice 新建一个 session, 返回带有该 session cookie 的请求。
+func login(t *testing.T, manager *Manager, data []byte) *http.Request {
+	return loginAs(t, manager, "alice", data)
+}
+
+func loginAs(t *testing.T, manager *Manager, user string, data []byte) *http.Request {
+	w := httptest.NewRecorder()
+	if err := manager.Add(w, user, data); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return r
+}
+
+func TestSessionData(t *testing.T) {
+	manager := NewManager(60)
+	r := login(t, manager, []byte("secret"))
+	if !manager.Check(r) {
+		t.Fatal("session should be valid")
+	}
+	data, err := manager.Data(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("got %q; want %q", data, "secret")
+	}
+
+	// 没有 cookie 的请求
+	if manager.Check(httptest.NewRequest("GET", "/", nil)) {
+		t.Error("a request without cookie should not be valid")
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	manager := NewManager(60)
+	r := login(t, manager, nil)
+	for _, sess := range manager.sessions {
+		sess.ExpiresAt = time.Now().Add(-time.Second)
+	}
+	if manager.Check(r) {
+		t.Error("an expired session should not be valid")
+	}
+	if n := manager.Cleanup(); n != 1 {
+		t.Errorf("cleanup: got %d; want 1", n)
+	}
+}
+
+func TestSessionRenew(t *testing.T) {
+	manager := NewManager(60)
+	r := login(t, manager, nil)
+	var sess *Session
+	for _, s := range manager.sessions {
+		sess = s
+	}
+
+	// 剩余有效期超过一半时不续期
+	w := httptest.NewRecorder()
+	if err := manager.Renew(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("should not renew a fresh session")
+	}
+
+	sess.ExpiresAt = time.Now().Add(10 * time.Second)
+	w = httptest.NewRecorder()
+	if err := manager.Renew(w, r); err != nil {
+		t.Fatal(err)
+	}
+	renewed := false
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == SessionID && cookie.MaxAge == 60 {
+			renewed = true
+		}
+	}
+	if !renewed {
+		t.Error("should set a new cookie when renewing")
+	}
+	if sess.ExpiresAt.Sub(time.Now()) < 50*time.Second {
+		t.Error("ExpiresAt should be extended")
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	store := &memStore{sessions: make(map[string]Session)}
+	manager := NewManager(60)
+	if err := manager.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	r := login(t, manager, []byte("secret"))
+
+	// 模拟服务器重启
+	restarted := NewManager(60)
+	if err := restarted.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	data, err := restarted.Data(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "secret" {
+		t.Errorf("got %q; want %q", data, "secret")
+	}
+
+	restarted.DeleteSID(httptest.NewRecorder(), r)
+	if restarted.Check(r) || len(store.sessions) != 0 {
+		t.Error("the session should be deleted from both manager and store")
+	}
+}
+
+func TestSessionUser(t *testing.T) {
+	manager := NewManager(60)
+	alice := loginAs(t, manager, "alice", nil)
+	loginAs(t, manager, "alice", nil)
+	bob := loginAs(t, manager, "bob", nil)
+
+	if user, err := manager.User(bob); err != nil || user != "bob" {
+		t.Errorf("User() = %q, %v; want bob", user, err)
+	}
+	if n := manager.CountUser("alice"); n != 2 {
+		t.Errorf("CountUser(alice) = %d; want 2", n)
+	}
+
+	manager.DeleteUser("alice")
+	if manager.Check(alice) {
+		t.Error("alice's sessions should be deleted")
+	}
+	if !manager.Check(bob) {
+		t.Error("bob's session should not be affected")
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Package throttle 限制登入尝试的频率，防止暴力破解密码。
+
+每个来源 (IP 与所尝试的账号的组合) 及全局各有一个失败计数：
+
+  - 每次失败后，该来源需要等待一段时间才能再次尝试，等待时间每次加倍 (指数退避)。
+  - 连续失败 MaxTry 次后锁定该来源 Lockout 时间。
+  - 全部来源合计连续失败 GlobalMaxTry 次后，锁定全部来源 (应对分布式的尝试)。
+  - 成功登入后只清除该来源的计数。全局计数及同一 IP 对其他账号的计数不会被清除，
+    否则拥有账号的人可以在每次猜测别人的密码之间登入自己的账号，使计数永远归零。
+
+记录可以保存在 Store 中，使锁定期在服务器重启后仍然有效。
+*/
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// globalKey 是全局计数在 records 中的 key.
+const globalKey = "*"
+
+// Record 记录一个来源 (或全局) 的失败次数及锁定期限。
+type Record struct {
+	Key         string `storm:"id"` // 参考 sourceKey, 或 globalKey
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store 用来持久化 Record, 使锁定期在服务器重启后仍然有效。
+type Store interface {
+	Save(rec *Record) error
+	Delete(key string) error
+	All() ([]Record, error)
+}
+
+// Options 是 Limiter 的设置。
+type Options struct {
+	MaxTry       int           // 每个来源最多可连续失败几次
+	GlobalMaxTry int           // 全部来源合计最多可连续失败几次，0 表示不限
+	BaseDelay    time.Duration // 第一次失败后的等待时间，之后每次加倍
+	MaxDelay     time.Duration // 等待时间的上限
+	Lockout      time.Duration // 锁定时间，超过该时间没有失败的记录也会被清除
+}
+
+// Limiter 可在多个 goroutine 中同时使用。
+type Limiter struct {
+	mu      sync.Mutex
+	opts    Options
+	records map[string]*Record
+	store   Store // 可以为 nil, 此时记录只保存在内存中
+	now     func() time.Time
+}
+
+// New .
+func New(opts Options) *Limiter {
+	return &Limiter{
+		opts:    opts,
+		records: make(map[string]*Record),
+		now:     time.Now,
+	}
+}
+
+// SetStore 设置 store, 并读取其中未过期的记录。
+func (l *Limiter) SetStore(store Store) error {
+	all, err := store.All()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+	now := l.now()
+	for i := range all {
+		rec := all[i]
+		if l.stale(&rec, now) {
+			if err := store.Delete(rec.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		l.records[rec.Key] = &rec
+	}
+	return nil
+}
+
+// sourceKey 返回来源的 key. account 是所尝试的账号，可以为空 (只按 IP 计数)。
+func sourceKey(ip, account string) string {
+	if account == "" {
+		return ip
+	}
+	return account + "@" + ip
+}
+
+// Allow 检查 ip 现在是否可以尝试登入账号 account, 不可以时返回需要等待的时间。
+func (l *Limiter) Allow(ip, account string) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	// 全局计数只用于锁定，不退避，以免一个来源的失败拖慢全部来源。
+	if rec := l.get(globalKey, now); rec != nil && now.Before(rec.LockedUntil) {
+		wait = rec.LockedUntil.Sub(now)
+	}
+	if w := l.wait(l.get(sourceKey(ip, account), now), now); w > wait {
+		wait = w
+	}
+	return wait, wait == 0
+}
+
+// Fail 记录 ip 登入账号 account 的一次失败。
+func (l *Limiter) Fail(ip, account string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if err := l.fail(sourceKey(ip, account), l.opts.MaxTry, now); err != nil {
+		return err
+	}
+	if l.opts.GlobalMaxTry <= 0 {
+		return nil
+	}
+	return l.fail(globalKey, l.opts.GlobalMaxTry, now)
+}
+
+// Succeed 在成功登入后只清除 ip 对账号 account 的记录 (参考本 package 的说明)。
+func (l *Limiter) Succeed(ip, account string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.delete(sourceKey(ip, account))
+}
+
+func (l *Limiter) fail(key string, maxTry int, now time.Time) error {
+	rec := l.get(key, now)
+	if rec == nil {
+		rec = &Record{Key: key}
+		l.records[key] = rec
+	}
+	rec.Failures++
+	rec.LastFailure = now
+	if maxTry > 0 && rec.Failures >= maxTry {
+		rec.LockedUntil = now.Add(l.opts.Lockout)
+		rec.Failures = 0
+	}
+	if l.store != nil {
+		return l.store.Save(rec)
+	}
+	return nil
+}
+
+// get 返回 key 的记录，如果记录已过期则删除并返回 nil.
+func (l *Limiter) get(key string, now time.Time) *Record {
+	rec, ok := l.records[key]
+	if !ok {
+		return nil
+	}
+	if l.stale(rec, now) {
+		_ = l.delete(key) // 删除失败不要紧，下次读取时会再次删除。
+		return nil
+	}
+	return rec
+}
+
+func (l *Limiter) delete(key string) error {
+	if _, ok := l.records[key]; !ok {
+		return nil
+	}
+	delete(l.records, key)
+	if l.store != nil {
+		return l.store.Delete(key)
+	}
+	return nil
+}
+
+// stale 判断记录是否已不再需要：不在锁定期内，并且最后一次失败已超过 Lockout.
+func (l *Limiter) stale(rec *Record, now time.Time) bool {
+	return !now.Before(rec.LockedUntil) && now.Sub(rec.LastFailure) > l.opts.Lockout
+}
+
+// wait 返回 rec 还需要等待的时间。
+func (l *Limiter) wait(rec *Record, now time.Time) time.Duration {
+	if rec == nil {
+		return 0
+	}
+	if now.Before(rec.LockedUntil) {
+		return rec.LockedUntil.Sub(now)
+	}
+	if rec.Failures == 0 {
+		return 0
+	}
+	if w := rec.LastFailure.Add(l.delay(rec.Failures)).Sub(now); w > 0 {
+		return w
+	}
+	return 0
+}
+
+// delay 返回失败 n 次后的等待时间: BaseDelay * 2^(n-1), 不超过 MaxDelay.
+func (l *Limiter) delay(n int) time.Duration {
+	d := l.opts.BaseDelay
+	for i := 1; i < n && d < l.opts.MaxDelay; i++ {
+		d *= 2
+	}
+	if l.opts.MaxDelay > 0 && d > l.opts.MaxDelay {
+		d = l.opts.MaxDelay
+	}
+	return d
+}
@@ -0,0 +1,176 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+type memStore map[string]Record
+
+func (store memStore) Save(rec *Record) error {
+	store[rec.Key] = *rec
+	return nil
+}
+
+func (store memStore) Delete(key string) error {
+	delete(store, key)
+	return nil
+}
+
+func (store memStore) All() (all []Record, err error) {
+	for _, rec := range store {
+		all = append(all, rec)
+	}
+	return
+}
+
+var testOptions = Options{
+	MaxTry:       3,
+	GlobalMaxTry: 5,
+	BaseDelay:    time.Second,
+	MaxDelay:     10 * time.Second,
+	Lockout:      time.Hour,
+}
+
+func newTestLimiter(now *time.Time) *Limiter {
+	l := New(testOptions)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestBackoff(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, time.Hour}, // 锁定
+	}
+	for _, tt := range tests {
+		if _, ok := l.Allow("a", "alice"); !ok {
+			t.Fatalf("failures %d: should be allowed before failing", tt.failures)
+		}
+		if err := l.Fail("a", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		wait, ok := l.Allow("a", "alice")
+		if ok || wait != tt.wait {
+			t.Errorf("failures %d: wait = %v, %v; want %v, false", tt.failures, wait, ok, tt.wait)
+		}
+		now = now.Add(wait)
+	}
+	if _, ok := l.Allow("b", "alice"); !ok {
+		t.Error("other ip should not be affected")
+	}
+}
+
+func TestDelayLimit(t *testing.T) {
+	l := New(testOptions)
+	if d := l.delay(10); d != testOptions.MaxDelay {
+		t.Errorf("delay(10) = %v; want %v", d, testOptions.MaxDelay)
+	}
+}
+
+func TestGlobalLockout(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+	for _, ip := range []string{"a", "b", "c", "d", "e"} {
+		if err := l.Fail(ip, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, ok := l.Allow("f", "bob"); ok || wait != time.Hour {
+		t.Errorf("global lockout: wait = %v, %v; want 1h, false", wait, ok)
+	}
+}
+
+func TestSucceed(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+	if err := l.Fail("a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Succeed("a", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Allow("a", "alice"); !ok {
+		t.Error("should be allowed after success")
+	}
+}
+
+// 成功登入自己的账号不能清除对其他账号的失败计数及全局计数。
+func TestSucceedKeepsOtherRecords(t *testing.T) {
+	now := time.Now()
+	l := newTestLimiter(&now)
+	for i := 1; i < testOptions.GlobalMaxTry; i++ {
+		if err := l.Fail("a", "alice"); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Succeed("a", "mallory"); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(testOptions.MaxDelay)
+	}
+	if _, ok := l.Allow("a", "alice"); ok {
+		t.Error("logging in to another account should not reset the lockout")
+	}
+	if err := l.Fail("a", "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, ok := l.Allow("z", "carol"); ok || wait != time.Hour {
+		t.Errorf("the global counter should not be reset: wait = %v, %v", wait, ok)
+	}
+}
+
+func TestNoGlobalLimit(t *testing.T) {
+	now := time.Now()
+	opts := testOptions
+	opts.GlobalMaxTry = 0
+	l := New(opts)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 10; i++ {
+		if err := l.Fail(string(rune('a'+i)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := l.Allow("z", ""); !ok {
+		t.Error("without GlobalMaxTry other sources should not be locked")
+	}
+}
+
+func TestStore(t *testing.T) {
+	now := time.Now()
+	store := make(memStore)
+	l := newTestLimiter(&now)
+	if err := l.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testOptions.MaxTry; i++ {
+		if err := l.Fail("a", "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 模拟服务器重启
+	l2 := newTestLimiter(&now)
+	if err := l2.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l2.Allow("a", "alice"); ok {
+		t.Error("lockout should survive a restart")
+	}
+
+	// 锁定期过后，记录会被清除
+	now = now.Add(2 * time.Hour)
+	l3 := newTestLimiter(&now)
+	if err := l3.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l3.Allow("a", "alice"); !ok || len(store) != 0 {
+		t.Errorf("stale records should be deleted, got %d", len(store))
+	}
+}
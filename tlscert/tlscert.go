@@ -0,0 +1,92 @@
+/*
+Package tlscert 生成并保存自签名证书，以便在没有提供证书时也能启用 HTTPS.
+*/
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// validFor 是自签名证书的有效期。
+const validFor = 10 * 365 * 24 * time.Hour
+
+// EnsureSelfSigned 如果 certFile 或 keyFile 不存在，就为 hosts 生成一对自签名证书并保存，
+// 否则不进行任何操作 (因此浏览器只需要信任一次该证书)。
+// hosts 可以是域名或 IP.
+func EnsureSelfSigned(certFile, keyFile string, hosts []string) error {
+	if fileExists(certFile) && fileExists(keyFile) {
+		return nil
+	}
+	certPEM, keyPEM, err := Generate(hosts)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(keyFile, keyPEM); err != nil {
+		return err
+	}
+	return writeFile(certFile, certPEM)
+}
+
+// Generate 为 hosts 生成一对自签名证书 (PEM 格式)。
+func Generate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"recoit"}},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func writeFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0600)
+}
@@ -0,0 +1,50 @@
+package tlscert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recoit-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	hosts := []string{"127.0.0.1", "localhost"}
+	if err := EnsureSelfSigned(certFile, keyFile, hosts); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	// 已存在证书时不可覆盖。
+	before, _ := ioutil.ReadFile(certFile)
+	if err := EnsureSelfSigned(certFile, keyFile, hosts); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := ioutil.ReadFile(certFile)
+	if !bytes.Equal(before, after) {
+		t.Error("the existing certificate should not be overwritten")
+	}
+}
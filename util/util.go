@@ -3,7 +3,8 @@ package util
 import (
 	"bufio"
 	"crypto/rand"
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/big"
 	"os"
 	"strconv"
@@ -34,6 +35,12 @@ func DeleteFiles(filePaths []string) error {
 	return nil
 }
 
+// Sha256Hex 返回 data 的 sha256 (hex 格式)。
+func Sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // HasString .
 func HasString(slice []string, item string) bool {
 	i := StringIndex(slice, item)
@@ -58,15 +65,6 @@ func DeleteFromSlice(slice []string, i int) []string {
 	return append(slice[:i], slice[i+1:]...)
 }
 
-// CreateThumb .
-func CreateThumb(imgPath, thumbPath string) error {
-	img, err := ioutil.ReadFile(imgPath)
-	if err != nil {
-		return err
-	}
-	return goutil.BytesToThumb(img, thumbPath)
-}
-
 // DifferentSlice 对比新旧 slice 的差异，并返回需要新增的项目与需要删除的项目。
 func DifferentSlice(oldSlice, newSlice []string) (toAdd, toDelete []string) {
 	// newTags 里有，oldTags 里没有的，需要添加到数据库。